@@ -0,0 +1,13 @@
+// Package js holds the javascript modeling library that rvn topology models
+// are evaluated against. The library is compiled into the rvn binary so
+// building a topology does not depend on anything installed on the host.
+package js
+
+import (
+	_ "embed"
+)
+
+// Modeling is the source of the modeling library, modeling.js
+//
+//go:embed modeling.js
+var Modeling string
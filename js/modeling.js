@@ -39,15 +39,46 @@ Node = (name, level, mounts, image, os) => ({
 //generic nic generator
 Nic = (n, speed, i) => Array(n).fill({'speed': speed, 'nic': i});
 
+// link properties that describe emulated link characteristics, these are
+// lifted out of the link props into the link's emulation
+const emulationProps = ['delay', 'jitter', 'loss', 'duplicate', 'reorder', 'rate'];
+
+// split link properties into the emulation and the remaining props
+function linkProps(props) {
+  let emulation = {};
+  let rest = {};
+  Object.keys(props).forEach(k => {
+    if(emulationProps.includes(k)) {
+      emulation[k] = props[k];
+    } else {
+      rest[k] = props[k];
+    }
+  });
+
+  return {
+    'props': rest,
+    'emulation': Object.keys(emulation).length > 0 ? emulation : undefined
+  };
+}
+
 Link = (a, pa, b, pb, props = {}) => ({
-    'endpoints': [
-      {'name': a, 'port': pa},
-      {'name': b, 'port': pb}
-    ],
-    'name': `${a}_${pa}-${b}_${pb}`,
-    'props': props
-  }
-);
+  'endpoints': [
+    {'name': a, 'port': pa},
+    {'name': b, 'port': pb}
+  ],
+  'name': `${a}_${pa}-${b}_${pb}`,
+  ...linkProps(props)
+});
+
+// a LAN connects any number of endpoints to a shared segment, endpoints are
+// given as [name, port] pairs e.g. Lan('lan0', [['a', 1], ['b', 1], ['c', 0]])
+Lan = (name, endpoints, props = {}) => ({
+  'endpoints': endpoints.map(e =>
+    Array.isArray(e) ? {'name': e[0], 'port': e[1]} : e
+  ),
+  'name': name,
+  ...linkProps(props)
+});
 
 Image = (name, arch, version) => ({
   'name': name, 
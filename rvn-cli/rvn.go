@@ -2,12 +2,15 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/ceftb/xir/tools/viz"
@@ -18,6 +21,7 @@ import (
 
 func main() {
 	log.SetFlags(0)
+	rvn.SetProgress(showProgress)
 
 	checkDir()
 
@@ -28,6 +32,8 @@ func main() {
 	switch os.Args[1] {
 	case "build":
 		doBuild()
+	case "lint":
+		doLint()
 	case "deploy":
 		doDeploy()
 	case "configure":
@@ -37,7 +43,7 @@ func main() {
 	case "destroy":
 		doDestroy()
 	case "status":
-		doStatus()
+		doStatus(os.Args[2:])
 	case "viz":
 		doViz()
 
@@ -76,6 +82,23 @@ func main() {
 			usage()
 		}
 		doWipe(os.Args[2:])
+	case "link":
+		if len(os.Args) < 4 {
+			usage()
+		}
+		doLink(os.Args[2], os.Args[3], os.Args[4:])
+	case "image":
+		if len(os.Args) < 3 {
+			usage()
+		}
+		doImage(os.Args[2], os.Args[3:])
+	case "inventory":
+		doInventory(os.Args[2:])
+	case "logs":
+		if len(os.Args) < 3 {
+			usage()
+		}
+		doLogs(os.Args[2:])
 
 	default:
 		usage()
@@ -84,19 +107,25 @@ func main() {
 
 func doBuild() {
 	checkDir()
-	err := rvn.RunModel()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	//error would happen in RunModel if LoadTopo failed
-	topo, _ := rvn.LoadTopo()
-	CheckRvnImages(topo)
+	exitOnError("build", rvn.RunModel())
+	exitOnError("build", rvn.Create())
+}
 
-	rvn.Create()
+func doLint() {
+	_, err := rvn.LoadModel(".")
+	exitOnError("lint", err)
+	log.Println(green("ok"))
 }
 
-func doStatus() {
+func doStatus(args []string) {
+
+	history := false
+	for _, a := range args {
+		if a != "--history" {
+			usage()
+		}
+		history = true
+	}
 
 	status := rvn.Status()
 	if status == nil {
@@ -104,6 +133,7 @@ func doStatus() {
 	}
 	nodes := status["nodes"].(map[string]rvn.DomStatus)
 	switches := status["switches"].(map[string]rvn.DomStatus)
+	links := status["links"].(map[string]rvn.LinkStatus)
 
 	log.Println(blue("nodes"))
 	for _, n := range nodes {
@@ -113,19 +143,76 @@ func doStatus() {
 	for _, s := range switches {
 		log.Println(domString(s))
 	}
+	log.Println(blue("links"))
+	for _, l := range links {
+		log.Println(linkString(l))
+	}
+
+	if history {
+		log.Println(blue("history"))
+		doHistory()
+	}
+
+}
+
+// doHistory prints the configuration history of every host of the topology,
+// one line per configuration phase.
+func doHistory() {
+
+	topo, err := rvn.LoadTopo()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var hosts []string
+	for _, x := range topo.Nodes {
+		hosts = append(hosts, x.Name)
+	}
+	for _, x := range topo.Switches {
+		hosts = append(hosts, x.Name)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw,
+		"HOST\tSTART\tATTEMPT\tPHASE\tPLAYBOOK\tEXIT\tDURATION\tRESULT\tLOG")
+	for _, h := range hosts {
+		history, err := rvn.ConfigHistory(topo.Name, h)
+		if err != nil {
+			log.Printf("%s: %v", h, err)
+			continue
+		}
+		for _, x := range history {
+			result := "ok"
+			if x.Error != "" {
+				result = x.Error
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%d\t%v\t%s\t%s\n",
+				h,
+				x.Start.Format("2006-01-02 15:04:05"),
+				x.Attempt,
+				x.Phase,
+				filepath.Base(x.Playbook),
+				x.ExitCode,
+				x.Duration.Duration,
+				result,
+				x.Log,
+			)
+		}
+	}
+	tw.Flush()
 
 }
 
 func doConfigure(args []string) {
 	if len(args) == 0 {
-		rvn.Configure(true)
+		exitOnError("configure", rvn.Configure(true))
 	} else {
 		topo, err := rvn.LoadTopo()
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		rvn.ConfigureNodes(topo, args)
+		exitOnError("configure", rvn.ConfigureNodes(topo, args))
 	}
 }
 
@@ -155,7 +242,7 @@ func doShutdown() {
 
 func doDestroy() {
 
-	rvn.Destroy()
+	exitOnError("destroy", rvn.Destroy())
 
 }
 
@@ -172,8 +259,15 @@ func doSsh(node string) {
 		os.Exit(1)
 	}
 
+	user, err := rvn.LoginUser(topo, node)
+	if err != nil {
+		fmt.Printf("error getting node login %v\n", err)
+		os.Exit(1)
+	}
+
 	fmt.Printf(
-		"ssh -o StrictHostKeyChecking=no -i /var/rvn/ssh/rvn rvn@%s\n", ds.IP)
+		"ssh -o StrictHostKeyChecking=no -i /var/rvn/ssh/rvn %s@%s\n",
+		user, ds.IP)
 
 }
 
@@ -229,53 +323,17 @@ func doVnc(node string) {
 
 }
 
-func doAnsible(node, yml string) {
+func doAnsible(pattern, yml string) {
 
-	topo, err := rvn.LoadTopo()
+	// the playbook runs against the whole topology, limited to the pattern, so
+	// it can address groups and look up the other hosts
+	inventory, err := rvn.WriteInventory()
 	if err != nil {
 		log.Fatal(err)
 	}
+	args := []string{"-i", inventory, "--limit", pattern, yml}
 
-	sys := topo.Name
-
-	var h *rvn.Host = nil
-	for _, x := range topo.Nodes {
-		if x.Name == node {
-			h = &x.Host
-			break
-		}
-	}
-	if h == nil {
-		for _, x := range topo.Switches {
-			if x.Name == node {
-				h = &x.Host
-				break
-			}
-		}
-	}
-	if h == nil {
-		log.Fatal("%s not found in topology", node)
-	}
-
-	ds, err := rvn.DomainStatus(sys, node)
-	if err != nil {
-		fmt.Printf("error getting node status %v\n", err)
-		os.Exit(1)
-	}
-
-	extra_vars := "ansible_become_pass=rvn"
-	if strings.ToLower(h.OS) == "freebsd" {
-		extra_vars += " ansible_python_interpreter='/usr/local/bin/python2'"
-	}
-
-	cmd := exec.Command(
-		"ansible-playbook",
-		"-i", ds.IP+",",
-		yml,
-		"--extra-vars", extra_vars,
-		`--ssh-extra-args='-i/var/rvn/ssh/rvn'`,
-		"--user=rvn", "--private-key=/var/rvn/ssh/rvn",
-	)
+	cmd := exec.Command("ansible-playbook", args...)
 	cmd.Env = append(os.Environ(), "ANSIBLE_HOST_KEY_CHECKING=False")
 
 	reader, err := cmd.StdoutPipe()
@@ -301,6 +359,68 @@ func doAnsible(node, yml string) {
 
 }
 
+func doInventory(args []string) {
+
+	inv, err := rvn.LoadInventory()
+	exitOnError("inventory", err)
+
+	// --list and --host make rvn usable as a dynamic inventory script
+	switch {
+	case len(args) == 0:
+		fmt.Print(inv.INI())
+	case args[0] == "--json" || args[0] == "--list":
+		out, err := inv.JSON()
+		exitOnError("inventory", err)
+		fmt.Println(string(out))
+	case args[0] == "--host" && len(args) > 1:
+		vars, ok := inv.HostVars[args[1]]
+		if !ok {
+			log.Fatalf("%s not found in topology", args[1])
+		}
+		out, err := json.MarshalIndent(vars, "", "  ")
+		exitOnError("inventory", err)
+		fmt.Println(string(out))
+	default:
+		usage()
+	}
+
+}
+
+func doLogs(args []string) {
+
+	follow := false
+	var node string
+	for _, a := range args {
+		switch a {
+		case "-f", "--follow":
+			follow = true
+		default:
+			if node != "" {
+				usage()
+			}
+			node = a
+		}
+	}
+	if node == "" {
+		usage()
+	}
+
+	// stop following on ctrl-c
+	stop := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		close(stop)
+	}()
+
+	err := rvn.TailLog(node, os.Stdout, follow, stop)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+}
+
 func doReboot(args []string) {
 
 	if len(args) < 1 {
@@ -317,7 +437,7 @@ func doReboot(args []string) {
 		Nodes: args[0:],
 	}
 
-	rvn.Reboot(rr)
+	exitOnError("reboot", rvn.Reboot(rr))
 
 }
 
@@ -399,11 +519,146 @@ func doWipe(args []string) {
 		log.Fatal(err)
 	}
 
+	var errs rvn.ErrorList
 	for _, x := range args {
-		err = rvn.WipeNode(topo, x)
-		if err != nil {
-			log.Printf("%v", err)
+		errs.Add(rvn.WipeNode(topo, x))
+	}
+	exitOnError("wipe", errs.Err())
+
+}
+
+// exitOnError prints a summary of everything that went wrong with the named
+// operation, one line per failed resource, and exits non-zero. If err is nil
+// it does nothing.
+func exitOnError(what string, err error) {
+	if err == nil {
+		return
+	}
+
+	errs, ok := err.(rvn.ErrorList)
+	if !ok {
+		errs = rvn.ErrorList{err}
+	}
+
+	log.Printf("%s %d error(s)", red(what+" failed:"), len(errs))
+	for _, e := range errs {
+		if re, ok := e.(*rvn.ResourceError); ok {
+			log.Printf("  %s %s %s: %v",
+				re.Kind, bold(re.Name), yellow(re.Step), re.Err)
+		} else if le, ok := e.(*rvn.LintError); ok {
+			log.Printf("  %s: %s", yellow(le.Location), le.Msg)
+		} else {
+			log.Printf("  %v", e)
+		}
+	}
+	os.Exit(1)
+}
+
+func doLink(link, op string, args []string) {
+
+	var err error
+	switch op {
+	case "up":
+		err = rvn.SetLinkState(link, true)
+	case "down":
+		err = rvn.SetLinkState(link, false)
+	case "set":
+		if len(args) == 0 {
+			usage()
+		}
+		err = rvn.SetLinkEmulation(link, args, false)
+	case "clear":
+		err = rvn.SetLinkEmulation(link, nil, true)
+	default:
+		usage()
+	}
+	exitOnError("link", err)
+
+}
+
+func doImage(op string, args []string) {
+
+	if op == "list" {
+		images, err := rvn.ListImages()
+		exitOnError("image list", err)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "IMAGE\tFORMAT\tSIZE\tDISK\tBACKING")
+		for _, x := range images {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+				x.Name,
+				x.Format,
+				humanSize(x.VirtualSize),
+				humanSize(x.ActualSize),
+				strings.Join(x.Backing, " -> "),
+			)
 		}
+		tw.Flush()
+		return
+	}
+
+	if len(args) < 1 {
+		usage()
+	}
+	ref := args[0]
+
+	switch op {
+	case "pull":
+		path, err := rvn.PullImage(ref)
+		exitOnError("image pull", err)
+		fmt.Println(path)
+	case "rm":
+		exitOnError("image rm", rvn.RemoveImage(ref))
+	case "build":
+		path, err := rvn.BuildImage(ref)
+		exitOnError("image build", err)
+		fmt.Println(path)
+	case "save":
+		if len(args) < 2 {
+			usage()
+		}
+		path, err := rvn.SaveImage(ref, args[1])
+		exitOnError("image save", err)
+		fmt.Println(path)
+	case "info":
+		info, err := rvn.GetImageInfo(ref)
+		exitOnError("image info", err)
+		fmt.Printf("%s %s\n", blue("name:"), info.Name)
+		fmt.Printf("%s %s\n", blue("path:"), info.Path)
+		fmt.Printf("%s %s\n", blue("format:"), info.Format)
+		fmt.Printf("%s %s\n", blue("size:"), humanSize(info.VirtualSize))
+		fmt.Printf("%s %s\n", blue("disk:"), humanSize(info.ActualSize))
+		for i, x := range info.Backing {
+			fmt.Printf("%s %s\n", blue(fmt.Sprintf("backing[%d]:", i)), x)
+		}
+		m, err := rvn.LoadImageManifest(ref)
+		exitOnError("image info", err)
+		if m != nil {
+			fmt.Printf("%s\n", blue("manifest:"))
+			for _, x := range []struct{ k, v string }{
+				{"arch", m.Arch},
+				{"platform", m.Platform},
+				{"os", m.OS},
+				{"nic", m.Nic},
+				{"user", m.User},
+				{"become", m.Become},
+				{"python", m.Python},
+			} {
+				if x.v != "" {
+					fmt.Printf("  %s %s\n", blue(x.k+":"), x.v)
+				}
+			}
+			if m.Disktype != nil {
+				fmt.Printf("  %s %s/%s\n",
+					blue("disktype:"), m.Disktype.Bus, m.Disktype.Dev)
+			}
+		}
+		users, err := rvn.ImageUsers(info.Path)
+		exitOnError("image info", err)
+		for _, x := range users {
+			fmt.Printf("%s %s\n", blue("used by:"), x)
+		}
+	default:
+		usage()
 	}
 
 }
@@ -415,19 +670,69 @@ func checkDir() {
 	}
 }
 
+// lastProgress is the download progress that was last shown
+var lastProgress = struct {
+	url     string
+	percent int64
+}{}
+
+// showProgress shows the progress of a download on a single line, updating it
+// each time another percent has been downloaded.
+func showProgress(url string, done, total int64) {
+	if total <= 0 {
+		return
+	}
+	percent := done * 100 / total
+	if url == lastProgress.url && percent == lastProgress.percent {
+		return
+	}
+	lastProgress.url, lastProgress.percent = url, percent
+
+	fmt.Fprintf(os.Stderr, "\r%s %3d%% %s/%s", url, percent,
+		humanSize(done), humanSize(total))
+	if done >= total {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func humanSize(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	f, i := float64(n), 0
+	for ; f >= 1024 && i < len(units)-1; i++ {
+		f /= 1024
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d%s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", f, units[i])
+}
+
 func domString(ds rvn.DomStatus) string {
 	state := ds.State
 	if state == "running" {
 		state = green(state)
 	}
-	return fmt.Sprintf(
+	s := fmt.Sprintf(
 		"  %s %s %s %s", ds.Name, state, yellow(ds.ConfigState), ds.IP)
+	if ds.ConfigLog != "" {
+		s += fmt.Sprintf(" (see %s)", ds.ConfigLog)
+	}
+	return s
+}
+
+func linkString(ls rvn.LinkStatus) string {
+	state := ls.State
+	if state == "up" {
+		state = green(state)
+	}
+	return fmt.Sprintf("  %s %s %s", ls.Name, state, yellow(ls.Emulation.String()))
 }
 
 func usage() {
 	s := red("usage:\n")
-	s += fmt.Sprintf("  %s [%s | %s | %s | %s | %s | %s | %s] \n", blue("rvn"),
+	s += fmt.Sprintf("  %s [%s | %s | %s | %s | %s | %s | %s | %s] \n", blue("rvn"),
 		green("build"),
+		green("lint"),
 		green("deploy"),
 		green("configure"),
 		green("shutdown"),
@@ -435,6 +740,7 @@ func usage() {
 		green("status"),
 		green("viz"),
 	)
+	s += fmt.Sprintf("  %s %s --history\n", blue("rvn"), green("status"))
 	s += fmt.Sprintf("  %s %s node\n", blue("rvn"), green("ssh"))
 	s += fmt.Sprintf("  %s %s node\n", blue("rvn"), green("ip"))
 	s += fmt.Sprintf("  %s %s node\n", blue("rvn"), green("vnc"))
@@ -442,7 +748,18 @@ func usage() {
 	s += fmt.Sprintf("  %s %s node-1 ... node-n\n", blue("rvn"), green("reboot"))
 	s += fmt.Sprintf("  %s %s node-1 ... node-n\n", blue("rvn"), green("pingwait"))
 	s += fmt.Sprintf("  %s %s node-1 ... node-n\n", blue("rvn"), green("wipe"))
-	s += fmt.Sprintf("  %s %s node script.yml", blue("rvn"), green("ansible"))
+	s += fmt.Sprintf("  %s %s link [up | down | clear]\n", blue("rvn"), green("link"))
+	s += fmt.Sprintf("  %s %s link set delay=50ms loss=1%% ...\n",
+		blue("rvn"), green("link"))
+	s += fmt.Sprintf("  %s %s [list | pull image | rm image | info image]\n",
+		blue("rvn"), green("image"))
+	s += fmt.Sprintf("  %s %s save node name\n", blue("rvn"), green("image"))
+	s += fmt.Sprintf("  %s %s build spec.yml\n", blue("rvn"), green("image"))
+	s += fmt.Sprintf("  %s %s [--json | --host node]\n", blue("rvn"),
+		green("inventory"))
+	s += fmt.Sprintf("  %s %s node [--follow]\n", blue("rvn"), green("logs"))
+	s += fmt.Sprintf("  %s %s node|group|pattern script.yml", blue("rvn"),
+		green("ansible"))
 
 	log.Fatal(s)
 }
@@ -457,122 +774,3 @@ var red = color.New(color.FgRed).SprintFunc()
 var redb = color.New(color.FgRed, color.Bold).SprintFunc()
 var yellow = color.New(color.FgYellow).SprintFunc()
 var bold = color.New(color.Bold).SprintFunc()
-
-func CheckRvnImages(topo rvn.Topo) {
-	var images []string
-	// NOTE: moving over to an extentionless naming scheme
-	// for each Node, get the image required
-	for i := range topo.Nodes {
-		var currentImg string = topo.Nodes[i].Host.Image
-		// no way to check existance
-		var exists bool = false
-		for j := range images {
-			if currentImg == images[j] {
-				exists = true
-				break
-			}
-		}
-		// we did not find image, add it to our image list
-		if !exists {
-			images = append(images, currentImg)
-		}
-	}
-	for i := range topo.Switches {
-		var currentImg string = topo.Switches[i].Host.Image
-		// no way to check existance
-		var exists bool = false
-		for j := range images {
-			if currentImg == images[j] {
-				exists = true
-				break
-			}
-		}
-		// we did not find image, add it to our image list
-		if !exists {
-			images = append(images, currentImg)
-		}
-	}
-
-	// for each unique image, check that it exists, if not, download it
-	for i := range images {
-		// parse the uri reference (with golang url parser)
-		parsedURL := rvn.ValidateURL(images[i])
-
-		// NOTE: local images need to be prefixed with absolute path or ./
-		remoteHost := parsedURL.Host
-
-		// there is no remote host, so the image is local
-		if remoteHost == "" {
-			// very first thing, check if url is nil or empty, then we need to create
-			// a netboot image if it does not exist
-			if parsedURL.String() == "" {
-				err := rvn.CreateNetbootImage()
-				if err != nil {
-					log.Fatalln(err)
-				}
-				break
-			}
-			// check if this is local image path, or deterlab path
-			splitPath := strings.Split(images[i], "/")
-			// a local image must be prefixed with atleast one slash, / or ./, therefore
-			// we can check the length of of the split on / to determin if deterlab or local image
-			if len(splitPath) > 1 {
-				// place user images in /var/rvn/img/user
-				filePath := filepath.Join("/var/rvn/img/user/", splitPath[len(splitPath)-1])
-				_, err := os.Stat(filePath)
-				// if file exists, copy file to /var/rvn/img
-				if err != nil {
-					_, err = os.Stat(images[i])
-					if err != nil {
-						log.Fatalln("Copy failed - make sure if relative paths accessable by root (~)")
-						log.Fatalln(err)
-					} else {
-						// no error, so image does exist, so lets copy from path to /var/rvn/img
-						log.Println("Downloading from: " + images[i] + " to: " + filePath)
-						err = rvn.CopyLocalFile(images[i], filePath)
-						if err != nil {
-							log.Fatalln(err)
-						}
-					}
-				}
-				// if len == 1, we are given a name, we assume the named image is hosted on deterlab
-			} else {
-				// official images go in /var/rvn/img
-				filePath := filepath.Join("/var/rvn/img/", images[i])
-				_, err := os.Stat(filePath)
-				// if there is an err, file does not exist, download it
-				if err != nil {
-					remotePath := "https://mirror.deterlab.net/rvn/img/" + images[i]
-					log.Println("copying : " + remotePath + " to: " + filePath)
-					var dl_err error = rvn.DownloadFile(filePath, remotePath)
-					// we tried to find the image on deterlab mirror, but could not, error
-					if dl_err != nil {
-						log.Fatalln(dl_err)
-					}
-				}
-			}
-			// if the host is remote, we should assume we are going off-world to get image
-		} else {
-			subPath, imageName, err := rvn.ParseURL(parsedURL)
-			if err != nil {
-				log.Fatalf("error validating URL: %v\n", err)
-			}
-			filePath := filepath.Join("/var/rvn/img/user/", subPath)
-			_, err = os.Stat(filepath.Join(filePath, imageName))
-			// path to image does not exist, we will need to download it
-			if err != nil {
-				// first we create all the subdirectorys in the file path
-				cr_err := os.MkdirAll(filePath, 0755)
-				if cr_err != nil {
-					log.Fatalln(cr_err)
-				}
-				// now try to download the image to the correct lcoation
-				log.Println("copying: " + parsedURL.String() + " to: " + filePath + imageName)
-				dl_err := rvn.DownloadURL(parsedURL, filePath, imageName)
-				if dl_err != nil {
-					log.Fatalln(dl_err)
-				}
-			}
-		}
-	}
-}
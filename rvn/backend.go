@@ -0,0 +1,108 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file defines the backend abstraction of rvn. A backend is the thing
+ * that actually materializes a topology: it defines, starts and stops domains
+ * and networks, creates instance images and sets up the host plumbing those
+ * domains and networks depend on. The lifecycle functions (Create, Launch,
+ * Destroy ...) only ever talk to the active backend, which by default is
+ * libvirt.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	xlibvirt "github.com/libvirt/libvirt-go-xml"
+)
+
+// Types ======================================================================
+
+// Backend is the interface rvn uses to manage the virtual machines and
+// networks that make up a topology. All names passed to a backend are fully
+// qualified, e.g. 'topo_node'.
+type Backend interface {
+
+	// Domains ------------------------------------------------------------------
+
+	// DefineDomain defines the domain, replacing any existing definition with
+	// the same name.
+	DefineDomain(d *xlibvirt.Domain) error
+	// UndefineDomain stops the domain if it is running and removes its
+	// definition. It is not an error to undefine a domain that does not exist.
+	UndefineDomain(name string) error
+	StartDomain(name string) error
+	// ShutdownDomain gracefully shuts down a domain.
+	ShutdownDomain(name string) error
+	// RebootDomain reboots a domain, if reset is true the domain is hard reset.
+	RebootDomain(name string, reset bool) error
+	DomainActive(name string) (bool, error)
+	// DomainState returns the runtime state of a domain. Only the State, IP
+	// and Macs fields of the result are filled in by the backend.
+	DomainState(name string) (DomStatus, error)
+	DomainInfo(name string) (*xlibvirt.Domain, error)
+	// ListDomains returns the names of all domains the backend knows about,
+	// including those of topologies rvn has no record of.
+	ListDomains() ([]string, error)
+
+	// Networks -----------------------------------------------------------------
+
+	// DefineNetwork defines the network, replacing any existing definition with
+	// the same name.
+	DefineNetwork(n *xlibvirt.Network) error
+	// UndefineNetwork stops the network if it is active and removes its
+	// definition. It is not an error to undefine a network that does not exist.
+	UndefineNetwork(name string) error
+	StartNetwork(name string) error
+	NetworkActive(name string) (bool, error)
+	// EmulateLink applies the emulation to the interfaces of every running
+	// domain attached to the network. A nil or empty emulation removes any
+	// emulation from the network.
+	EmulateLink(name string, e *Emulation) error
+	// SetLinkState brings an active network up or down, a network that is down
+	// does not carry any traffic between its domains.
+	SetLinkState(name string, up bool) error
+
+	// Host plumbing ------------------------------------------------------------
+
+	// SetupLinkNetwork prepares the host side of an active link network, e.g.
+	// allowing LLDP and BOOTP across the bridge.
+	SetupLinkNetwork(name string) error
+	CleanupLinkNetwork(name string) error
+	// SetupTestNetwork prepares the host side of an active test (management)
+	// network, e.g. allowing NFS traffic from the network to the host.
+	SetupTestNetwork(name string) error
+	CleanupTestNetwork(name string) error
+	// Export publishes the NFS exports table at path under the given name.
+	Export(name, path string) error
+	Unexport(name string) error
+
+	// Images -------------------------------------------------------------------
+
+	// CreateImage creates a copy on write instance image at path that is backed
+	// by the base image at backing. If size is not zero the instance image is
+	// grown to size bytes.
+	CreateImage(path, backing string, size int64) error
+	// CreateDisk creates a blank disk image of size bytes at path in the given
+	// format.
+	CreateDisk(path, format string, size int64) error
+	// ImageInfo returns the format, size and backing chain of the image at path.
+	ImageInfo(path string) (*ImageInfo, error)
+	// ConvertImage writes a standalone qcow2 copy of the image at src, with its
+	// backing chain flattened into it, to dst. If compress is true the copy is
+	// compressed.
+	ConvertImage(src, dst string, compress bool) error
+	// CreateISO creates an iso image at path with the given volume label that
+	// holds the given files, by name.
+	CreateISO(path, label string, files map[string][]byte) error
+}
+
+// Variables ==================================================================
+
+var backend Backend = &LibvirtBackend{}
+
+// Functions ==================================================================
+
+// SetBackend sets the backend used by all rvn lifecycle functions.
+func SetBackend(b Backend) {
+	backend = b
+}
@@ -0,0 +1,928 @@
+package rvn
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	xlibvirt "github.com/libvirt/libvirt-go-xml"
+)
+
+// Fake backend ===============================================================
+
+type memDomain struct {
+	Def    *xlibvirt.Domain
+	Active bool
+	Boots  int
+	// IP is the address the domain reports while it is running
+	IP string
+}
+
+type memNetwork struct {
+	Def       *xlibvirt.Network
+	Active    bool
+	Setup     bool
+	Down      bool
+	Emulation *Emulation
+}
+
+// memBackend is an in memory Backend for testing the rvn lifecycle functions
+// without a libvirt host.
+type memBackend struct {
+	Domains  map[string]*memDomain
+	Networks map[string]*memNetwork
+	Images   map[string]string
+	Exports  map[string]string
+	// Sizes holds the size of every image and disk created
+	Sizes map[string]int64
+	// ISOs holds the label and files of every iso created
+	ISOs map[string]map[string]string
+
+	// Lease is the address given to domains as they are defined
+	Lease string
+
+	// Fail holds errors to inject, keyed by operation and resource name, e.g.
+	// 'define:topo_a'.
+	Fail map[string]error
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{
+		Domains:  make(map[string]*memDomain),
+		Networks: make(map[string]*memNetwork),
+		Images:   make(map[string]string),
+		Exports:  make(map[string]string),
+		Sizes:    make(map[string]int64),
+		ISOs:     make(map[string]map[string]string),
+		Fail:     make(map[string]error),
+	}
+}
+
+func (b *memBackend) fail(op, name string) error {
+	return b.Fail[op+":"+name]
+}
+
+func (b *memBackend) domain(name string) (*memDomain, error) {
+	d, ok := b.Domains[name]
+	if !ok {
+		return nil, fmt.Errorf("domain %s not found", name)
+	}
+	return d, nil
+}
+
+func (b *memBackend) network(name string) (*memNetwork, error) {
+	n, ok := b.Networks[name]
+	if !ok {
+		return nil, fmt.Errorf("network %s not found", name)
+	}
+	return n, nil
+}
+
+func (b *memBackend) DefineDomain(d *xlibvirt.Domain) error {
+	if d == nil {
+		return fmt.Errorf("nil domain")
+	}
+	if err := b.fail("define", d.Name); err != nil {
+		return err
+	}
+	b.Domains[d.Name] = &memDomain{Def: d, IP: b.Lease}
+	return nil
+}
+
+func (b *memBackend) UndefineDomain(name string) error {
+	delete(b.Domains, name)
+	return nil
+}
+
+func (b *memBackend) StartDomain(name string) error {
+	d, err := b.domain(name)
+	if err != nil {
+		return err
+	}
+	if d.Active {
+		return fmt.Errorf("domain %s already active", name)
+	}
+	d.Active = true
+	d.Boots++
+	return nil
+}
+
+func (b *memBackend) ShutdownDomain(name string) error {
+	d, err := b.domain(name)
+	if err != nil {
+		return err
+	}
+	d.Active = false
+	return nil
+}
+
+func (b *memBackend) RebootDomain(name string, reset bool) error {
+	d, err := b.domain(name)
+	if err != nil {
+		return err
+	}
+	d.Boots++
+	return nil
+}
+
+func (b *memBackend) DomainActive(name string) (bool, error) {
+	d, err := b.domain(name)
+	if err != nil {
+		return false, err
+	}
+	return d.Active, nil
+}
+
+func (b *memBackend) DomainState(name string) (DomStatus, error) {
+	d, err := b.domain(name)
+	if err != nil {
+		return DomStatus{}, err
+	}
+	if d.Active {
+		return DomStatus{State: "running", IP: d.IP}, nil
+	}
+	return DomStatus{State: "off"}, nil
+}
+
+func (b *memBackend) DomainInfo(name string) (*xlibvirt.Domain, error) {
+	d, err := b.domain(name)
+	if err != nil {
+		return nil, err
+	}
+	return d.Def, nil
+}
+
+func (b *memBackend) ListDomains() ([]string, error) {
+	var names []string
+	for name := range b.Domains {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (b *memBackend) DefineNetwork(n *xlibvirt.Network) error {
+	if err := b.fail("define", n.Name); err != nil {
+		return err
+	}
+	b.Networks[n.Name] = &memNetwork{Def: n}
+	return nil
+}
+
+func (b *memBackend) UndefineNetwork(name string) error {
+	delete(b.Networks, name)
+	return nil
+}
+
+func (b *memBackend) StartNetwork(name string) error {
+	n, err := b.network(name)
+	if err != nil {
+		return err
+	}
+	n.Active = true
+	return nil
+}
+
+func (b *memBackend) NetworkActive(name string) (bool, error) {
+	n, err := b.network(name)
+	if err != nil {
+		return false, err
+	}
+	return n.Active, nil
+}
+
+func (b *memBackend) EmulateLink(name string, e *Emulation) error {
+	n, err := b.network(name)
+	if err != nil {
+		return err
+	}
+	if !n.Active {
+		return fmt.Errorf("network %s not active", name)
+	}
+	n.Emulation = e
+	return nil
+}
+
+func (b *memBackend) SetLinkState(name string, up bool) error {
+	n, err := b.network(name)
+	if err != nil {
+		return err
+	}
+	if !n.Active {
+		return fmt.Errorf("network %s not active", name)
+	}
+	n.Down = !up
+	return nil
+}
+
+func (b *memBackend) SetupLinkNetwork(name string) error {
+	if err := b.fail("setup", name); err != nil {
+		return err
+	}
+	n, err := b.network(name)
+	if err != nil {
+		return err
+	}
+	n.Setup = true
+	return nil
+}
+
+func (b *memBackend) CleanupLinkNetwork(name string) error {
+	if n, ok := b.Networks[name]; ok {
+		n.Setup = false
+	}
+	return nil
+}
+
+func (b *memBackend) SetupTestNetwork(name string) error {
+	return b.SetupLinkNetwork(name)
+}
+
+func (b *memBackend) CleanupTestNetwork(name string) error {
+	return b.CleanupLinkNetwork(name)
+}
+
+func (b *memBackend) Export(name, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	b.Exports[name] = string(data)
+	return nil
+}
+
+func (b *memBackend) Unexport(name string) error {
+	delete(b.Exports, name)
+	return nil
+}
+
+func (b *memBackend) CreateImage(path, backing string, size int64) error {
+	if err := b.fail("image", path); err != nil {
+		return err
+	}
+	b.Images[path] = backing
+	b.Sizes[path] = size
+	return nil
+}
+
+func (b *memBackend) CreateDisk(path, format string, size int64) error {
+	if err := b.fail("disk", path); err != nil {
+		return err
+	}
+	b.Images[path] = ""
+	b.Sizes[path] = size
+	return ioutil.WriteFile(path, nil, 0644)
+}
+
+func (b *memBackend) ConvertImage(src, dst string, compress bool) error {
+	if err := b.fail("convert", src); err != nil {
+		return err
+	}
+	if _, ok := b.Images[src]; !ok {
+		return fmt.Errorf("image %s not found", src)
+	}
+	op := "flattened "
+	if compress {
+		op = "compressed "
+	}
+	return ioutil.WriteFile(dst, []byte(op+src), 0644)
+}
+
+func (b *memBackend) CreateISO(
+	path, label string, files map[string][]byte) error {
+	if err := b.fail("iso", path); err != nil {
+		return err
+	}
+	iso := map[string]string{"label": label}
+	for name, data := range files {
+		iso[name] = string(data)
+	}
+	b.ISOs[path] = iso
+	return nil
+}
+
+func (b *memBackend) ImageInfo(path string) (*ImageInfo, error) {
+	info := &ImageInfo{Path: path, Format: "qcow2"}
+	backing, ok := b.Images[path]
+	if !ok {
+		// base images are real files
+		st, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		info.Format = "raw"
+		info.VirtualSize, info.ActualSize = st.Size(), st.Size()
+		return info, nil
+	}
+	for backing != "" {
+		info.Backing = append(info.Backing, backing)
+		backing = b.Images[backing]
+	}
+	return info, nil
+}
+
+// memStore is an in memory Store for testing.
+type memStore map[string]string
+
+func (s memStore) Get(key string) (string, error) {
+	v, ok := s[key]
+	if !ok {
+		return "", fmt.Errorf("%s not found", key)
+	}
+	return v, nil
+}
+
+func (s memStore) Set(key, value string) error {
+	s[key] = value
+	return nil
+}
+
+func (s memStore) Del(keys ...string) error {
+	for _, k := range keys {
+		delete(s, k)
+	}
+	return nil
+}
+
+// Test environment ===========================================================
+
+var testTopo = Topo{
+	Name: "lifecycle",
+	Nodes: []Node{
+		{Host{Name: "a", Image: "debian-stretch", OS: "linux"}},
+		{Host{Name: "b", Image: "debian-stretch", OS: "linux"}},
+	},
+	Switches: []Zwitch{
+		{Host{Name: "sw", Image: "cumulusvx-3.5", OS: "linux"}},
+	},
+	Links: []Link{
+		{Name: "a_0-sw_1", Endpoints: []Endpoint{{"a", 0}, {"sw", 1}}},
+		{Name: "b_0-sw_2", Endpoints: []Endpoint{{"b", 0}, {"sw", 2}}},
+	},
+}
+
+// withTestEnv runs f from a scratch working directory containing the topology
+// as a built (but not created) rvn system, with the rvn backend and store
+// replaced by in memory fakes.
+func withTestEnv(t *testing.T, topo Topo, f func(*memBackend, memStore)) {
+
+	pkgDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "rvn-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := struct {
+		backend                                  Backend
+		store                                    Store
+		runtime, templateDir, imageDir, settings string
+	}{backend, store, runtimeFile, templateDir, imageDir, settingsFile}
+
+	defer func() {
+		os.Chdir(pkgDir)
+		os.RemoveAll(dir)
+		backend, store = saved.backend, saved.store
+		runtimeFile, templateDir = saved.runtime, saved.templateDir
+		imageDir, settingsFile = saved.imageDir, saved.settings
+	}()
+
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templateDir = pkgDir
+	runtimeFile = dir + "/run"
+	imageDir = dir + "/img"
+	settingsFile = dir + "/rvn.yml"
+	err = ioutil.WriteFile(runtimeFile, []byte("{}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topo.Dir = dir
+	buf, err := json.MarshalIndent(topo, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(".rvn", 0755)
+	err = ioutil.WriteFile(".rvn/topo.json", buf, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, s := newMemBackend(), make(memStore)
+	SetBackend(b)
+	SetStore(s)
+
+	f(b, s)
+}
+
+// Tests ======================================================================
+
+func TestCreate(t *testing.T) {
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		err := Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, x := range []string{"a", "b", "sw"} {
+			d, ok := b.Domains["lifecycle_"+x]
+			if !ok {
+				t.Fatalf("domain %s not defined", x)
+			}
+			// test network + one link each for the nodes, two for the switch
+			expected := 2
+			if x == "sw" {
+				expected = 3
+			}
+			if len(d.Def.Devices.Interfaces) != expected {
+				t.Errorf("%s: expected %d interfaces, got %d",
+					x, expected, len(d.Def.Devices.Interfaces))
+			}
+			if d.Active {
+				t.Errorf("%s: create should not start domains", x)
+			}
+		}
+
+		for _, x := range []string{"test", "a_0-sw_1", "b_0-sw_2"} {
+			if _, ok := b.Networks["lifecycle_"+x]; !ok {
+				t.Errorf("network %s not defined", x)
+			}
+		}
+
+		wd, _ := WkDir()
+		if b.Images[wd+"/a"] != imageDir+"/debian-stretch" {
+			t.Errorf("bad backing image for a: %s", b.Images[wd+"/a"])
+		}
+		if b.Images[wd+"/sw"] != imageDir+"/cumulusvx-3.5" {
+			t.Errorf("bad backing image for sw: %s", b.Images[wd+"/sw"])
+		}
+
+		// exports need the addresses of the hosts, they wait for configure
+		if _, ok := b.Exports["lifecycle"]; ok {
+			t.Errorf("nfs exports published before hosts have addresses")
+		}
+
+		topo, err := LoadTopo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if topo.MgmtIp != "172.22.0.1" {
+			t.Errorf("unexpected management ip %s", topo.MgmtIp)
+		}
+
+	})
+}
+
+func TestCreateErrors(t *testing.T) {
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		wd, _ := WkDir()
+		b.Fail["image:"+wd+"/b"] = fmt.Errorf("disk full")
+		b.Fail["define:lifecycle_sw"] = fmt.Errorf("bad xml")
+		b.Fail["define:lifecycle_a_0-sw_1"] = fmt.Errorf("bad bridge")
+
+		err := Create()
+		errs, ok := err.(ErrorList)
+		if !ok {
+			t.Fatalf("expected an ErrorList, got %v", err)
+		}
+
+		expected := map[string]bool{
+			"node b: image: disk full":             false,
+			"switch sw: define: bad xml":           false,
+			"network a_0-sw_1: define: bad bridge": false,
+		}
+		for _, e := range errs {
+			if _, ok := e.(*ResourceError); !ok {
+				t.Errorf("expected a ResourceError, got %v", e)
+			}
+			if _, ok := expected[e.Error()]; !ok {
+				t.Errorf("unexpected error %v", e)
+			}
+			expected[e.Error()] = true
+		}
+		for e, seen := range expected {
+			if !seen {
+				t.Errorf("missing error %s", e)
+			}
+		}
+
+		// everything that did not fail is still defined
+		if _, ok := b.Domains["lifecycle_a"]; !ok {
+			t.Errorf("domain a not defined")
+		}
+		if _, ok := b.Networks["lifecycle_b_0-sw_2"]; !ok {
+			t.Errorf("network b_0-sw_2 not defined")
+		}
+
+	})
+}
+
+func TestCreateBadLink(t *testing.T) {
+	topo := testTopo
+	topo.Links = append([]Link{}, testTopo.Links...)
+	topo.Links = append(topo.Links, Link{
+		Name:      "a_1-c_0",
+		Endpoints: []Endpoint{{"a", 1}, {"c", 0}},
+	})
+
+	withTestEnv(t, topo, func(b *memBackend, s memStore) {
+
+		err := Create()
+		if err == nil {
+			t.Fatal("expected error for link to unknown host")
+		}
+		if !strings.Contains(err.Error(), "link a_1-c_0: resolve") {
+			t.Errorf("unexpected error %v", err)
+		}
+		if len(b.Domains) != 0 {
+			t.Errorf("domains defined for topology with bad link")
+		}
+
+	})
+}
+
+func TestCreateLan(t *testing.T) {
+	topo := testTopo
+	topo.Links = append([]Link{}, testTopo.Links...)
+	topo.Links = append(topo.Links, Link{
+		Name:      "lan0",
+		Endpoints: []Endpoint{{"a", 1}, {"b", 1}, {"sw", 0}},
+	})
+
+	withTestEnv(t, topo, func(b *memBackend, s memStore) {
+
+		err := Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := b.Networks["lifecycle_lan0"]; !ok {
+			t.Fatal("lan network not defined")
+		}
+		for _, x := range []string{"a", "b", "sw"} {
+			found := false
+			for _, ifx := range b.Domains["lifecycle_"+x].Def.Devices.Interfaces {
+				if ifx.Source.Network.Network == "lifecycle_lan0" {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%s not plugged into lan", x)
+			}
+		}
+
+	})
+}
+
+func TestLaunch(t *testing.T) {
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		Create()
+		errs := Launch()
+		if len(errs) != 0 {
+			t.Fatalf("launch failed: %v", errs)
+		}
+
+		for name, d := range b.Domains {
+			if !d.Active {
+				t.Errorf("domain %s not started", name)
+			}
+		}
+		for name, n := range b.Networks {
+			if !n.Active || !n.Setup {
+				t.Errorf("network %s not started", name)
+			}
+		}
+
+		// launching a running system is a no-op
+		errs = Launch()
+		if len(errs) != 0 {
+			t.Fatalf("relaunch failed: %v", errs)
+		}
+		if b.Domains["lifecycle_a"].Boots != 1 {
+			t.Errorf("relaunch restarted running domain")
+		}
+
+		// the test network is set up again even though it is running
+		b.Networks["lifecycle_test"].Setup = false
+		Launch()
+		if !b.Networks["lifecycle_test"].Setup {
+			t.Errorf("running test network not set up on relaunch")
+		}
+
+		// setup failures are reported
+		b.Fail["setup:lifecycle_test"] = fmt.Errorf("no bridge")
+		b.Fail["setup:lifecycle_a_0-sw_1"] = fmt.Errorf("no bridge")
+		b.Networks["lifecycle_a_0-sw_1"].Active = false
+		errs = Launch()
+		if len(errs) != 2 {
+			t.Errorf("expected 2 setup errors, got %v", errs)
+		}
+
+	})
+}
+
+func TestLaunchEmulation(t *testing.T) {
+	topo := testTopo
+	topo.Links = append([]Link{}, testTopo.Links...)
+	topo.Links[0].Emulation = &Emulation{Delay: "50ms", Loss: "1%"}
+
+	withTestEnv(t, topo, func(b *memBackend, s memStore) {
+
+		Create()
+		errs := Launch()
+		if len(errs) != 0 {
+			t.Fatalf("launch failed: %v", errs)
+		}
+
+		e := b.Networks["lifecycle_a_0-sw_1"].Emulation
+		if e == nil || e.Delay != "50ms" || e.Loss != "1%" {
+			t.Errorf("emulation not applied: %v", e)
+		}
+		if b.Networks["lifecycle_b_0-sw_2"].Emulation != nil {
+			t.Errorf("emulation applied to plain link")
+		}
+
+		links := Status()["links"].(map[string]LinkStatus)
+		if links["a_0-sw_1"].Emulation.String() != "delay=50ms loss=1%" {
+			t.Errorf("bad emulation status %v", links["a_0-sw_1"].Emulation)
+		}
+
+		// wiping a node reapplies the emulation to its links
+		b.Networks["lifecycle_a_0-sw_1"].Emulation = nil
+		topo, err := LoadTopo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = WipeNode(topo, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Networks["lifecycle_a_0-sw_1"].Emulation == nil {
+			t.Errorf("emulation not reapplied after wipe")
+		}
+
+	})
+}
+
+func TestLinkManipulation(t *testing.T) {
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		Create()
+		Launch()
+		n := b.Networks["lifecycle_a_0-sw_1"]
+
+		err := SetLinkState("a_0-sw_1", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !n.Down {
+			t.Errorf("link not taken down")
+		}
+
+		err = SetLinkEmulation("a_0-sw_1", []string{"delay=50ms", "loss=1%"}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = SetLinkEmulation("a_0-sw_1", []string{"loss=", "rate=1gbit"}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Emulation.String() != "delay=50ms rate=1gbit" {
+			t.Errorf("bad emulation applied %v", n.Emulation)
+		}
+
+		links := Status()["links"].(map[string]LinkStatus)
+		l := links["a_0-sw_1"]
+		if l.State != "down" || l.Emulation.String() != "delay=50ms rate=1gbit" {
+			t.Errorf("bad link status %+v", l)
+		}
+
+		// state survives a redeploy
+		n.Active, n.Down, n.Emulation = false, false, nil
+		Launch()
+		if !n.Down || n.Emulation.String() != "delay=50ms rate=1gbit" {
+			t.Errorf("link state not restored on launch %+v", n)
+		}
+
+		err = SetLinkState("a_0-sw_1", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = SetLinkEmulation("a_0-sw_1", nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Down || n.Emulation != nil {
+			t.Errorf("link not restored %+v", n)
+		}
+
+		if SetLinkState("nope", false) == nil {
+			t.Errorf("expected error for unknown link")
+		}
+		if SetLinkEmulation("a_0-sw_1", []string{"delay=soon"}, false) == nil {
+			t.Errorf("expected error for bad emulation")
+		}
+
+	})
+}
+
+func TestLaunchNotCreated(t *testing.T) {
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		errs := Launch()
+		// 3 domains, 2 links and the test network
+		if len(errs) != 6 {
+			t.Fatalf("expected 6 launch errors, got %d: %v", len(errs), errs)
+		}
+
+	})
+}
+
+func TestReboot(t *testing.T) {
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		Create()
+		Launch()
+
+		err := Reboot(RebootRequest{Topo: "lifecycle", Nodes: []string{"a", "sw"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Domains["lifecycle_a"].Boots != 2 {
+			t.Errorf("a not rebooted")
+		}
+
+		// every host that could not be rebooted is reported
+		err = Reboot(RebootRequest{Topo: "lifecycle", Nodes: []string{"x", "a"}})
+		errs, ok := err.(ErrorList)
+		if !ok || len(errs) != 1 ||
+			!strings.HasPrefix(errs[0].Error(), "node x: reboot:") {
+			t.Errorf("expected reboot failure for x, got %v", err)
+		}
+
+	})
+}
+
+func TestStatus(t *testing.T) {
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		Create()
+		Launch()
+		b.Domains["lifecycle_b"].Active = false
+		s.Set("config_state:lifecycle:a", "success")
+
+		status := Status()
+		nodes := status["nodes"].(map[string]DomStatus)
+		switches := status["switches"].(map[string]DomStatus)
+		links := status["links"].(map[string]LinkStatus)
+
+		if nodes["a"].State != "running" || nodes["a"].ConfigState != "success" {
+			t.Errorf("bad status for a: %+v", nodes["a"])
+		}
+		if nodes["b"].State != "off" {
+			t.Errorf("bad status for b: %+v", nodes["b"])
+		}
+		if switches["sw"].State != "running" {
+			t.Errorf("bad status for sw: %+v", switches["sw"])
+		}
+		if links["a_0-sw_1"].State != "up" {
+			t.Errorf("bad status for link a_0-sw_1: %+v", links["a_0-sw_1"])
+		}
+		if status["mgmtip"] != "172.22.0.1" {
+			t.Errorf("bad management ip %v", status["mgmtip"])
+		}
+
+		delete(b.Domains, "lifecycle_b")
+		status = Status()
+		nodes = status["nodes"].(map[string]DomStatus)
+		if nodes["b"].State != "non-existant" {
+			t.Errorf("bad status for missing b: %+v", nodes["b"])
+		}
+
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		Create()
+		Launch()
+		errs := Shutdown()
+		if len(errs) != 0 {
+			t.Fatalf("shutdown failed: %v", errs)
+		}
+		for name, d := range b.Domains {
+			if d.Active {
+				t.Errorf("domain %s still running", name)
+			}
+		}
+
+		delete(b.Domains, "lifecycle_a")
+		errs = Shutdown()
+		if len(errs) != 1 {
+			t.Fatalf("expected 1 shutdown error, got %v", errs)
+		}
+
+	})
+}
+
+func TestWipeNode(t *testing.T) {
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		Create()
+		Launch()
+		before := b.Domains["lifecycle_b"]
+
+		topo, err := LoadTopo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = WipeNode(topo, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := b.Domains["lifecycle_a"]
+		if !d.Active || d.Boots != 1 {
+			t.Errorf("wiped node not freshly started: %+v", d)
+		}
+		if len(d.Def.Devices.Interfaces) != 2 {
+			t.Errorf("wiped node has %d interfaces", len(d.Def.Devices.Interfaces))
+		}
+		if b.Domains["lifecycle_b"] != before {
+			t.Errorf("wipe touched another node")
+		}
+
+		err = WipeNode(topo, "nope")
+		if err == nil {
+			t.Errorf("expected error wiping unknown node")
+		}
+
+	})
+}
+
+func TestDestroy(t *testing.T) {
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		Create()
+		Launch()
+		s.Set("config_state:lifecycle:a", "success")
+
+		err := Destroy()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(b.Domains) != 0 {
+			t.Errorf("domains left behind: %v", b.Domains)
+		}
+		if len(b.Networks) != 0 {
+			t.Errorf("networks left behind: %v", b.Networks)
+		}
+		if len(b.Exports) != 0 {
+			t.Errorf("exports left behind: %v", b.Exports)
+		}
+		if len(s) != 0 {
+			t.Errorf("state left behind: %v", s)
+		}
+		if _, err := os.Stat(".rvn"); !os.IsNotExist(err) {
+			t.Errorf("working directory not removed")
+		}
+		if _, ok := LoadRuntime().SubnetReverseTable["lifecycle"]; ok {
+			t.Errorf("subnet not freed")
+		}
+
+	})
+}
+
+func TestDestroyLoadErrors(t *testing.T) {
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		// a topology that cannot be read is not mistaken for no topology
+		err := ioutil.WriteFile(".rvn/topo.json", []byte("{"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Destroy()
+		if err == nil {
+			t.Errorf("expected error destroying an unreadable topology")
+		}
+
+		os.RemoveAll(".rvn")
+		err = Destroy()
+		if err != nil {
+			t.Errorf("expected nothing to destroy, got %v", err)
+		}
+
+	})
+}
@@ -0,0 +1,386 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements image builds. An image build boots a throwaway
+ * single node topology from a base image, runs a list of provisioning steps
+ * against it over ssh, shuts it down and flattens its disk into a new
+ * compressed and checksummed image in the image store. A build is described
+ * by a spec, e.g.
+ *
+ *   name: debian-ceph
+ *   base: debian-stretch
+ *   memory:
+ *     capacity: {value: 4, unit: GB}
+ *   steps:
+ *     - ansible: ceph.yml
+ *     - shell: cleanup.sh
+ *
+ * Paths in the steps are relative to the directory holding the spec. The
+ * throwaway topology lives in a scratch directory with its own NAT test
+ * network, so builds do not interfere with the topology in the working
+ * directory or with each other.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/yaml"
+)
+
+// Types ======================================================================
+
+// ImageSpec describes an image build.
+type ImageSpec struct {
+	// Name is the name of the new image in the image store
+	Name string `json:"name"`
+	// Base is the image the build starts from
+	Base   string      `json:"base"`
+	CPU    *CPU        `json:"cpu,omitempty"`
+	Memory *Memory     `json:"memory,omitempty"`
+	Steps  []BuildStep `json:"steps"`
+}
+
+// BuildStep is a provisioning step of an image build. Exactly one of its
+// fields is set.
+type BuildStep struct {
+	// Ansible is a playbook to run against the build host
+	Ansible string `json:"ansible,omitempty"`
+	// Shell is a script to run on the build host as the login user
+	Shell string `json:"shell,omitempty"`
+}
+
+// Variables ==================================================================
+
+var (
+	// how long to wait for a build host to boot and accept ssh connections
+	bootTimeout = 10 * time.Minute
+	bootPoll    = 2 * time.Second
+	sshPort     = "22"
+
+	// runBuildStep runs a provisioning step against the build host at ip
+	runBuildStep = func(s BuildStep, h Host, ip string) error {
+		return s.run(h, ip)
+	}
+)
+
+const (
+	// name of the host of a build topology
+	buildHost = "build"
+)
+
+// Functions ==================================================================
+
+// LoadImageSpec reads and checks the image build spec at path. The paths of
+// the steps are made absolute.
+func LoadImageSpec(path string) (*ImageSpec, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &ImageSpec{}
+	err = yaml.UnmarshalStrict(data, spec)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if spec.Name == "" || strings.ContainsAny(spec.Name, "/ ") ||
+		!isImageFile(spec.Name) {
+		return nil, fmt.Errorf("%s: bad image name '%s'", path, spec.Name)
+	}
+	if spec.Base == "" {
+		return nil, fmt.Errorf("%s: no base image", path)
+	}
+
+	dir := filepath.Dir(path)
+	for i := range spec.Steps {
+		s := &spec.Steps[i]
+		file := s.file()
+		if file == nil {
+			return nil, fmt.Errorf("%s: steps[%d]: a step needs exactly one of "+
+				"ansible or shell", path, i)
+		}
+		if !filepath.IsAbs(*file) {
+			*file, err = filepath.Abs(filepath.Join(dir, *file))
+			if err != nil {
+				return nil, err
+			}
+		}
+		_, err := os.Stat(*file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: steps[%d]: %v", path, i, err)
+		}
+	}
+
+	return spec, nil
+
+}
+
+// BuildImage builds the image described by the spec at path and returns the
+// path of the new image. The image is written to the image store under the
+// name of the spec, so models use it like any other image.
+func BuildImage(path string) (string, error) {
+
+	spec, err := LoadImageSpec(path)
+	if err != nil {
+		return "", err
+	}
+
+	dst, err := ImagePath(spec.Name)
+	if err != nil {
+		return "", err
+	}
+	_, err = os.Stat(dst)
+	if err == nil {
+		return "", fmt.Errorf("image %s already exists, remove it first with "+
+			"rvn image rm", spec.Name)
+	}
+
+	_, err = PullImage(spec.Base)
+	if err != nil {
+		return "", err
+	}
+
+	// the build topology lives in a scratch directory, the lifecycle functions
+	// work on the topology in the working directory so the build runs from
+	// there
+	dir, err := ioutil.TempDir("", "rvn-build-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		return "", err
+	}
+	defer os.Chdir(cwd)
+
+	err = os.MkdirAll(".rvn", 0755)
+	if err != nil {
+		return "", err
+	}
+
+	topo := Topo{
+		Name: fmt.Sprintf("build-%d", os.Getpid()),
+		Dir:  dir,
+		Nodes: []Node{{Host{
+			Name:       buildHost,
+			Image:      spec.Base,
+			CPU:        spec.CPU,
+			Memory:     spec.Memory,
+			TelnetPort: LoadRuntime().NewTelnetPort(),
+		}}},
+	}
+	// the host takes its defaults from the manifest of the base image, like
+	// the hosts of a model
+	err = applyImageManifest(&topo.Nodes[0].Host)
+	if err != nil {
+		return "", fmt.Errorf("%s: manifest - %v", spec.Base, err)
+	}
+	fillInTopo(&topo)
+	err = SaveTopo(topo)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		err := Destroy()
+		if err != nil {
+			log.Warnf("failed to clean up build topology %s - %v", topo.Name, err)
+		}
+	}()
+
+	log.Infof("booting %s", spec.Base)
+	err = Create()
+	if err != nil {
+		return "", err
+	}
+	errs := Launch()
+	if len(errs) > 0 {
+		return "", fmt.Errorf("launch failed - %s", strings.Join(errs, ", "))
+	}
+
+	// reload the topology for the host as saved
+	topo, err = LoadTopo()
+	if err != nil {
+		return "", err
+	}
+	h := topo.getHost(buildHost)
+	qname := topo.QualifyName(buildHost)
+
+	ip, err := waitForSSH(qname)
+	if err != nil {
+		return "", err
+	}
+
+	for i, s := range spec.Steps {
+		log.Infof("running step %d: %s", i, s)
+		err = runBuildStep(s, *h, ip)
+		if err != nil {
+			return "", fmt.Errorf("steps[%d]: %s - %v", i, s, err)
+		}
+	}
+
+	log.Infof("shutting down %s", buildHost)
+	err = shutdownAndWait(qname)
+	if err != nil {
+		return "", err
+	}
+
+	wd, err := WkDir()
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	log.Infof("writing %s", dst)
+	part := dst + ".part"
+	err = finishImage(filepath.Join(wd, buildHost), part, dst, *h)
+	if err != nil {
+		os.Remove(part)
+		return "", err
+	}
+
+	return dst, nil
+
+}
+
+// Methods ====================================================================
+
+func (s BuildStep) String() string {
+	if s.Ansible != "" {
+		return "ansible " + filepath.Base(s.Ansible)
+	}
+	return "shell " + filepath.Base(s.Shell)
+}
+
+// file returns the file of the step, or nil if the step does not have exactly
+// one.
+func (s *BuildStep) file() *string {
+	switch {
+	case s.Ansible != "" && s.Shell == "":
+		return &s.Ansible
+	case s.Shell != "" && s.Ansible == "":
+		return &s.Shell
+	}
+	return nil
+}
+
+func (s BuildStep) run(h Host, ip string) error {
+
+	var cmd *exec.Cmd
+
+	if s.Ansible != "" {
+		args, err := AnsibleArgs(s.Ansible, h, ip)
+		if err != nil {
+			return err
+		}
+		cmd = exec.Command("ansible-playbook", args...)
+		cmd.Env = append(os.Environ(), "ANSIBLE_HOST_KEY_CHECKING=False")
+	} else {
+		login, err := hostLogin(h)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(s.Shell)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		cmd = exec.Command("ssh",
+			"-i", "/var/rvn/ssh/rvn",
+			"-o", "StrictHostKeyChecking=no",
+			"-o", "UserKnownHostsFile=/dev/null",
+			"-p", sshPort,
+			login.User+"@"+ip,
+			"sh", "-s",
+		)
+		cmd.Stdin = f
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Printf("%s", out)
+		return err
+	}
+	return nil
+
+}
+
+// Helper Functions ===========================================================
+
+// waitForSSH waits for a domain to get an address and accept ssh connections
+// and returns its address.
+func waitForSSH(name string) (string, error) {
+
+	deadline := time.Now().Add(bootTimeout)
+	for time.Now().Before(deadline) {
+		status, err := backend.DomainState(name)
+		if err != nil {
+			return "", err
+		}
+		if status.IP != "" {
+			c, err := net.DialTimeout(
+				"tcp", net.JoinHostPort(status.IP, sshPort), bootPoll)
+			if err == nil {
+				c.Close()
+				return status.IP, nil
+			}
+		}
+		time.Sleep(bootPoll)
+	}
+
+	return "", fmt.Errorf("%s did not come up within %v", name, bootTimeout)
+
+}
+
+// finishImage flattens and compresses the disk of a build host at src into
+// part, writes its checksum and manifest next to dst and moves it into place.
+// The image is moved last, so an image in the store is always complete.
+func finishImage(src, part, dst string, h Host) error {
+
+	err := backend.ConvertImage(src, part, true)
+	if err != nil {
+		return err
+	}
+
+	sum, err := sha256File(part)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(dst+".sha256",
+		[]byte(fmt.Sprintf("%s  %s\n", sum, filepath.Base(dst))), 0644)
+	if err != nil {
+		return err
+	}
+
+	m, err := hostManifest(h)
+	if err != nil {
+		return err
+	}
+	err = SaveImageManifest(dst, m)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(part, dst)
+
+}
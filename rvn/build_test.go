@@ -0,0 +1,185 @@
+package rvn
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withBuildEnv runs f in a test environment holding a base image and an ssh
+// server for build hosts to come up on. The provisioning steps run by builds
+// are recorded in steps instead of being run.
+func withBuildEnv(t *testing.T, f func(b *memBackend, steps *[]string)) {
+
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		os.MkdirAll(imageDir, 0755)
+		err := ioutil.WriteFile(
+			filepath.Join(imageDir, "debian-stretch"), []byte("debian"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				c.Close()
+			}
+		}()
+
+		var steps []string
+		saved := struct {
+			port    string
+			timeout time.Duration
+			run     func(BuildStep, Host, string) error
+		}{sshPort, bootTimeout, runBuildStep}
+		defer func() {
+			sshPort, bootTimeout, runBuildStep = saved.port, saved.timeout, saved.run
+		}()
+		_, sshPort, _ = net.SplitHostPort(l.Addr().String())
+		bootTimeout = 5 * time.Second
+		runBuildStep = func(s BuildStep, h Host, ip string) error {
+			if strings.Contains(s.Shell, "fail") {
+				return fmt.Errorf("exit status 1")
+			}
+			steps = append(steps, fmt.Sprintf("%s %s@%s", s, h.Name, ip))
+			return nil
+		}
+
+		b.Lease = "127.0.0.1"
+		ioutil.WriteFile("setup.yml", []byte("---"), 0644)
+		ioutil.WriteFile("clean.sh", []byte("apt-get clean"), 0644)
+		ioutil.WriteFile("fail.sh", []byte("false"), 0644)
+
+		f(b, &steps)
+
+	})
+
+}
+
+func TestBuildImage(t *testing.T) {
+
+	withBuildEnv(t, func(b *memBackend, steps *[]string) {
+
+		cwd, _ := os.Getwd()
+		ioutil.WriteFile("spec.yml", []byte(`
+name: debian-custom
+base: debian-stretch
+steps:
+  - ansible: setup.yml
+  - shell: clean.sh
+`), 0644)
+
+		path, err := BuildImage("spec.yml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != filepath.Join(imageDir, "debian-custom") {
+			t.Errorf("unexpected image path %s", path)
+		}
+
+		expected := "ansible setup.yml build@127.0.0.1, shell clean.sh build@127.0.0.1"
+		if strings.Join(*steps, ", ") != expected {
+			t.Errorf("unexpected steps %v", *steps)
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(data), "compressed ") {
+			t.Errorf("expected compressed image, got '%s'", data)
+		}
+		sum, _ := sha256File(path)
+		data, err = ioutil.ReadFile(path + ".sha256")
+		if err != nil || !strings.HasPrefix(string(data), sum) {
+			t.Errorf("bad checksum sidecar '%s' - %v", data, err)
+		}
+
+		// the new image resolves like any other image
+		m, err := LoadImageManifest("debian-custom")
+		if err != nil || m == nil || m.OS != "linux" {
+			t.Errorf("unexpected manifest %+v - %v", m, err)
+		}
+		p, err := PullImage("debian-custom")
+		if err != nil || p != path {
+			t.Errorf("expected image to resolve to %s, got %s - %v", path, p, err)
+		}
+
+		// the build topology is gone
+		if len(b.Domains) != 0 || len(b.Networks) != 0 {
+			t.Errorf("build topology left behind %v %v", b.Domains, b.Networks)
+		}
+		if len(LoadRuntime().Topologies) != 0 {
+			t.Errorf("build topology still registered")
+		}
+		if wd, _ := os.Getwd(); wd != cwd {
+			t.Errorf("working directory not restored, in %s", wd)
+		}
+
+		_, err = BuildImage("spec.yml")
+		if err == nil || !strings.Contains(err.Error(), "already exists") {
+			t.Errorf("expected image exists error, got %v", err)
+		}
+
+	})
+
+}
+
+func TestBuildImageErrors(t *testing.T) {
+
+	withBuildEnv(t, func(b *memBackend, steps *[]string) {
+
+		tests := []struct{ spec, err string }{
+			{"base: debian-stretch", "bad image name"},
+			{"name: x/y\nbase: debian-stretch", "bad image name"},
+			{"name: x", "no base image"},
+			{"name: x\nbase: debian-stretch\nsteps: [{}]", "exactly one of"},
+			{"name: x\nbase: debian-stretch\nsteps: [{shell: nope.sh}]",
+				"no such file"},
+			{"name: x\nbase: debian-stretch\nbogus: 1", "unknown field"},
+		}
+		for _, x := range tests {
+			ioutil.WriteFile("spec.yml", []byte(x.spec), 0644)
+			_, err := BuildImage("spec.yml")
+			if err == nil || !strings.Contains(err.Error(), x.err) {
+				t.Errorf("%q: expected error containing '%s', got %v",
+					x.spec, x.err, err)
+			}
+		}
+
+		// a failing step leaves nothing behind
+		ioutil.WriteFile("spec.yml", []byte(`
+name: broken
+base: debian-stretch
+steps:
+  - shell: clean.sh
+  - shell: fail.sh
+`), 0644)
+		_, err := BuildImage("spec.yml")
+		if err == nil || !strings.Contains(err.Error(), "steps[1]: shell fail.sh") {
+			t.Errorf("expected step failure, got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(imageDir, "broken")); err == nil {
+			t.Errorf("failed build left an image behind")
+		}
+		if len(b.Domains) != 0 {
+			t.Errorf("failed build left domains behind")
+		}
+
+	})
+
+}
@@ -0,0 +1,184 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements cloud-init provisioning. A host with a cloud-init
+ * section in the model gets a NoCloud seed, an iso labeled 'cidata' holding
+ * its meta-data and user-data, that is attached to it as a cdrom. Images with
+ * cloud-init then come up with their hostname, login, ssh keys, the iamme
+ * utility and mounts already set up, so 'rvn configure' skips their base
+ * config. The exception is NFS mounts, sources are exported to the addresses
+ * hosts get from DHCP, which are only known once they are up. NFS mounts are
+ * put in place by the seed but only succeed once 'rvn configure' has exported
+ * their sources, so hosts with NFS mounts still get their base config.
+ *
+ * The generated user-data is a cloud-config document. Any user-data given in
+ * the model is merged into it, keys from the model replace generated ones.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Types ======================================================================
+
+// CloudInit is the cloud-init configuration of a host.
+type CloudInit struct {
+	// SSHKeys are public keys authorized to log in as the rvn user, in
+	// addition to the rvn key
+	SSHKeys []string `json:"ssh-keys,omitempty"`
+	// UserData is cloud-config merged into the generated user-data
+	UserData map[string]interface{} `json:"user-data,omitempty"`
+}
+
+// Variables ==================================================================
+
+var sshPubKey = "/var/rvn/ssh/rvn.pub"
+
+// Functions ==================================================================
+
+// GenSeed creates the NoCloud seed of a host in the working directory. Hosts
+// without cloud-init are left alone.
+func GenSeed(h Host, topo Topo) error {
+
+	if h.CloudInit == nil {
+		return nil
+	}
+
+	wd, err := WkDir()
+	if err != nil {
+		return fmt.Errorf("failed to get working dir - %v", err)
+	}
+
+	meta, user, err := seedData(h, topo)
+	if err != nil {
+		return err
+	}
+
+	return backend.CreateISO(seedPath(wd, h.Name), "cidata", map[string][]byte{
+		"meta-data": meta,
+		"user-data": user,
+	})
+
+}
+
+// Helper Functions ===========================================================
+
+// seedConfigures returns whether the seed of a host does all of its base
+// config. NFS mounts need the sources exported by rvn configure first.
+func seedConfigures(h Host, topo Topo) bool {
+
+	if h.CloudInit == nil {
+		return false
+	}
+	for _, m := range mountEntries(h, topo) {
+		if m[2] == "nfs" {
+			return false
+		}
+	}
+	return true
+
+}
+
+// seedData returns the meta-data and user-data of a host.
+func seedData(h Host, topo Topo) ([]byte, []byte, error) {
+
+	meta, err := yaml.Marshal(map[string]string{
+		"instance-id":    topo.QualifyName(h.Name),
+		"local-hostname": h.Name,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := ioutil.ReadFile(sshPubKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read rvn ssh key - %v", err)
+	}
+	keys := []string{strings.TrimSpace(string(key))}
+	keys = append(keys, h.CloudInit.SSHKeys...)
+
+	login, err := hostLogin(h)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the same iamme the base config installs, linux hosts run it to update
+	// libvirt dns
+	iamme := "iamme-linux"
+	if strings.ToLower(h.OS) == "freebsd" {
+		iamme = "iamme-freebsd"
+	}
+	util, err := ioutil.ReadFile(filepath.Join(utilDir, iamme))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s - %v", iamme, err)
+	}
+
+	mounts := mountEntries(h, topo)
+	for _, m := range mounts {
+		if m[2] == "nfs" {
+			// the source is exported to the host by rvn configure, once the
+			// host has an address, until then the mount is retried in the
+			// background
+			m[3] += ",bg"
+		}
+	}
+
+	// without a password to become root with, the login is key only
+	user := map[string]interface{}{
+		"name":                login.User,
+		"sudo":                "ALL=(ALL) NOPASSWD:ALL",
+		"shell":               "/bin/sh",
+		"lock_passwd":         true,
+		"ssh_authorized_keys": keys,
+	}
+	if login.BecomePass != "" {
+		user["lock_passwd"] = false
+		user["plain_text_passwd"] = login.BecomePass
+	}
+
+	doc := map[string]interface{}{
+		"hostname":         h.Name,
+		"fqdn":             fmt.Sprintf("%s.%s.net", h.Name, topo.Name),
+		"manage_etc_hosts": true,
+		"users":            []interface{}{"default", user},
+		"write_files": []interface{}{
+			map[string]interface{}{
+				"path":        "/usr/local/bin/iamme",
+				"permissions": "0755",
+				"encoding":    "b64",
+				"content":     base64.StdEncoding.EncodeToString(util),
+			},
+		},
+	}
+	if strings.ToLower(h.OS) != "freebsd" {
+		doc["runcmd"] = []interface{}{
+			[]string{"/usr/local/bin/iamme", "eth0", topo.MgmtIp},
+		}
+	}
+	if len(mounts) > 0 {
+		doc["mounts"] = mounts
+	}
+	for k, v := range h.CloudInit.UserData {
+		doc[k] = v
+	}
+
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return meta, append([]byte("#cloud-config\n"), data...), nil
+
+}
+
+func seedPath(wd, host string) string {
+	return fmt.Sprintf("%s/%s.seed.iso", wd, host)
+}
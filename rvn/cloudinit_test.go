@@ -0,0 +1,142 @@
+package rvn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestCloudInitSeed(t *testing.T) {
+
+	topo := testTopo
+	topo.Nodes = []Node{
+		{Host{Name: "a", Image: "debian-stretch", OS: "linux",
+			Mounts: []Mount{
+				{Point: "/opt/src", Source: "/srv/src"},
+				{Point: "/opt/9p", Source: "/srv/9p", Type: "9p", ReadOnly: true},
+			},
+			CloudInit: &CloudInit{
+				SSHKeys: []string{"ssh-ed25519 AAAA me@laptop"},
+				UserData: map[string]interface{}{
+					"packages": []interface{}{"ceph"},
+				},
+			},
+		}},
+		{Host{Name: "b", Image: "debian-stretch", OS: "linux"}},
+	}
+
+	withTestEnv(t, topo, func(b *memBackend, s memStore) {
+
+		saved := sshPubKey
+		defer func() { sshPubKey = saved }()
+		sshPubKey = filepath.Join(filepath.Dir(runtimeFile), "rvn.pub")
+		ioutil.WriteFile(sshPubKey, []byte("ssh-rsa BBBB rvn\n"), 0644)
+		savedUtil := utilDir
+		defer func() { utilDir = savedUtil }()
+		utilDir = "util"
+		os.MkdirAll(utilDir, 0755)
+		ioutil.WriteFile("util/iamme-linux", []byte("iamme"), 0755)
+
+		err := Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wd, _ := WkDir()
+		seed := wd + "/a.seed.iso"
+		iso, ok := b.ISOs[seed]
+		if !ok {
+			t.Fatalf("no seed for a")
+		}
+		if len(b.ISOs) != 1 {
+			t.Errorf("only a uses cloud-init, got seeds %v", b.ISOs)
+		}
+		if iso["label"] != "cidata" {
+			t.Errorf("seed labeled '%s'", iso["label"])
+		}
+		if !strings.Contains(iso["meta-data"], "local-hostname: a") ||
+			!strings.Contains(iso["meta-data"], "instance-id: lifecycle_a") {
+			t.Errorf("bad meta-data\n%s", iso["meta-data"])
+		}
+
+		if !strings.HasPrefix(iso["user-data"], "#cloud-config\n") {
+			t.Errorf("user-data is not cloud-config")
+		}
+		var user struct {
+			Hostname   string
+			FQDN       string
+			Users      []interface{}
+			Mounts     [][]string
+			Packages   []string
+			WriteFiles []map[string]string `json:"write_files"`
+			Runcmd     [][]string
+		}
+		err = yaml.Unmarshal([]byte(iso["user-data"]), &user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Hostname != "a" || user.FQDN != "a.lifecycle.net" {
+			t.Errorf("bad hostname %s %s", user.Hostname, user.FQDN)
+		}
+		if !strings.Contains(iso["user-data"], "- ssh-rsa BBBB rvn") ||
+			!strings.Contains(iso["user-data"], "- ssh-ed25519 AAAA me@laptop") {
+			t.Errorf("missing ssh keys\n%s", iso["user-data"])
+		}
+		mounts := []string{
+			"172.22.0.1:/srv/src /opt/src nfs rw,soft,bg 0 0",
+			"rvn1 /opt/9p 9p trans=virtio,version=9p2000.L,ro 0 0",
+		}
+		for i, m := range user.Mounts {
+			if i >= len(mounts) || strings.Join(m, " ") != mounts[i] {
+				t.Errorf("unexpected mounts %v", user.Mounts)
+				break
+			}
+		}
+		if len(user.Packages) != 1 || user.Packages[0] != "ceph" {
+			t.Errorf("model user-data not merged %v", user.Packages)
+		}
+		if len(user.WriteFiles) != 1 ||
+			user.WriteFiles[0]["path"] != "/usr/local/bin/iamme" ||
+			user.WriteFiles[0]["content"] != "aWFtbWU=" {
+			t.Errorf("iamme not written %v", user.WriteFiles)
+		}
+		if len(user.Runcmd) != 1 ||
+			strings.Join(user.Runcmd[0], " ") != "/usr/local/bin/iamme eth0 172.22.0.1" {
+			t.Errorf("iamme not run %v", user.Runcmd)
+		}
+		if !strings.Contains(iso["user-data"], "lock_passwd: false") ||
+			!strings.Contains(iso["user-data"], "plain_text_passwd: rvn") {
+			t.Errorf("expected rvn password\n%s", iso["user-data"])
+		}
+
+		// a login without a password is locked
+		savedLogin := defaultLogin
+		defer func() { defaultLogin = savedLogin }()
+		defaultLogin.BecomePass = ""
+		_, data, err := seedData(topo.Nodes[0].Host, topo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "lock_passwd: true") ||
+			strings.Contains(string(data), "plain_text_passwd") {
+			t.Errorf("expected a locked password\n%s", data)
+		}
+
+		// the seed is the last disk, a read only cdrom
+		disks := b.Domains["lifecycle_a"].Def.Devices.Disks
+		cdrom := disks[len(disks)-1]
+		if cdrom.Device != "cdrom" || cdrom.Source.File.File != seed ||
+			cdrom.ReadOnly == nil || cdrom.Target.Bus != "sata" {
+			t.Errorf("seed not attached as a cdrom %+v", cdrom)
+		}
+		if len(b.Domains["lifecycle_b"].Def.Devices.Disks) != 1 {
+			t.Errorf("b should only have its root disk")
+		}
+
+	})
+
+}
@@ -1,49 +1,61 @@
 package rvn
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
-	"sync"
 	"text/template"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func GenConfigAll(topo Topo) {
+var (
+	// runConfig makes an attempt to configure a host, stopping when ctx is
+	// done
+	runConfig = configureNode
+
+	// how long to wait for the output of a killed playbook to be drained
+	ansibleWaitDelay = 10 * time.Second
+)
+
+func GenConfigAll(topo Topo) error {
+	var errs ErrorList
 	for _, node := range topo.Nodes {
-		GenConfig(node.Host, topo)
+		errs.Add(nodeError(node.Name, "genconfig", GenConfig(node.Host, topo)))
 	}
 	for _, zwitch := range topo.Switches {
-		GenConfig(zwitch.Host, topo)
+		errs.Add(
+			switchError(zwitch.Name, "genconfig", GenConfig(zwitch.Host, topo)))
 	}
+	return errs.Err()
 }
 
-func GenConfig(h Host, topo Topo) {
-	tp_path, err := filepath.Abs("/var/rvn/template/config.yml")
+func GenConfig(h Host, topo Topo) error {
+	tp_path, err := filepath.Abs(templateDir + "/config.yml")
 	if err != nil {
-		log.Printf("failed to create absolute path for config.yml - %v", err)
-		return
+		return fmt.Errorf(
+			"failed to create absolute path for config.yml - %v", err)
 	}
 	tp, err := template.ParseFiles(tp_path)
 	if err != nil {
-		log.Printf("failed to read config.yml - %v", err)
-		return
+		return fmt.Errorf("failed to read config.yml - %v", err)
 	}
 
 	wd, err := WkDir()
 	if err != nil {
-		log.Printf("genconfig: failed to get working dir")
-		return
+		return fmt.Errorf("failed to get working dir - %v", err)
 	}
 
 	path := fmt.Sprintf("/%s/%s.yml", wd, h.Name)
 	f, err := os.Create(path)
 	if err != nil {
-		log.Printf("failed to create path %s - %v", path, err)
-		return
+		return fmt.Errorf("failed to create path %s - %v", path, err)
 	}
 	defer f.Close()
 
@@ -54,60 +66,72 @@ func GenConfig(h Host, topo Topo) {
 
 	err = tp.Execute(f, data)
 	if err != nil {
-		log.Printf("failed to execute config template for %s - %v", h.Name, err)
+		return fmt.Errorf("failed to execute config template - %v", err)
 	}
+
+	return nil
 }
 
-func Configure(withUserConfig bool) {
-	//TODO return error condition
+// Configure runs the base configuration, and optionally the user
+// configuration, on every node and switch of the topology, in parallel as far
+// as the configuration order of the topology allows. The returned ErrorList
+// has an entry for every host whose configuration failed or was skipped.
+func Configure(withUserConfig bool) error {
 
 	topo, err := LoadTopo()
 	if err != nil {
 		if strings.Contains(err.Error(), "topo.json: no such file or directory") {
-			log.Printf("Topology not built. Use `rvn build` first")
-			return
+			return fmt.Errorf("topology not built. Use `rvn build` first")
 		}
-		log.Println("configure: failed to load topo - %v", err)
-		return
+		return fmt.Errorf("configure: failed to load topo - %v", err)
+	}
+	err = preConfigure(topo)
+	if err != nil {
+		return topoError(topo.Name, "pre-config", err)
 	}
-	preConfigure(topo)
 	status := Status()
 	node_status := status["nodes"].(map[string]DomStatus)
 	switch_status := status["switches"].(map[string]DomStatus)
 
-	var wg sync.WaitGroup
-	doConfig := func(topo Topo, host Host, ds DomStatus) {
-
-		configureNode(topo, host, ds, withUserConfig)
-		wg.Done()
+	// now that the hosts have addresses their mounts can be exported to them,
+	// and playbooks can be run against the inventory of the topology
+	addrs := hostAddrs(node_status, switch_status)
+	err = ExportNFS(topo, addrs)
+	if err != nil {
+		return topoError(topo.Name, "nfs-export", err)
+	}
+	err = writeTopoInventory(topo, addrs)
+	if err != nil {
+		return topoError(topo.Name, "inventory", err)
 	}
 
+	var hosts []string
 	for _, x := range topo.Nodes {
 		if x.OS == "netboot" {
 			continue
 		}
-		wg.Add(1)
-		go doConfig(topo, x.Host, node_status[x.Name])
+		hosts = append(hosts, x.Name)
 	}
 	for _, x := range topo.Switches {
-		wg.Add(1)
-		go doConfig(topo, x.Host, switch_status[x.Name])
+		hosts = append(hosts, x.Name)
 	}
 
-	wg.Wait()
+	err = configureHosts(topo, hosts, mergeStatus(node_status, switch_status),
+		withUserConfig)
 
 	log.Println("configuration of all nodes complete")
+
+	return err
 }
 
-func preConfigure(topo Topo) {
+func preConfigure(topo Topo) error {
 	pc_script := fmt.Sprintf("%s/pre-config/run", topo.Dir)
 	if _, err := os.Stat(pc_script); err == nil {
 		log.Printf("running pre-config for %s", topo.Name)
 
 		wd, err := WkDir()
 		if err != nil {
-			log.Printf("preconfigure: failed to get working dir")
-			return
+			return fmt.Errorf("failed to get working dir - %v", err)
 		}
 
 		cmd := exec.Command(pc_script)
@@ -116,111 +140,284 @@ func preConfigure(topo Topo) {
 		cmd.Dir = fmt.Sprintf("%s/pre-config", topo.Dir)
 		out, err := cmd.CombinedOutput()
 		if err != nil {
-			log.Printf("pre-config failed %s - %v", out, err)
+			return fmt.Errorf("pre-config failed %s - %v", out, err)
 		}
 	}
 
-}
+	return nil
 
-func ConfigureNode(topo Topo, node string) {
-	status := Status()
-	node_status := status["nodes"].(map[string]DomStatus)
-	switch_status := status["switches"].(map[string]DomStatus)
+}
 
-	s, ok := node_status[node]
-	h := topo.getHost(node)
-	if ok {
-		configureNode(topo, *h, s, true)
-	} else if s, ok := switch_status[node]; ok {
-		configureNode(topo, *h, s, true)
-	}
+func ConfigureNode(topo Topo, node string) error {
+	return ConfigureNodes(topo, []string{node})
 }
 
-func ConfigureNodes(topo Topo, nodes []string) {
+// ConfigureNodes runs the base and user configuration on the named nodes and
+// switches, in parallel as far as the configuration order of the topology
+// allows. Hosts that are not named are taken to be configured already.
+func ConfigureNodes(topo Topo, nodes []string) error {
 	status := Status()
 	node_status := status["nodes"].(map[string]DomStatus)
 	switch_status := status["switches"].(map[string]DomStatus)
 
-	var wg sync.WaitGroup
-	doConfig := func(topo Topo, host string, ds DomStatus) {
+	addrs := hostAddrs(node_status, switch_status)
+	err := ExportNFS(topo, addrs)
+	if err != nil {
+		return topoError(topo.Name, "nfs-export", err)
+	}
+	err = writeTopoInventory(topo, addrs)
+	if err != nil {
+		return topoError(topo.Name, "inventory", err)
+	}
 
-		s, ok := node_status[host]
-		h := topo.getHost(host)
-		if ok {
-			configureNode(topo, *h, s, true)
-		} else if s, ok := switch_status[host]; ok {
-			configureNode(topo, *h, s, true)
+	var hosts []string
+	for _, x := range nodes {
+		if !contains(hosts, x) {
+			hosts = append(hosts, x)
 		}
+	}
 
-		wg.Done()
+	err = configureHosts(topo, hosts, mergeStatus(node_status, switch_status),
+		true)
 
-	}
+	log.Println("configuration of all nodes complete")
 
-	for _, x := range nodes {
-		wg.Add(1)
-		go doConfig(topo, x, node_status[x])
+	return err
+
+}
+
+// configureWithRetries configures a host, retrying with backoff when the host
+// can not be reached, and records the outcome along with the number of
+// attempts in the configuration state of the host, along with the phase the
+// last attempt got to. Each attempt is stopped after the configured timeout,
+// an attempt that times out is retried like one that can not reach the host.
+// The output of all attempts goes to a new configuration log of the host.
+func configureWithRetries(topo Topo, host Host, ds DomStatus,
+	withUserConfig bool, cs ConfigureSettings) error {
+
+	db_state_key := stateKey(topo.Name, host.Name)
+	backoff := cs.Backoff.Duration
+
+	var out io.Writer = ioutil.Discard
+	var logPath string
+	f, err := createConfigLog(host.Name)
+	if err != nil {
+		log.Warnf("no configuration log for %s - %v", host.Name, err)
+	} else {
+		defer f.Close()
+		out = f
+		logPath = f.Name()
 	}
 
-	wg.Wait()
+	for attempt := 1; ; attempt++ {
 
-	log.Println("configuration of all nodes complete")
+		store.Set(db_state_key, attemptState("configuring", attempt))
+		fmt.Fprintf(out, "==> configuring %s:%s, attempt %d at %s\n",
+			topo.Name, host.Name, attempt, time.Now().Format(time.RFC3339))
+
+		run := &configRun{
+			topo:    topo,
+			host:    host,
+			attempt: attempt,
+			out:     out,
+			log:     logPath,
+		}
+		ctx, cancel := context.WithTimeout(
+			context.Background(), cs.Timeout.Duration)
+		err := runConfig(ctx, run, ds, withUserConfig)
+		if ctx.Err() == context.DeadlineExceeded {
+			err = &TransientError{
+				fmt.Errorf("timed out after %v", cs.Timeout.Duration)}
+		}
+		cancel()
+
+		if err == nil {
+			fmt.Fprintf(out, "==> success\n")
+			store.Set(db_state_key,
+				finalState(phaseState(run.phase, "success"), attempt))
+			return nil
+		}
+		fmt.Fprintf(out, "==> failed - %v\n", err)
+
+		_, transient := err.(*TransientError)
+		if !transient || attempt > *cs.Retries {
+			store.Set(db_state_key,
+				finalState(phaseState(run.phase, "failed"), attempt))
+			if f != nil {
+				log.Printf("configuring %s failed, see %s", host.Name, f.Name())
+			}
+			return err
+		}
+
+		log.Printf("configuring %s failed, retrying in %v - %v",
+			host.Name, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+
+	}
 
 }
 
-func configureNode(topo Topo, host Host, ds DomStatus, withUserConfig bool) {
+// configureNode runs the base config of a host and, if withUserConfig is set,
+// its user config, recording each phase in the history of the host.
+func configureNode(ctx context.Context, run *configRun, ds DomStatus,
+	withUserConfig bool) error {
+
+	topo, host, out := run.topo, run.host, run.out
 
 	wd, err := WkDir()
 	if err != nil {
-		log.Printf("configure: failed to get working dir")
-		return
+		return fmt.Errorf("failed to get working dir - %v", err)
 	}
 
+	// hosts with provisioning steps are provisioned without ansible, their base
+	// config is done by the native provisioner as well. Hosts whose cloud-init
+	// seed did the base config skip it.
 	yml := fmt.Sprintf("%s/%s.yml", wd, host.Name)
-	log.Printf("running base config for %s:%s", topo.Name, host.Name)
-	runAnsible(yml, topo.Name, host, ds)
+	switch {
+	case seedConfigures(host, topo):
+		log.Printf("base config for %s:%s done by cloud-init", topo.Name,
+			host.Name)
+	case len(host.Provision) > 0:
+		log.Printf("running base config for %s:%s", topo.Name, host.Name)
+		err = run.runPhase(ctx, "base", "provision", func() error {
+			return runBaseProvision(ctx, topo, host, ds, out)
+		})
+	default:
+		log.Printf("running base config for %s:%s", topo.Name, host.Name)
+		err = run.runPhase(ctx, "base", yml, func() error {
+			return runAnsible(ctx, yml, host, ds, out)
+		})
+	}
+	if err != nil {
+		return keepTransient(err, fmt.Errorf("base config failed - %v", err))
+	}
 
 	user_yml := fmt.Sprintf("%s/config/%s.yml", topo.Dir, host.Name)
 	if _, err := os.Stat(user_yml); err == nil {
 		if withUserConfig {
 			log.Printf("running user config for %s:%s", topo.Name, host.Name)
-			runAnsible(user_yml, topo.Name, host, ds)
+			err = run.runPhase(ctx, "user", user_yml, func() error {
+				return runAnsible(ctx, user_yml, host, ds, out)
+			})
+			if err != nil {
+				return keepTransient(err, fmt.Errorf("user config failed - %v", err))
+			}
 		}
 	}
 
+	if withUserConfig && len(host.Provision) > 0 {
+		log.Printf("provisioning %s:%s", topo.Name, host.Name)
+		err = run.runPhase(ctx, "user", "provision", func() error {
+			return runProvision(ctx, topo, host, ds, out)
+		})
+		if err != nil {
+			return keepTransient(err, fmt.Errorf("provisioning failed - %v", err))
+		}
+	}
+
+	return nil
+
 }
 
-func runAnsible(yml, topo string, h Host, s DomStatus) {
+// hostAddrs returns the addresses of the hosts in the given status maps.
+func hostAddrs(status ...map[string]DomStatus) map[string]string {
+	addrs := make(map[string]string)
+	for _, m := range status {
+		for name, ds := range m {
+			if ds.IP != "" {
+				addrs[name] = ds.IP
+			}
+		}
+	}
+	return addrs
+}
 
-	dbCheckConnection()
-	db_state_key := fmt.Sprintf("config_state:%s:%s", topo, h.Name)
-	db.Set(db_state_key, "configuring", 0)
+// mergeStatus merges the given status maps into one.
+func mergeStatus(status ...map[string]DomStatus) map[string]DomStatus {
+	merged := make(map[string]DomStatus)
+	for _, m := range status {
+		for name, ds := range m {
+			merged[name] = ds
+		}
+	}
+	return merged
+}
+
+// writeTopoInventory writes the inventory of a topology, given the test
+// network addresses of its hosts, for runAnsible to use.
+func writeTopoInventory(topo Topo, addrs map[string]string) error {
+	inv, err := NewInventory(topo, addrs)
+	if err != nil {
+		return err
+	}
+	_, err = saveInventory(inv)
+	return err
+}
+
+// runAnsible runs the playbook yml against a host, writing its output to
+// out. The playbook runs against the inventory of the topology limited to the
+// host, so it can address groups and look up the other hosts. The playbook is
+// killed when ctx is done.
+func runAnsible(ctx context.Context, yml string, h Host, s DomStatus,
+	out io.Writer) error {
 
 	if strings.ToLower(h.OS) == "netboot" {
-		return
+		return nil
 	}
 
-	extra_vars := "ansible_become_pass=rvn"
-	if strings.ToLower(h.OS) == "freebsd" {
-		extra_vars += " ansible_python_interpreter='/usr/local/bin/python2'"
+	inventory, err := inventoryPath()
+	if err != nil {
+		return err
+	}
+	// ansible runs nothing rather than failing without its inventory
+	_, err = os.Stat(inventory)
+	if err != nil {
+		return fmt.Errorf("no inventory - %v", err)
 	}
+	args := []string{"-i", inventory, "--limit", h.Name, yml}
 
-	cmd := exec.Command(
-		"ansible-playbook",
-		"-i", s.IP+",",
-		yml,
-		"--extra-vars", extra_vars,
-		`--ssh-extra-args='-i/var/rvn/ssh/rvn'`,
-		"--user=rvn", "--private-key=/var/rvn/ssh/rvn",
-	)
+	fmt.Fprintf(out, "==> ansible-playbook %s\n", yml)
+	cmd := exec.CommandContext(ctx, "ansible-playbook", args...)
 	cmd.Env = append(os.Environ(), "ANSIBLE_HOST_KEY_CHECKING=False")
-	out, err := cmd.CombinedOutput()
+	cmd.Stdout = out
+	cmd.Stderr = out
+	// the ssh processes of a killed playbook may hold on to its output, do not
+	// wait for them forever
+	cmd.WaitDelay = ansibleWaitDelay
+	err = cmd.Run()
 
 	if err != nil {
-		log.Printf("failed to run configuration for %s - %v", h.Name, err)
-		log.Printf(string(out))
-		db.Set(db_state_key, "failed", 0)
-	} else {
-		db.Set(db_state_key, "success", 0)
+		err = fmt.Errorf("ansible-playbook %s - %v", filepath.Base(yml), err)
+		if cmd.ProcessState == nil {
+			return err
+		}
+		err = &ExitError{Code: cmd.ProcessState.ExitCode(), Err: err}
+		// ansible-playbook exits with 4 when it could not reach the host
+		if cmd.ProcessState.ExitCode() == 4 {
+			return &TransientError{err}
+		}
+		return err
 	}
 
+	return nil
+
+}
+
+// attemptState returns the configuration state of a host during an attempt
+// to configure it.
+func attemptState(state string, attempt int) string {
+	if attempt == 1 {
+		return state
+	}
+	return fmt.Sprintf("%s (attempt %d)", state, attempt)
+}
+
+// finalState returns the configuration state of a host after it took the
+// given number of attempts to configure.
+func finalState(state string, attempts int) string {
+	if attempts == 1 {
+		return state + " (1 attempt)"
+	}
+	return fmt.Sprintf("%s (%d attempts)", state, attempts)
 }
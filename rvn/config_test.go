@@ -2,9 +2,17 @@ package rvn
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"text/template"
+	"time"
 )
 
 type TpData struct {
@@ -107,3 +115,243 @@ func TestConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestConfigMounts(t *testing.T) {
+	tp, err := template.ParseFiles("config.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc bytes.Buffer
+	err = tp.Execute(&doc, &TpData{
+		Host: Host{
+			Name: "walrus",
+			Mounts: []Mount{
+				{Point: "/opt/a", Source: "/a"},
+				{Point: "/opt/b", Source: "/b", Type: "9p", ReadOnly: true},
+				{Point: "/opt/c", Source: "/c", Type: "virtiofs"},
+			},
+		},
+		NFS: "172.22.0.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+    - name: mount /opt/a
+      mount:
+        name: /opt/a
+        src: 172.22.0.1:/a
+        opts: rw,soft
+        fstype: nfs
+        state: mounted
+    - name: mount /opt/b
+      mount:
+        name: /opt/b
+        src: rvn1
+        opts: trans=virtio,version=9p2000.L,ro
+        fstype: 9p
+        state: mounted
+    - name: mount /opt/c
+      mount:
+        name: /opt/c
+        src: rvn2
+        opts: rw
+        fstype: virtiofs
+        state: mounted
+`
+	if !strings.Contains(doc.String(), expected) {
+		t.Fatalf("bad mounts in config:\n%s", doc.String())
+	}
+}
+
+func TestConfigureSettings(t *testing.T) {
+
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		settings, err := LoadSettings()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(settings.Configure, defaultConfigure) {
+			t.Errorf("expected defaults, got %+v", settings.Configure)
+		}
+
+		ioutil.WriteFile(settingsFile, []byte(`
+configure:
+  parallel: 4
+  timeout: 1h
+  retries: 0
+`), 0644)
+		settings, err = LoadSettings()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := settings.Configure
+		if c.Parallel != 4 || c.Timeout.Duration != time.Hour ||
+			*c.Retries != 0 || c.Backoff != defaultConfigure.Backoff {
+			t.Errorf("unexpected settings %+v", c)
+		}
+
+		os.Setenv("RVN_CONFIGURE_TIMEOUT", "90s")
+		os.Setenv("RVN_CONFIGURE_RETRIES", "5")
+		settings, err = LoadSettings()
+		os.Unsetenv("RVN_CONFIGURE_TIMEOUT")
+		os.Unsetenv("RVN_CONFIGURE_RETRIES")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c = settings.Configure
+		if c.Timeout.Duration != 90*time.Second || *c.Retries != 5 {
+			t.Errorf("environment not applied %+v", c)
+		}
+
+		for _, x := range []struct{ settings, err string }{
+			{"configure: {timeout: soon}", "invalid duration"},
+			{"configure: {timeout: 5}", "expected a string"},
+			{"configure: {parallel: -1}", "may not be negative"},
+		} {
+			ioutil.WriteFile(settingsFile, []byte(x.settings), 0644)
+			_, err = LoadSettings()
+			if err == nil || !strings.Contains(err.Error(), x.err) {
+				t.Errorf("%s: expected error containing '%s', got %v",
+					x.settings, x.err, err)
+			}
+		}
+
+	})
+
+}
+
+func TestConfigureRetries(t *testing.T) {
+
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		saved := runConfig
+		defer func() { runConfig = saved }()
+
+		var mtx sync.Mutex
+		attempts := make(map[string]int)
+		runConfig = func(ctx context.Context, run *configRun, ds DomStatus,
+			withUserConfig bool) error {
+
+			h := run.host
+
+			mtx.Lock()
+			attempts[h.Name]++
+			n := attempts[h.Name]
+			mtx.Unlock()
+
+			switch h.Name {
+			case "flaky":
+				if n < 3 {
+					return &TransientError{fmt.Errorf("unreachable")}
+				}
+			case "broken":
+				return fmt.Errorf("bad playbook")
+			case "gone":
+				return &TransientError{fmt.Errorf("unreachable")}
+			case "hung":
+				<-ctx.Done()
+				return fmt.Errorf("killed")
+			}
+			return nil
+
+		}
+
+		cs := ConfigureSettings{
+			Parallel: 1,
+			Timeout:  Duration{50 * time.Millisecond},
+			Retries:  intPtr(2),
+			Backoff:  Duration{time.Millisecond},
+		}
+		topo := Topo{Name: "retry"}
+
+		tests := []struct {
+			host, state, err string
+			attempts         int
+		}{
+			{"ok", "success (1 attempt)", "", 1},
+			{"flaky", "success (3 attempts)", "", 3},
+			{"broken", "failed (1 attempt)", "bad playbook", 1},
+			{"gone", "failed (3 attempts)", "unreachable", 3},
+			{"hung", "failed (3 attempts)", "timed out after 50ms", 3},
+		}
+		for _, x := range tests {
+			err := configureWithRetries(topo, Host{Name: x.host}, DomStatus{},
+				true, cs)
+			if x.err == "" && err != nil ||
+				x.err != "" && (err == nil || !strings.Contains(err.Error(), x.err)) {
+				t.Errorf("%s: expected error '%s', got %v", x.host, x.err, err)
+			}
+			state := s["config_state:retry:"+x.host]
+			if state != x.state {
+				t.Errorf("%s: expected state '%s', got '%s'", x.host, x.state, state)
+			}
+			if attempts[x.host] != x.attempts {
+				t.Errorf("%s: expected %d attempts, got %d",
+					x.host, x.attempts, attempts[x.host])
+			}
+		}
+
+	})
+
+}
+
+func TestRunAnsibleInventory(t *testing.T) {
+
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		// a fake ansible-playbook that records its arguments and exits as the
+		// host name says
+		bin, err := filepath.Abs("bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.MkdirAll(bin, 0755)
+		ioutil.WriteFile(filepath.Join(bin, "ansible-playbook"), []byte(
+			"#!/bin/sh\necho \"$@\" > args\n"+
+				"case \"$4\" in unreachable) exit 4;; esac\n"), 0755)
+		savedPath := os.Getenv("PATH")
+		defer os.Setenv("PATH", savedPath)
+		os.Setenv("PATH", bin+":"+savedPath)
+
+		topo, err := LoadTopo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+
+		err = runAnsible(ctx, "a.yml", Host{Name: "a"}, DomStatus{}, ioutil.Discard)
+		if err == nil || !strings.Contains(err.Error(), "no inventory") {
+			t.Errorf("expected missing inventory error, got %v", err)
+		}
+
+		err = writeTopoInventory(topo, map[string]string{"a": "172.22.0.2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = runAnsible(ctx, "a.yml", Host{Name: "a"}, DomStatus{}, ioutil.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args, _ := ioutil.ReadFile("args")
+		inventory, _ := inventoryPath()
+		if string(args) != "-i "+inventory+" --limit a a.yml\n" {
+			t.Errorf("unexpected ansible-playbook args '%s'", args)
+		}
+		data, _ := ioutil.ReadFile(inventory)
+		if !strings.Contains(string(data), "ansible_host=172.22.0.2") {
+			t.Errorf("unexpected inventory:\n%s", data)
+		}
+
+		err = runAnsible(ctx, "a.yml", Host{Name: "unreachable"}, DomStatus{},
+			ioutil.Discard)
+		if _, ok := err.(*TransientError); !ok || exitCode(err) != 4 {
+			t.Errorf("expected a transient exit 4, got %v", err)
+		}
+
+	})
+
+}
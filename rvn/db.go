@@ -7,6 +7,39 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Store is a simple key value store rvn keeps runtime state, such as the
+// configuration state of nodes, in.
+type Store interface {
+	Get(key string) (string, error)
+	Set(key, value string) error
+	Del(keys ...string) error
+}
+
+// RedisStore is the default rvn store, backed by a local redis server.
+type RedisStore struct{}
+
+var store Store = &RedisStore{}
+
+// SetStore sets the store used by rvn for runtime state.
+func SetStore(s Store) {
+	store = s
+}
+
+func (s *RedisStore) Get(key string) (string, error) {
+	dbCheckConnection()
+	return db.Get(key).Result()
+}
+
+func (s *RedisStore) Set(key, value string) error {
+	dbCheckConnection()
+	return db.Set(key, value, 0).Err()
+}
+
+func (s *RedisStore) Del(keys ...string) error {
+	dbCheckConnection()
+	return db.Del(keys...).Err()
+}
+
 var db *redis.Client
 
 func dbConnect() {
@@ -0,0 +1,192 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements the data disks of hosts. Besides its root disk, an
+ * overlay of its image, a host may have any number of blank disks. They are
+ * created next to the overlay in the working directory as <host>.<dev>, e.g.
+ * walrus.vdb, and attached after the root disk with sequential device
+ * letters.
+ *
+ * A topology may also declare shared disks, which are created once as
+ * <disk>.shared and attached to every host that uses them after the host's
+ * own disks. Shared disks outlive their hosts, wiping a host leaves them
+ * intact, and are only removed when the topology is destroyed.
+ *
+ * The cloud-init seed of a host, if it has one, is attached as a cdrom after
+ * all other disks.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	xlibvirt "github.com/libvirt/libvirt-go-xml"
+)
+
+// Variables ==================================================================
+
+var (
+	// device name prefixes by disk bus
+	busDevs = map[string]string{
+		"virtio": "vd",
+		"scsi":   "sd",
+		"sata":   "sd",
+		"usb":    "sd",
+		"sd":     "sd",
+		"ide":    "hd",
+	}
+
+	diskFormats = []string{"qcow2", "raw"}
+
+	// bytes per unit, as libvirt interprets them
+	unitBytes = map[string]int64{
+		"b": 1, "bytes": 1,
+		"k": 1 << 10, "kib": 1 << 10, "kb": 1e3,
+		"m": 1 << 20, "mib": 1 << 20, "mb": 1e6,
+		"g": 1 << 30, "gib": 1 << 30, "gb": 1e9,
+		"t": 1 << 40, "tib": 1 << 40, "tb": 1e12,
+	}
+)
+
+// Methods ====================================================================
+
+// Bytes returns the value in bytes.
+func (u UnitValue) Bytes() (int64, error) {
+	n, ok := unitBytes[strings.ToLower(u.Unit)]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit '%s'", u.Unit)
+	}
+	return int64(u.Value) * n, nil
+}
+
+// Helper Functions ===========================================================
+
+// createSharedDisks creates the shared disks of a topology.
+func createSharedDisks(t *Topo) error {
+
+	wd, err := WkDir()
+	if err != nil {
+		return err
+	}
+
+	var errs ErrorList
+	for _, x := range t.Disks {
+		size, err := x.Size.Bytes()
+		if err != nil {
+			errs.Add(diskError(x.Name, "create", err))
+			continue
+		}
+		path := sharedDiskPath(wd, x.Name)
+		os.RemoveAll(path)
+		err = backend.CreateDisk(path, "raw", size)
+		errs.Add(diskError(x.Name, "create", err))
+	}
+
+	return errs.Err()
+
+}
+
+// createDisks creates the data disks of a host and returns their domain
+// devices, followed by the devices of the shared disks of the topology the
+// host uses.
+func createDisks(h *Host, t *Topo) ([]xlibvirt.DomainDisk, error) {
+
+	wd, err := WkDir()
+	if err != nil {
+		return nil, err
+	}
+
+	var disks []xlibvirt.DomainDisk
+	for i, x := range h.Disks {
+
+		format := x.Format
+		if format == "" {
+			format = "qcow2"
+		}
+		size, err := x.Size.Bytes()
+		if err != nil {
+			return nil, fmt.Errorf("disks[%d]: %v", i, err)
+		}
+
+		// the root disk is the first device
+		bus, dev := diskTarget(h, x.Bus, i+1)
+		path := fmt.Sprintf("%s/%s.%s", wd, h.Name, dev)
+		os.RemoveAll(path)
+
+		err = backend.CreateDisk(path, format, size)
+		if err != nil {
+			return nil, fmt.Errorf("disks[%d]: %v", i, err)
+		}
+
+		disks = append(disks, domainDisk(path, format, bus, dev, x.Shared))
+
+	}
+
+	for _, x := range t.Disks {
+		if !contains(x.Hosts, h.Name) {
+			continue
+		}
+		bus, dev := diskTarget(h, x.Bus, len(disks)+1)
+		disks = append(disks,
+			domainDisk(sharedDiskPath(wd, x.Name), "raw", bus, dev, true))
+	}
+
+	// the cloud-init seed goes last, cloud-init finds it by its label
+	if h.CloudInit != nil {
+		bus, dev := diskTarget(h, "sata", len(disks)+1)
+		cdrom := domainDisk(seedPath(wd, h.Name), "raw", bus, dev, false)
+		cdrom.Device = "cdrom"
+		cdrom.ReadOnly = &xlibvirt.DomainDiskReadOnly{}
+		disks = append(disks, cdrom)
+	}
+
+	return disks, nil
+
+}
+
+// diskTarget returns the bus and device name of the nth disk of a host on the
+// given bus, which defaults to the bus of the host's default disk type.
+func diskTarget(h *Host, bus string, n int) (string, string) {
+	prefix := h.DefaultDisktype.Dev
+	if bus == "" || bus == h.DefaultDisktype.Bus {
+		bus = h.DefaultDisktype.Bus
+	} else {
+		prefix = busDevs[bus]
+	}
+	return bus, diskDev(prefix, n)
+}
+
+func domainDisk(path, format, bus, dev string, shared bool) xlibvirt.DomainDisk {
+
+	disk := xlibvirt.DomainDisk{
+		Device: "disk",
+		Driver: &xlibvirt.DomainDiskDriver{Name: "qemu", Type: format},
+		Source: &xlibvirt.DomainDiskSource{
+			File: &xlibvirt.DomainDiskSourceFile{File: path},
+		},
+		Target: &xlibvirt.DomainDiskTarget{Dev: dev, Bus: bus},
+	}
+	if shared {
+		disk.Driver.Cache = "none"
+		disk.Shareable = &xlibvirt.DomainDiskShareable{}
+	}
+	return disk
+
+}
+
+func sharedDiskPath(wd, name string) string {
+	return fmt.Sprintf("%s/%s.shared", wd, name)
+}
+
+// diskDev returns the name of the nth disk device with the given prefix, e.g.
+// vda, vdb ... vdz, vdaa.
+func diskDev(prefix string, n int) string {
+	s := ""
+	for n++; n > 0; n = (n - 1) / 26 {
+		s = string(rune('a'+(n-1)%26)) + s
+	}
+	return prefix + s
+}
@@ -0,0 +1,148 @@
+package rvn
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCreateDisks(t *testing.T) {
+
+	topo := testTopo
+	topo.Nodes = []Node{
+		{Host{Name: "a", Image: "debian-stretch", DiskSize: &UnitValue{20, "GiB"},
+			Disks: []Disk{
+				{Size: UnitValue{10, "GiB"}},
+				{Size: UnitValue{1, "GB"}, Bus: "scsi", Format: "raw", Shared: true},
+			}}},
+		{Host{Name: "b", Image: "debian-stretch", DiskSize: &UnitValue{1, "B"}}},
+	}
+
+	withTestEnv(t, topo, func(b *memBackend, s memStore) {
+
+		os.MkdirAll(imageDir, 0755)
+		ioutil.WriteFile(imageDir+"/debian-stretch", []byte("debian"), 0644)
+
+		err := Create()
+		if err == nil || !strings.Contains(err.Error(),
+			"disksize 1B is smaller than image debian-stretch") {
+			t.Errorf("expected disk size error for b, got %v", err)
+		}
+
+		wd, _ := WkDir()
+		if b.Sizes[wd+"/a"] != 20<<30 {
+			t.Errorf("root disk not grown: %d", b.Sizes[wd+"/a"])
+		}
+		if b.Sizes[wd+"/a.vdb"] != 10<<30 || b.Sizes[wd+"/a.sdc"] != 1e9 {
+			t.Errorf("unexpected disk sizes %v", b.Sizes)
+		}
+
+		disks := b.Domains["lifecycle_a"].Def.Devices.Disks
+		if len(disks) != 3 {
+			t.Fatalf("expected 3 disks, got %d", len(disks))
+		}
+		var devs []string
+		for _, d := range disks {
+			devs = append(devs, d.Target.Bus+":"+d.Target.Dev+":"+d.Driver.Type)
+		}
+		if strings.Join(devs, " ") != "virtio:vda:qcow2 virtio:vdb:qcow2 scsi:sdc:raw" {
+			t.Errorf("unexpected disks %v", devs)
+		}
+		if disks[1].Shareable != nil || disks[2].Shareable == nil ||
+			disks[2].Driver.Cache != "none" {
+			t.Errorf("only the shared disk should be shareable and uncached")
+		}
+
+	})
+
+}
+
+func TestSharedDisks(t *testing.T) {
+
+	topo := testTopo
+	topo.Nodes = []Node{
+		{Host{Name: "a", Image: "debian-stretch",
+			Disks: []Disk{{Size: UnitValue{1, "GiB"}}}}},
+		{Host{Name: "b", Image: "debian-stretch"}},
+	}
+	topo.Disks = []SharedDisk{
+		{Name: "quorum", Size: UnitValue{1, "GiB"}, Hosts: []string{"a", "b"}},
+		{Name: "data", Size: UnitValue{2, "GiB"}, Hosts: []string{"b"},
+			Bus: "scsi"},
+	}
+
+	withTestEnv(t, topo, func(b *memBackend, s memStore) {
+
+		err := Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wd, _ := WkDir()
+		quorum, data := wd+"/quorum.shared", wd+"/data.shared"
+		if b.Sizes[quorum] != 1<<30 || b.Sizes[data] != 2<<30 {
+			t.Errorf("unexpected shared disk sizes %v", b.Sizes)
+		}
+
+		// shared disks follow each host's own disks
+		for _, x := range []struct{ host, disks string }{
+			{"a", "vda vdb " + quorum + ":vdc"},
+			{"b", "vda " + quorum + ":vdb " + data + ":sdc"},
+		} {
+			var devs []string
+			for _, d := range b.Domains["lifecycle_"+x.host].Def.Devices.Disks {
+				if d.Shareable == nil {
+					devs = append(devs, d.Target.Dev)
+					continue
+				}
+				if d.Driver.Type != "raw" || d.Driver.Cache != "none" {
+					t.Errorf("%s: shared disk %s is not raw and uncached",
+						x.host, d.Target.Dev)
+				}
+				devs = append(devs, d.Source.File.File+":"+d.Target.Dev)
+			}
+			if strings.Join(devs, " ") != x.disks {
+				t.Errorf("%s: unexpected disks %v", x.host, devs)
+			}
+		}
+
+		// wiping a host leaves the shared disks alone
+		err = ioutil.WriteFile(quorum, []byte("cluster state"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Launch()
+		topo, err := LoadTopo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = WipeNode(topo, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadFile(quorum)
+		if err != nil || string(buf) != "cluster state" {
+			t.Errorf("wipe touched the shared disk: '%s' %v", buf, err)
+		}
+
+		err = Destroy()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(quorum); !os.IsNotExist(err) {
+			t.Errorf("shared disk left behind")
+		}
+
+	})
+
+}
+
+func TestDiskDev(t *testing.T) {
+	for n, x := range map[int]string{0: "vda", 1: "vdb", 25: "vdz", 26: "vdaa",
+		27: "vdab", 701: "vdzz", 702: "vdaaa"} {
+		if diskDev("vd", n) != x {
+			t.Errorf("%d: expected %s, got %s", n, x, diskDev("vd", n))
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements image downloads. A download goes to a '.part' file
+ * next to its destination and is only renamed into place once it is complete
+ * and its sha256 checksum has been verified, so an interrupted or failed
+ * download never leaves a truncated image behind. Interrupted downloads are
+ * resumed with HTTP range requests, both within a download and the next time
+ * the same file is downloaded. A server that stops sending interrupts the
+ * download like a dropped connection does.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Types ======================================================================
+
+// ProgressFunc is called as a download proceeds with the number of bytes
+// downloaded so far and the total size, which is -1 if it is not known.
+type ProgressFunc func(url string, done, total int64)
+
+// Download describes a file to download.
+type Download struct {
+	URL  string
+	Path string
+	// SHA256 is the expected hex encoded checksum of the file. If it is empty
+	// the checksum is taken from the sidecar file <URL>.sha256, if the server
+	// has one.
+	SHA256 string
+}
+
+// idleReader reads from r, pushing timer back by timeout each time data
+// arrives.
+type idleReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+// progressWriter counts the bytes of a download and reports them to the
+// progress function.
+type progressWriter struct {
+	url         string
+	done, total int64
+}
+
+// Variables ==================================================================
+
+var (
+	httpClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+		},
+	}
+	progress ProgressFunc
+
+	// a download that receives nothing for this long is interrupted
+	downloadIdleTimeout = time.Minute
+
+	// number of times a download is attempted before giving up
+	downloadAttempts = 5
+)
+
+// Functions ==================================================================
+
+// SetProgress sets the function that is called with the progress of
+// downloads. A nil function disables progress reporting.
+func SetProgress(f ProgressFunc) {
+	progress = f
+}
+
+// DownloadFile downloads url to filepath, verifying it against the checksum in
+// the sidecar file <url>.sha256 if there is one.
+func DownloadFile(filepath string, url string) error {
+	return (&Download{URL: url, Path: filepath}).Run()
+}
+
+// Methods ====================================================================
+
+// Run performs the download.
+func (d *Download) Run() error {
+
+	sum := strings.ToLower(d.SHA256)
+	if sum == "" {
+		var err error
+		sum, err = fetchSidecar(d.URL + ".sha256")
+		if err != nil {
+			return err
+		}
+		if sum == "" {
+			log.Warnf("no checksum published for %s, it will not be verified",
+				d.URL)
+		}
+	}
+
+	part := d.Path + ".part"
+
+	var err error
+	for i := 0; i < downloadAttempts; i++ {
+		var retry bool
+		retry, err = d.fetch(part)
+		if err == nil || !retry {
+			break
+		}
+		log.Warnf("download of %s interrupted, resuming - %v", d.URL, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if sum != "" {
+		actual, err := sha256File(part)
+		if err != nil {
+			return err
+		}
+		if actual != sum {
+			// the partial file is corrupt, resuming from it will not help
+			os.Remove(part)
+			return fmt.Errorf("checksum mismatch for %s: expected %s got %s",
+				d.URL, sum, actual)
+		}
+	}
+
+	return os.Rename(part, d.Path)
+
+}
+
+// fetch downloads the remainder of the file into part. If the download fails
+// part holds everything received so far, and retry says whether it is worth
+// resuming.
+func (d *Download) fetch(part string) (retry bool, err error) {
+
+	var offset int64
+	st, err := os.Stat(part)
+	if err == nil {
+		offset = st.Size()
+	}
+
+	// the request is cancelled if the body stalls
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var stalled int32
+	timer := time.AfterFunc(downloadIdleTimeout, func() {
+		atomic.StoreInt32(&stalled, 1)
+		cancel()
+	})
+	defer timer.Stop()
+
+	req, err := http.NewRequest("GET", d.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("GET %s - %v", d.URL, err)
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	total := resp.ContentLength
+
+	switch resp.StatusCode {
+
+	case http.StatusPartialContent:
+		start, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			// not the range we asked for, start over
+			os.Remove(part)
+			return true, fmt.Errorf("bad range response from %s", d.URL)
+		}
+		flags |= os.O_APPEND
+		total = size
+
+	case http.StatusOK:
+		// the server ignored the range request or there was none
+		offset = 0
+		flags |= os.O_TRUNC
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the partial file is no prefix of what the server has, start over
+		os.Remove(part)
+		return true, fmt.Errorf("GET %s - %s", d.URL, resp.Status)
+
+	default:
+		return false, fmt.Errorf("GET %s - %s", d.URL, resp.Status)
+
+	}
+
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	w := &progressWriter{url: d.URL, done: offset, total: total}
+	body := &idleReader{r: resp.Body, timer: timer, timeout: downloadIdleTimeout}
+	_, err = io.Copy(io.MultiWriter(f, w), body)
+	if atomic.LoadInt32(&stalled) == 1 {
+		return true, fmt.Errorf("GET %s - nothing received for %v",
+			d.URL, downloadIdleTimeout)
+	}
+	if err != nil {
+		return true, fmt.Errorf("GET %s - %v", d.URL, err)
+	}
+	if total >= 0 && w.done != total {
+		return true, fmt.Errorf("GET %s - short read, %d of %d bytes",
+			d.URL, w.done, total)
+	}
+
+	return false, f.Close()
+
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.done += int64(len(p))
+	if progress != nil {
+		progress(w.url, w.done, w.total)
+	}
+	return len(p), nil
+}
+
+// Helper Functions ===========================================================
+
+// fetchSidecar returns the checksum held by a sidecar file, which is either
+// just the checksum or a sha256sum style line. If there is no sidecar the
+// checksum is empty.
+func fetchSidecar(url string) (string, error) {
+
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("GET %s - %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s - %s", url, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", fmt.Errorf("GET %s - %v", url, err)
+	}
+
+	return parseChecksum(string(data))
+
+}
+
+func parseChecksum(s string) (string, error) {
+
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum")
+	}
+	sum := strings.ToLower(fields[0])
+	_, err := hex.DecodeString(sum)
+	if err != nil || len(sum) != sha256.Size*2 {
+		return "", fmt.Errorf("bad sha256 checksum '%s'", fields[0])
+	}
+	return sum, nil
+
+}
+
+func sha256File(path string) (string, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+
+}
+
+// parseContentRange parses a 'bytes start-end/size' content range header. The
+// size is -1 if it is unknown.
+func parseContentRange(s string) (start, size int64, err error) {
+
+	var end int64
+	var total string
+	_, err = fmt.Sscanf(s, "bytes %d-%d/%s", &start, &end, &total)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad content range '%s'", s)
+	}
+	if total == "*" {
+		return start, -1, nil
+	}
+	size, err = strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad content range '%s'", s)
+	}
+	return start, size, nil
+
+}
@@ -0,0 +1,251 @@
+package rvn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// imageServer serves image at /img, its checksum at /img.sha256 and manifest,
+// if there is one, at /img.manifest. The ranges requested for the image are
+// recorded.
+type imageServer struct {
+	*httptest.Server
+	image    []byte
+	sum      string
+	manifest string
+
+	mu     sync.Mutex
+	ranges []string
+	// interrupt the first n image requests half way through
+	interrupt int
+	// stall the first n image requests half way through until the client
+	// goes away
+	stall int
+}
+
+func newImageServer(image []byte) *imageServer {
+
+	h := sha256.Sum256(image)
+	s := &imageServer{image: image, sum: hex.EncodeToString(h[:])}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/img", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		interrupt := s.interrupt > 0
+		s.interrupt--
+		stall := s.stall > 0
+		s.stall--
+		s.mu.Unlock()
+
+		if interrupt || stall {
+			w.Header().Set("Content-Length", fmt.Sprint(len(s.image)))
+			w.Write(s.image[:len(s.image)/2])
+			if stall {
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+			}
+			return
+		}
+		http.ServeContent(w, r, "img", time.Time{}, bytes.NewReader(s.image))
+	})
+	mux.HandleFunc("/img.sha256", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s  img\n", s.sum)
+	})
+	mux.HandleFunc("/img.manifest", func(w http.ResponseWriter, r *http.Request) {
+		if s.manifest == "" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, s.manifest)
+	})
+	s.Server = httptest.NewServer(mux)
+
+	return s
+
+}
+
+func testImage() []byte {
+	return bytes.Repeat([]byte("raven "), 100000)
+}
+
+func withDownloadDir(t *testing.T, f func(dir string)) {
+	dir, err := ioutil.TempDir("", "rvn-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f(dir)
+}
+
+func checkDownload(t *testing.T, path string, image []byte) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, image) {
+		t.Errorf("downloaded image does not match, %d of %d bytes",
+			len(data), len(image))
+	}
+	if _, err := os.Stat(path + ".part"); !os.IsNotExist(err) {
+		t.Errorf("partial download left behind")
+	}
+}
+
+func TestDownload(t *testing.T) {
+
+	s := newImageServer(testImage())
+	defer s.Close()
+
+	var done, total int64
+	SetProgress(func(url string, d, t int64) { done, total = d, t })
+	defer SetProgress(nil)
+
+	withDownloadDir(t, func(dir string) {
+
+		path := filepath.Join(dir, "img")
+		err := DownloadFile(path, s.URL+"/img")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDownload(t, path, s.image)
+
+		if done != int64(len(s.image)) || total != int64(len(s.image)) {
+			t.Errorf("expected progress %d/%d, got %d/%d",
+				len(s.image), len(s.image), done, total)
+		}
+
+	})
+
+}
+
+func TestDownloadErrors(t *testing.T) {
+
+	s := newImageServer(testImage())
+	defer s.Close()
+
+	withDownloadDir(t, func(dir string) {
+
+		path := filepath.Join(dir, "img")
+
+		// a missing image leaves nothing behind
+		err := DownloadFile(path, s.URL+"/nope")
+		if err == nil || !strings.Contains(err.Error(), "404") {
+			t.Errorf("expected not found error, got %v", err)
+		}
+
+		// as does an image that does not match its checksum
+		d := &Download{
+			URL:    s.URL + "/img",
+			Path:   path,
+			SHA256: strings.Repeat("0", 64),
+		}
+		err = d.Run()
+		if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+			t.Errorf("expected checksum error, got %v", err)
+		}
+
+		files, _ := ioutil.ReadDir(dir)
+		if len(files) != 0 {
+			t.Errorf("expected failed downloads to leave nothing, found %s",
+				files[0].Name())
+		}
+
+	})
+
+}
+
+func TestDownloadResume(t *testing.T) {
+
+	s := newImageServer(testImage())
+	defer s.Close()
+
+	withDownloadDir(t, func(dir string) {
+
+		// a partial download from an earlier run is resumed
+		path := filepath.Join(dir, "img")
+		half := len(s.image) / 2
+		err := ioutil.WriteFile(path+".part", s.image[:half], 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = DownloadFile(path, s.URL+"/img")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDownload(t, path, s.image)
+
+		expected := fmt.Sprintf("bytes=%d-", half)
+		if len(s.ranges) != 1 || s.ranges[0] != expected {
+			t.Errorf("expected one request for %s, got %q", expected, s.ranges)
+		}
+
+	})
+
+}
+
+func TestDownloadInterrupted(t *testing.T) {
+
+	s := newImageServer(testImage())
+	s.interrupt = 1
+	defer s.Close()
+
+	withDownloadDir(t, func(dir string) {
+
+		path := filepath.Join(dir, "img")
+		err := DownloadFile(path, s.URL+"/img")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDownload(t, path, s.image)
+
+		expected := fmt.Sprintf("bytes=%d-", len(s.image)/2)
+		if len(s.ranges) != 2 || s.ranges[0] != "" || s.ranges[1] != expected {
+			t.Errorf("expected the download to resume at %s, got %q",
+				expected, s.ranges)
+		}
+
+	})
+
+}
+
+func TestDownloadStalled(t *testing.T) {
+
+	idle := downloadIdleTimeout
+	downloadIdleTimeout = 50 * time.Millisecond
+	defer func() { downloadIdleTimeout = idle }()
+
+	s := newImageServer(testImage())
+	s.stall = 1
+	defer s.Close()
+
+	withDownloadDir(t, func(dir string) {
+
+		path := filepath.Join(dir, "img")
+		err := DownloadFile(path, s.URL+"/img")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDownload(t, path, s.image)
+
+		expected := fmt.Sprintf("bytes=%d-", len(s.image)/2)
+		if len(s.ranges) != 2 || s.ranges[0] != "" || s.ranges[1] != expected {
+			t.Errorf("expected the stalled download to resume at %s, got %q",
+				expected, s.ranges)
+		}
+
+	})
+
+}
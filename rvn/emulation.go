@@ -0,0 +1,200 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements link emulation. A link may carry emulated
+ * characteristics such as delay, loss and rate limits. These are applied by
+ * the backend with netem on each of the link's host side interfaces, so every
+ * value applies in each direction of the link.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types ======================================================================
+
+// Emulation holds the emulated characteristics of a link. Values use tc
+// syntax, e.g. Delay: "50ms", Loss: "1%", Rate: "100mbit". Empty values are
+// not emulated.
+type Emulation struct {
+	Delay     string `json:"delay,omitempty"`
+	Jitter    string `json:"jitter,omitempty"`
+	Loss      string `json:"loss,omitempty"`
+	Duplicate string `json:"duplicate,omitempty"`
+	Reorder   string `json:"reorder,omitempty"`
+	Rate      string `json:"rate,omitempty"`
+}
+
+// Variables ==================================================================
+
+var (
+	percentRx = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?%$`)
+	rateRx    = regexp.MustCompile(
+		`^[0-9]+(\.[0-9]+)?([kmgt]?bit|[kmgt]?bps)$`)
+)
+
+// Functions ==================================================================
+
+// ParseEmulation applies a list of key=value settings, e.g. [delay=50ms
+// loss=1%], on top of a base emulation and returns the result. The base is
+// not modified. A setting with an empty value, e.g. 'loss=', clears it.
+func ParseEmulation(settings []string, base *Emulation) (*Emulation, error) {
+
+	e := &Emulation{}
+	if base != nil {
+		*e = *base
+	}
+
+	for _, x := range settings {
+		parts := strings.SplitN(x, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad setting '%s' - expected key=value", x)
+		}
+		k, v := strings.ToLower(parts[0]), parts[1]
+		switch k {
+		case "delay":
+			e.Delay = v
+		case "jitter":
+			e.Jitter = v
+		case "loss":
+			e.Loss = v
+		case "duplicate":
+			e.Duplicate = v
+		case "reorder":
+			e.Reorder = v
+		case "rate":
+			e.Rate = v
+		default:
+			return nil, fmt.Errorf("unknown link property '%s'", k)
+		}
+	}
+
+	err := e.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if e.Empty() {
+		return nil, nil
+	}
+
+	return e, nil
+}
+
+// Methods ====================================================================
+
+// Empty returns true if no characteristic of the link is emulated.
+func (e *Emulation) Empty() bool {
+	return e == nil || *e == Emulation{}
+}
+
+// Validate checks that every value is well formed and that the combination of
+// values can be expressed with netem.
+func (e *Emulation) Validate() error {
+	if e.Empty() {
+		return nil
+	}
+
+	for _, x := range []struct{ name, value string }{
+		{"delay", e.Delay},
+		{"jitter", e.Jitter},
+	} {
+		if x.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(x.value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("bad %s '%s' - expected a duration like 50ms",
+				x.name, x.value)
+		}
+	}
+
+	for _, x := range []struct{ name, value string }{
+		{"loss", e.Loss},
+		{"duplicate", e.Duplicate},
+		{"reorder", e.Reorder},
+	} {
+		if x.value == "" {
+			continue
+		}
+		if !percentRx.MatchString(x.value) {
+			return fmt.Errorf("bad %s '%s' - expected a percentage like 1%%",
+				x.name, x.value)
+		}
+		p, _ := strconv.ParseFloat(strings.TrimSuffix(x.value, "%"), 64)
+		if p > 100 {
+			return fmt.Errorf("bad %s '%s' - more than 100%%", x.name, x.value)
+		}
+	}
+
+	if e.Rate != "" && !rateRx.MatchString(strings.ToLower(e.Rate)) {
+		return fmt.Errorf("bad rate '%s' - expected a rate like 100mbit", e.Rate)
+	}
+
+	if e.Delay == "" && e.Jitter != "" {
+		return fmt.Errorf("jitter requires a delay")
+	}
+	if e.Delay == "" && e.Reorder != "" {
+		return fmt.Errorf("reorder requires a delay")
+	}
+
+	return nil
+}
+
+// NetemArgs returns the netem arguments that implement the emulation, e.g.
+// [delay 50ms 5ms loss 1%]
+func (e *Emulation) NetemArgs() []string {
+	var args []string
+	if e.Empty() {
+		return args
+	}
+
+	if e.Delay != "" {
+		args = append(args, "delay", e.Delay)
+		if e.Jitter != "" {
+			args = append(args, e.Jitter)
+		}
+	}
+	if e.Loss != "" {
+		args = append(args, "loss", e.Loss)
+	}
+	if e.Duplicate != "" {
+		args = append(args, "duplicate", e.Duplicate)
+	}
+	if e.Reorder != "" {
+		args = append(args, "reorder", e.Reorder)
+	}
+	if e.Rate != "" {
+		args = append(args, "rate", strings.ToLower(e.Rate))
+	}
+
+	return args
+}
+
+// String returns the emulation as a list of key=value pairs, e.g.
+// 'delay=50ms loss=1%'
+func (e *Emulation) String() string {
+	if e.Empty() {
+		return ""
+	}
+
+	var s []string
+	for _, x := range []struct{ name, value string }{
+		{"delay", e.Delay},
+		{"jitter", e.Jitter},
+		{"loss", e.Loss},
+		{"duplicate", e.Duplicate},
+		{"reorder", e.Reorder},
+		{"rate", e.Rate},
+	} {
+		if x.value != "" {
+			s = append(s, x.name+"="+x.value)
+		}
+	}
+	return strings.Join(s, " ")
+}
@@ -0,0 +1,66 @@
+package rvn
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEmulationValidate(t *testing.T) {
+
+	good := []*Emulation{
+		nil,
+		&Emulation{},
+		&Emulation{Delay: "50ms"},
+		&Emulation{Delay: "1s", Jitter: "10ms", Reorder: "25%"},
+		&Emulation{Loss: "0.5%", Duplicate: "1%"},
+		&Emulation{Rate: "100mbit"},
+		&Emulation{Rate: "1Gbit"},
+		&Emulation{Rate: "512kbps"},
+	}
+	for _, e := range good {
+		if err := e.Validate(); err != nil {
+			t.Errorf("%v: unexpected error %v", e, err)
+		}
+	}
+
+	bad := []*Emulation{
+		&Emulation{Delay: "50"},
+		&Emulation{Delay: "-5ms"},
+		&Emulation{Jitter: "5ms"},
+		&Emulation{Reorder: "5%"},
+		&Emulation{Loss: "1"},
+		&Emulation{Loss: "101%"},
+		&Emulation{Duplicate: "lots"},
+		&Emulation{Rate: "fast"},
+		&Emulation{Rate: "100"},
+	}
+	for _, e := range bad {
+		if err := e.Validate(); err == nil {
+			t.Errorf("%v: expected error", e)
+		}
+	}
+
+}
+
+func TestEmulationNetemArgs(t *testing.T) {
+
+	e := &Emulation{
+		Delay:     "50ms",
+		Jitter:    "5ms",
+		Loss:      "1%",
+		Duplicate: "2%",
+		Reorder:   "25%",
+		Rate:      "10Mbit",
+	}
+	args := strings.Join(e.NetemArgs(), " ")
+	expected := "delay 50ms 5ms loss 1% duplicate 2% reorder 25% rate 10mbit"
+	if args != expected {
+		t.Errorf("expected '%s' got '%s'", expected, args)
+	}
+
+	var empty *Emulation
+	if len(empty.NetemArgs()) != 0 {
+		t.Errorf("expected no args for empty emulation")
+	}
+
+}
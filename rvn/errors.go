@@ -0,0 +1,151 @@
+package rvn
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Types ======================================================================
+
+// ResourceError is an error that occurred during a particular step of acting
+// on a particular resource of a topology, e.g. defining the domain for node
+// 'a'.
+type ResourceError struct {
+	// Kind of resource: node, switch, link, network, disk or topo
+	Kind string
+	// Name of the resource as it appears in the model
+	Name string
+	// Step that failed, e.g. image, define, genconfig, configure
+	Step string
+	Err  error
+}
+
+// SkipError is the error of a host that was not configured because a host it
+// depends on was not configured.
+type SkipError struct {
+	// Prereq is the host that was not configured
+	Prereq string
+	// Err is what happened to the prerequisite
+	Err error
+}
+
+// TransientError is a failure to reach a host that may clear up by itself,
+// e.g. while the host is still booting, so the operation is worth retrying.
+type TransientError struct {
+	Err error
+}
+
+// ExitError is the failure of a command that ran on or against a host and
+// exited non-zero.
+type ExitError struct {
+	// Code is the exit code of the command, -1 if it was killed
+	Code int
+	Err  error
+}
+
+// ErrorList collects the errors of an operation that keeps going after
+// individual resources fail, so every failure can be reported at once.
+type ErrorList []error
+
+// Methods ====================================================================
+
+func (e *ResourceError) Error() string {
+	return fmt.Sprintf("%s %s: %s: %v", e.Kind, e.Name, e.Step, e.Err)
+}
+
+func (e *ResourceError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SkipError) Error() string {
+	if _, ok := e.Err.(*SkipError); ok {
+		return fmt.Sprintf("skipped, %s was skipped", e.Prereq)
+	}
+	return fmt.Sprintf("skipped, %s failed", e.Prereq)
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+func (l ErrorList) Error() string {
+	var s []string
+	for _, e := range l {
+		s = append(s, e.Error())
+	}
+	return strings.Join(s, "\n")
+}
+
+// Add appends err to the list if it is not nil. If err is itself an ErrorList
+// its elements are added individually.
+func (l *ErrorList) Add(err error) {
+	if err == nil {
+		return
+	}
+	if el, ok := err.(ErrorList); ok {
+		*l = append(*l, el...)
+		return
+	}
+	*l = append(*l, err)
+}
+
+// Err returns the list as an error, or nil if the list is empty.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// Functions ==================================================================
+
+func nodeError(name, step string, err error) error {
+	return resourceError("node", name, step, err)
+}
+
+func switchError(name, step string, err error) error {
+	return resourceError("switch", name, step, err)
+}
+
+func linkError(name, step string, err error) error {
+	return resourceError("link", name, step, err)
+}
+
+func networkError(name, step string, err error) error {
+	return resourceError("network", name, step, err)
+}
+
+func diskError(name, step string, err error) error {
+	return resourceError("disk", name, step, err)
+}
+
+func topoError(name, step string, err error) error {
+	return resourceError("topo", name, step, err)
+}
+
+// keepTransient returns err marked as transient if cause is.
+func keepTransient(cause, err error) error {
+	if _, ok := cause.(*TransientError); ok {
+		return &TransientError{err}
+	}
+	return err
+}
+
+func resourceError(kind, name, step string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ResourceError{Kind: kind, Name: name, Step: step, Err: err}
+}
@@ -0,0 +1,180 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements the configuration history of hosts. Configuring a host
+ * runs in phases, the base config rvn generates for it and then the user
+ * config, i.e. the user playbook and provisioning steps of the host. Every
+ * phase of every attempt is recorded in the store under
+ *
+ *   config_history:<topo>:<host>
+ *
+ * as a JSON list, oldest first, with when it ran, what it ran, how it exited
+ * and where its output went. The configuration state of the host names the
+ * phase it refers to, e.g. 'user: failed (1 attempt)'.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Types ======================================================================
+
+// ConfigRecord is a record of a phase of an attempt to configure a host.
+type ConfigRecord struct {
+	// Attempt is the number of the attempt, starting at 1
+	Attempt int
+	// Phase is base or user
+	Phase string
+	// Playbook is the playbook the phase ran, or provision for the
+	// provisioning steps of the host
+	Playbook string
+	Start    time.Time
+	End      time.Time
+	Duration Duration
+	// ExitCode is the exit code of the playbook or failed provisioning step,
+	// -1 if it was killed or never ran
+	ExitCode int
+	// Error is what went wrong, empty if the phase succeeded
+	Error string `json:",omitempty"`
+	// Log is the configuration log the output of the phase went to
+	Log string `json:",omitempty"`
+}
+
+// configRun is an attempt to configure a host.
+type configRun struct {
+	topo    Topo
+	host    Host
+	attempt int
+	// out is where the output of the attempt goes, log is its path
+	out io.Writer
+	log string
+	// phase is the phase the attempt is in, or got to
+	phase string
+}
+
+// Variables ==================================================================
+
+var (
+	// the number of records kept per host, older records are dropped
+	maxConfigHistory = 50
+)
+
+// Functions ==================================================================
+
+// ConfigHistory returns the configuration history of a host, oldest first.
+func ConfigHistory(topo, host string) ([]ConfigRecord, error) {
+
+	val, err := store.Get(historyKey(topo, host))
+	if err != nil || val == "" {
+		// a host that was never configured has no history
+		return nil, nil
+	}
+
+	var history []ConfigRecord
+	err = json.Unmarshal([]byte(val), &history)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"bad configuration history for %s - %v", host, err)
+	}
+	return history, nil
+
+}
+
+// Methods ====================================================================
+
+// runPhase runs f as the given phase of the configure run, with the state of
+// the host saying so, and records it in the history of the host.
+func (r *configRun) runPhase(ctx context.Context, phase, playbook string,
+	f func() error) error {
+
+	r.phase = phase
+	store.Set(stateKey(r.topo.Name, r.host.Name),
+		attemptState(phaseState(phase, "configuring"), r.attempt))
+
+	rec := ConfigRecord{
+		Attempt:  r.attempt,
+		Phase:    phase,
+		Playbook: playbook,
+		Start:    time.Now(),
+		Log:      r.log,
+	}
+	err := f()
+	rec.End = time.Now()
+	rec.Duration = Duration{rec.End.Sub(rec.Start).Round(time.Millisecond)}
+	rec.ExitCode = exitCode(err)
+	if ctx.Err() == context.DeadlineExceeded {
+		rec.Error = "timed out"
+	} else if err != nil {
+		rec.Error = err.Error()
+	}
+
+	err2 := recordConfig(r.topo.Name, r.host.Name, rec)
+	if err2 != nil {
+		log.Warnf("failed to record configuration history of %s - %v",
+			r.host.Name, err2)
+	}
+
+	return err
+
+}
+
+// Helper Functions ===========================================================
+
+// recordConfig appends a record to the configuration history of a host.
+func recordConfig(topo, host string, rec ConfigRecord) error {
+
+	history, err := ConfigHistory(topo, host)
+	if err != nil {
+		// start over rather than never recording anything again
+		history = nil
+	}
+	history = append(history, rec)
+	if len(history) > maxConfigHistory {
+		history = history[len(history)-maxConfigHistory:]
+	}
+
+	buf, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	return store.Set(historyKey(topo, host), string(buf))
+
+}
+
+func stateKey(topo, host string) string {
+	return fmt.Sprintf("config_state:%s:%s", topo, host)
+}
+
+func historyKey(topo, host string) string {
+	return fmt.Sprintf("config_history:%s:%s", topo, host)
+}
+
+// phaseState returns state as the state of the given configuration phase.
+func phaseState(phase, state string) string {
+	if phase == "" {
+		return state
+	}
+	return phase + ": " + state
+}
+
+// exitCode returns the exit code behind the error of a phase.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if te, ok := err.(*TransientError); ok {
+		err = te.Err
+	}
+	if ee, ok := err.(*ExitError); ok {
+		return ee.Code
+	}
+	return -1
+}
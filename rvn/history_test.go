@@ -0,0 +1,120 @@
+package rvn
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestConfigHistory(t *testing.T) {
+
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		saved := runConfig
+		defer func() { runConfig = saved }()
+
+		runConfig = func(ctx context.Context, run *configRun, ds DomStatus,
+			withUserConfig bool) error {
+
+			err := run.runPhase(ctx, "base", "a.yml", func() error {
+				if run.host.Name == "flaky" && run.attempt == 1 {
+					return &TransientError{&ExitError{4, fmt.Errorf("unreachable")}}
+				}
+				return nil
+			})
+			if err != nil || !withUserConfig {
+				return err
+			}
+			return run.runPhase(ctx, "user", "config/a.yml", func() error {
+				if run.host.Name == "a" {
+					return &ExitError{2, fmt.Errorf("bad playbook")}
+				}
+				return nil
+			})
+
+		}
+
+		cs := ConfigureSettings{
+			Parallel: 1,
+			Timeout:  Duration{time.Second},
+			Retries:  intPtr(1),
+			Backoff:  Duration{time.Millisecond},
+		}
+		topo := Topo{Name: "history"}
+
+		history, err := ConfigHistory("history", "a")
+		if err != nil || len(history) != 0 {
+			t.Errorf("expected no history for a new host, got %v %v", history, err)
+		}
+
+		// a user config failure is reported as such
+		configureWithRetries(topo, Host{Name: "a"}, DomStatus{}, true, cs)
+		if s["config_state:history:a"] != "user: failed (1 attempt)" {
+			t.Errorf("unexpected state '%s'", s["config_state:history:a"])
+		}
+
+		history, err = ConfigHistory("history", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 2 {
+			t.Fatalf("expected 2 records, got %+v", history)
+		}
+		base, user := history[0], history[1]
+		if base.Phase != "base" || base.Playbook != "a.yml" ||
+			base.ExitCode != 0 || base.Error != "" || base.Attempt != 1 {
+			t.Errorf("bad base record %+v", base)
+		}
+		if user.Phase != "user" || user.Playbook != "config/a.yml" ||
+			user.ExitCode != 2 || user.Error != "bad playbook" {
+			t.Errorf("bad user record %+v", user)
+		}
+		if user.Log == "" || user.Log != base.Log {
+			t.Errorf("expected both phases in one log, got '%s' and '%s'",
+				base.Log, user.Log)
+		}
+		if user.Start.Before(base.End) || user.End.Before(user.Start) ||
+			user.Duration.Duration < 0 {
+			t.Errorf("bad times %+v", user)
+		}
+
+		// a later base config success does not hide which phase it was and
+		// keeps the user config failure in the history
+		configureWithRetries(topo, Host{Name: "a"}, DomStatus{}, false, cs)
+		if s["config_state:history:a"] != "base: success (1 attempt)" {
+			t.Errorf("unexpected state '%s'", s["config_state:history:a"])
+		}
+		history, _ = ConfigHistory("history", "a")
+		if len(history) != 3 || history[1].Error != "bad playbook" {
+			t.Errorf("history not kept %+v", history)
+		}
+
+		// every attempt is recorded
+		configureWithRetries(topo, Host{Name: "flaky"}, DomStatus{}, true, cs)
+		if s["config_state:history:flaky"] != "user: success (2 attempts)" {
+			t.Errorf("unexpected state '%s'", s["config_state:history:flaky"])
+		}
+		history, _ = ConfigHistory("history", "flaky")
+		if len(history) != 3 {
+			t.Fatalf("expected 3 records, got %+v", history)
+		}
+		if history[0].Attempt != 1 || history[0].ExitCode != 4 ||
+			history[1].Attempt != 2 || history[2].Attempt != 2 {
+			t.Errorf("attempts not recorded %+v", history)
+		}
+
+		// old records are dropped
+		savedMax := maxConfigHistory
+		defer func() { maxConfigHistory = savedMax }()
+		maxConfigHistory = 2
+		configureWithRetries(topo, Host{Name: "flaky"}, DomStatus{}, false, cs)
+		history, _ = ConfigHistory("history", "flaky")
+		if len(history) != 2 || history[0].ExitCode != 4 ||
+			history[1].ExitCode != 0 {
+			t.Errorf("expected the 2 latest records, got %+v", history)
+		}
+
+	})
+
+}
@@ -0,0 +1,650 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements the image store. Base images live in /var/rvn/img and
+ * are referred to from models by reference, which is one of
+ *
+ *   - a name, e.g. 'debian-stretch', kept in /var/rvn/img/<name> and pulled
+ *     from the first of the configured image sources that has it
+ *   - a local path, e.g. './my.qcow2', kept in /var/rvn/img/user/<file>
+ *   - a URL, e.g. 'https://host/a/b.qcow2', kept in
+ *     /var/rvn/img/user/<host>/<path>
+ *   - empty, the netboot image /var/rvn/img/netboot
+ *
+ * The instance images of a topology are copy on write overlays of the base
+ * images, so a base image may not be removed while a topology uses it.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Types ======================================================================
+
+// ImageInfo describes an image on disk.
+type ImageInfo struct {
+	// Name of the image within the image store, e.g. 'user/my.qcow2', this is
+	// only set for images in the store
+	Name        string
+	Path        string
+	Format      string
+	VirtualSize int64
+	ActualSize  int64
+	// Backing is the backing chain of the image, nearest first
+	Backing []string
+}
+
+// Variables ==================================================================
+
+var (
+	// how long to wait for a domain to shut down before saving its disk
+	shutdownTimeout = 5 * time.Minute
+	shutdownPoll    = time.Second
+)
+
+// Functions ==================================================================
+
+// ImagePath returns the location of the image ref in the image store.
+func ImagePath(ref string) (string, error) {
+
+	if ref == "" {
+		return filepath.Join(imageDir, "netboot"), nil
+	}
+
+	if !strings.Contains(ref, "/") {
+		return filepath.Join(imageDir, ref), nil
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", fmt.Errorf("error validating URL: %v", err)
+	}
+	if u.Host == "" {
+		return filepath.Join(imageDir, "user", filepath.Base(u.Path)), nil
+	}
+
+	subPath, imageName, err := ParseURL(u)
+	if err != nil {
+		return "", fmt.Errorf("error parsing URL: %v", err)
+	}
+	return filepath.Join(imageDir, "user", subPath, imageName), nil
+
+}
+
+// PullImage fetches the image ref into the image store if it is not already
+// there and returns its path. Images referred to by name come from the image
+// sources in the rvn settings, local paths are copied and URLs are
+// downloaded. When rvn is offline only local sources are used.
+func PullImage(ref string) (string, error) {
+
+	path, err := ImagePath(ref)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = os.Stat(path)
+	if err == nil {
+		return path, nil
+	}
+
+	if ref == "" {
+		return path, CreateNetbootImage()
+	}
+
+	settings, err := LoadSettings()
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil {
+		return "", fmt.Errorf("error validating URL: %v", err)
+	}
+	if u.Host != "" && settings.Offline {
+		return "", fmt.Errorf(
+			"image %s is not in the image store and rvn is offline", ref)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	// source is where the image came from, its manifest is pulled from the same
+	// place
+	source := ref
+	switch {
+	case !strings.Contains(ref, "/"):
+		source, err = pullNamed(ref, path, settings)
+	case u.Host == "":
+		log.Infof("copying %s to %s", ref, path)
+		err = CopyLocalFile(ref, path)
+	default:
+		log.Infof("downloading %s to %s", ref, path)
+		err = DownloadURL(u, filepath.Dir(path), filepath.Base(path))
+	}
+	if err != nil {
+		// do not leave a partial image behind for the next pull to find
+		os.Remove(path)
+		os.Remove(path + ".manifest")
+		return "", fmt.Errorf("pulling %s failed - %v", ref, err)
+	}
+
+	// downloads bring their manifest along, it is needed to verify them
+	if !strings.HasPrefix(source, "https://") {
+		err = pullManifest(source+".manifest", path+".manifest")
+		if err != nil {
+			log.Warnf("image %s: failed to pull manifest - %v", ref, err)
+		}
+	}
+
+	return path, nil
+
+}
+
+// PullImages pulls every image used by the topology that is not already in
+// the image store.
+func PullImages(topo Topo) error {
+
+	var refs []string
+	seen := make(map[string]bool)
+	add := func(h Host) {
+		if !seen[h.Image] {
+			seen[h.Image] = true
+			refs = append(refs, h.Image)
+		}
+	}
+	for _, x := range topo.Nodes {
+		add(x.Host)
+	}
+	for _, x := range topo.Switches {
+		add(x.Host)
+	}
+
+	var errs ErrorList
+	for _, ref := range refs {
+		_, err := PullImage(ref)
+		errs.Add(resourceError("image", ref, "pull", err))
+	}
+
+	return errs.Err()
+
+}
+
+// ListImages returns every image in the image store.
+func ListImages() ([]*ImageInfo, error) {
+
+	var images []*ImageInfo
+	err := filepath.Walk(imageDir, func(
+		path string, fi os.FileInfo, err error) error {
+
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || !isImageFile(path) {
+			return nil
+		}
+		info, err := backend.ImageInfo(path)
+		if err != nil {
+			return err
+		}
+		info.Name = storeName(path)
+		images = append(images, info)
+		return nil
+
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return images, nil
+
+}
+
+// GetImageInfo returns information about the image ref from the image store.
+func GetImageInfo(ref string) (*ImageInfo, error) {
+
+	path, err := findImage(ref)
+	if err != nil {
+		return nil, err
+	}
+	info, err := backend.ImageInfo(path)
+	if err != nil {
+		return nil, err
+	}
+	info.Name = storeName(path)
+	return info, nil
+
+}
+
+// ImageUsers returns the hosts, as 'topo/host', whose instance images are
+// backed by the image at path. Besides the topologies in the runtime, the
+// disks of every domain the backend knows about are checked, which covers
+// topologies built before the runtime kept track of them.
+func ImageUsers(path string) ([]string, error) {
+
+	var users []string
+	addUser := func(user string) {
+		if !contains(users, user) {
+			users = append(users, user)
+		}
+	}
+
+	backedBy := func(image string) bool {
+		info, err := backend.ImageInfo(image)
+		if err != nil {
+			// the instance image has not been created
+			return false
+		}
+		for _, x := range info.Backing {
+			if filepath.Clean(x) == filepath.Clean(path) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for name, dir := range LoadRuntime().Topologies {
+
+		topo, err := LoadTopoFile(filepath.Join(dir, ".rvn", "topo.json"))
+		if err != nil {
+			// the topology directory is gone, so are its instance images
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, topoError(name, "load", err)
+		}
+
+		var hosts []Host
+		for _, x := range topo.Nodes {
+			hosts = append(hosts, x.Host)
+		}
+		for _, x := range topo.Switches {
+			hosts = append(hosts, x.Host)
+		}
+
+		for _, h := range hosts {
+			if backedBy(filepath.Join(dir, ".rvn", h.Name)) {
+				addUser(name + "/" + h.Name)
+			}
+		}
+
+	}
+
+	doms, err := backend.ListDomains()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains - %v", err)
+	}
+	for _, name := range doms {
+		d, err := backend.DomainInfo(name)
+		if err != nil || d.Devices == nil {
+			continue
+		}
+		for _, disk := range d.Devices.Disks {
+			if disk.Source == nil || disk.Source.File == nil {
+				continue
+			}
+			if backedBy(disk.Source.File.File) {
+				// domains are named <topo>_<host>
+				addUser(strings.Replace(name, "_", "/", 1))
+				break
+			}
+		}
+	}
+
+	sort.Strings(users)
+	return users, nil
+
+}
+
+// RemoveImage removes the image ref and its manifest from the image store.
+// Images that back the instance image of a created topology are not removed.
+func RemoveImage(ref string) error {
+
+	path, err := findImage(ref)
+	if err != nil {
+		return err
+	}
+
+	users, err := ImageUsers(path)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("image %s is in use by %s", ref,
+			strings.Join(users, ", "))
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return err
+	}
+	os.Remove(path + ".manifest")
+	os.Remove(path + ".sha256")
+	return nil
+
+}
+
+// SaveImage turns the disk of a host of the topology in the working directory
+// into a new standalone base image, user/<name> in the image store, that
+// other topologies can use as 'user/<name>'. The host is shut down while its
+// disk is flattened and started again afterwards if it was running. The new
+// image gets a manifest describing the host it was taken from.
+func SaveImage(host, name string) (string, error) {
+
+	if name == "" || strings.ContainsAny(name, "/ ") || !isImageFile(name) {
+		return "", fmt.Errorf("bad image name '%s'", name)
+	}
+	dst := filepath.Join(imageDir, "user", name)
+	_, err := os.Stat(dst)
+	if err == nil {
+		return "", fmt.Errorf("image user/%s already exists, remove it first with "+
+			"rvn image rm", name)
+	}
+
+	topo, err := LoadTopo()
+	if err != nil {
+		return "", err
+	}
+	h := topo.getHost(host)
+	if h == nil {
+		return "", fmt.Errorf("%s not found in topology", host)
+	}
+	wd, err := WkDir()
+	if err != nil {
+		return "", err
+	}
+	src := filepath.Join(wd, h.Name)
+
+	qname := topo.QualifyName(h.Name)
+	active, err := backend.DomainActive(qname)
+	if err != nil {
+		return "", err
+	}
+	if active {
+		log.Infof("shutting down %s", h.Name)
+		err = shutdownAndWait(qname)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	log.Infof("saving %s to %s", h.Name, dst)
+	part := dst + ".part"
+	err = saveImage(src, part, dst, *h)
+	if err != nil {
+		os.Remove(part)
+	}
+
+	if active {
+		serr := backend.StartDomain(qname)
+		if serr != nil && err == nil {
+			err = fmt.Errorf("failed to restart %s - %v", h.Name, serr)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return dst, nil
+
+}
+
+// Helper Functions ===========================================================
+
+// saveImage flattens the disk of host h at src into part, writes its manifest
+// next to dst and moves it into place. Like finishImage, the image is moved
+// last so an image in the store always has its manifest.
+func saveImage(src, part, dst string, h Host) error {
+
+	err := backend.ConvertImage(src, part, false)
+	if err != nil {
+		return err
+	}
+
+	m, err := hostManifest(h)
+	if err != nil {
+		return err
+	}
+	err = SaveImageManifest(dst, m)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(part, dst)
+
+}
+
+// shutdownAndWait gracefully shuts down a domain and waits for it to stop.
+func shutdownAndWait(name string) error {
+
+	err := backend.ShutdownDomain(name)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(shutdownTimeout)
+	for time.Now().Before(deadline) {
+		active, err := backend.DomainActive(name)
+		if err != nil {
+			return err
+		}
+		if !active {
+			return nil
+		}
+		time.Sleep(shutdownPoll)
+	}
+
+	return fmt.Errorf("%s did not shut down within %v", name, shutdownTimeout)
+
+}
+
+// pullNamed pulls the image name to path from the first image source that has
+// it and returns where it came from. Mirrors are skipped when rvn is offline.
+func pullNamed(name, path string, settings *Settings) (string, error) {
+
+	var tried []string
+	for _, src := range settings.ImageSources {
+
+		if strings.HasPrefix(src, "https://") {
+			if settings.Offline {
+				continue
+			}
+			url := strings.TrimSuffix(src, "/") + "/" + name
+			log.Infof("downloading %s to %s", url, path)
+			err := downloadImage(url, path)
+			if err == nil {
+				return url, nil
+			}
+			tried = append(tried, err.Error())
+			continue
+		}
+
+		file := filepath.Join(src, name)
+		_, err := os.Stat(file)
+		if err != nil {
+			tried = append(tried, fmt.Sprintf("%s: not found", file))
+			continue
+		}
+		log.Infof("copying %s to %s", file, path)
+		err = copyImage(file, path)
+		if err == nil {
+			return file, nil
+		}
+		tried = append(tried, fmt.Sprintf("%s: %v", file, err))
+
+	}
+
+	if settings.Offline && len(tried) == 0 {
+		return "", fmt.Errorf("image %s is not in the image store, rvn is "+
+			"offline and there are no local image sources", name)
+	}
+	if settings.Offline {
+		return "", fmt.Errorf("image %s is not in the image store or any local "+
+			"image source and rvn is offline\n  %s",
+			name, strings.Join(tried, "\n  "))
+	}
+	return "", fmt.Errorf("image %s not found in any image source\n  %s",
+		name, strings.Join(tried, "\n  "))
+
+}
+
+// downloadImage downloads the image at url to path along with its manifest.
+// The image is verified against the checksum in its manifest, or the one in
+// the sidecar file <url>.sha256 if the manifest has none.
+func downloadImage(url, path string) error {
+
+	// a manifest left behind by an earlier pull is not this image's
+	os.Remove(path + ".manifest")
+	err := pullManifest(url+".manifest", path+".manifest")
+	if err != nil {
+		log.Warnf("%s: failed to pull manifest - %v", url, err)
+	}
+	m, err := readImageManifest(path + ".manifest")
+	if err != nil {
+		os.Remove(path + ".manifest")
+		return err
+	}
+
+	d := &Download{URL: url, Path: path}
+	if m != nil {
+		d.SHA256 = m.SHA256
+	}
+	err = d.Run()
+	if err != nil {
+		// the manifest goes with the image
+		os.Remove(path + ".manifest")
+	}
+	return err
+
+}
+
+// pullManifest fetches the manifest at src, a URL or local file, to path. It
+// is not an error for there to be no manifest.
+func pullManifest(src, path string) error {
+
+	u, err := url.Parse(src)
+	if err != nil || u.Host == "" {
+		_, err := os.Stat(src)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return CopyLocalFile(src, path)
+	}
+
+	resp, err := httpClient.Get(src)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s - %s", src, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+
+}
+
+// copyImage copies an image from a local image source into the image store.
+// Like a download, the copy is verified against the checksum in the sidecar
+// file <src>.sha256 if there is one and only then moved into place.
+func copyImage(src, dst string) error {
+
+	part := dst + ".part"
+	err := CopyLocalFile(src, part)
+	if err != nil {
+		os.Remove(part)
+		return err
+	}
+
+	data, err := ioutil.ReadFile(src + ".sha256")
+	if err == nil {
+		sum, err := parseChecksum(string(data))
+		if err != nil {
+			os.Remove(part)
+			return fmt.Errorf("%s.sha256: %v", src, err)
+		}
+		actual, err := sha256File(part)
+		if err != nil {
+			os.Remove(part)
+			return err
+		}
+		if actual != sum {
+			os.Remove(part)
+			return fmt.Errorf("checksum mismatch: expected %s got %s", sum, actual)
+		}
+	}
+
+	return os.Rename(part, dst)
+
+}
+
+// findImage returns the path of the image ref, which must be in the image
+// store. User images may also be referred to by their path within the store as
+// shown by ListImages, e.g. 'user/host/a/b.qcow2'.
+func findImage(ref string) (string, error) {
+
+	path, err := ImagePath(ref)
+	if err != nil {
+		return "", err
+	}
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) && strings.HasPrefix(filepath.Clean(ref), "user/") {
+		path = filepath.Join(imageDir, filepath.Clean(ref))
+		_, err = os.Stat(path)
+	}
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("image %s not found", ref)
+	}
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+
+}
+
+// isImageFile returns false for the files kept alongside images in the image
+// store, such as manifests and partial downloads.
+func isImageFile(path string) bool {
+	for _, x := range []string{".manifest", ".sha256", ".part"} {
+		if strings.HasSuffix(path, x) {
+			return false
+		}
+	}
+	return true
+}
+
+// storeName returns the path of an image relative to the image store
+func storeName(path string) string {
+	name, err := filepath.Rel(imageDir, path)
+	if err != nil {
+		return path
+	}
+	return name
+}
@@ -4,7 +4,6 @@ import (
 	"errors"
 	log "github.com/sirupsen/logrus"
 	"io"
-	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
@@ -69,52 +68,22 @@ func ParseURL(parsedURL *url.URL) (path string, image string, err error) {
 	return path, image, nil
 }
 
+// DownloadURL downloads the image at parsedURL to downloadPath/imageName along
+// with its manifest. Only https URLs are supported.
 func DownloadURL(parsedURL *url.URL, downloadPath string, imageName string) error {
 	URIScheme := parsedURL.Scheme
-	var err error
 	// if no scheme for downloading file is provided, default to https
 	// TODO: enforce HTTPS -- do not allow http, redirect
-	if URIScheme == "https" {
-		err = DownloadFile(filepath.Join(downloadPath, imageName), parsedURL.String())
+	if URIScheme == "https" || URIScheme == "" {
+		return downloadImage(parsedURL.String(), filepath.Join(downloadPath, imageName))
 	} else if URIScheme == "http" {
-		err = errors.New("http is not supported, please use https!")
-		return err
-	} else if URIScheme == "" {
-		DownloadFile(filepath.Join(downloadPath, imageName), parsedURL.String())
-	} else {
-		err := errors.New(parsedURL.Scheme + " is not currently implemented!")
-		return err
-	}
-	return nil
-}
-
-// https://golangcode.com/download-a-file-from-a-url/
-func DownloadFile(filepath string, url string) error {
-	// Create the file
-	out, err := os.Create(filepath)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	// Get the data
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		return err
+		return errors.New("http is not supported, please use https!")
 	}
-
-	return nil
+	return errors.New(parsedURL.Scheme + " is not currently implemented!")
 }
 
 func CreateNetbootImage() error {
-	cmd := exec.Command("qemu-img", "create", "/var/rvn/img/netboot", "25G")
+	cmd := exec.Command("qemu-img", "create", filepath.Join(imageDir, "netboot"), "25G")
 	log.Printf("Creating netboot image")
 	err := cmd.Run()
 	return err
@@ -0,0 +1,344 @@
+package rvn
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImagePath(t *testing.T) {
+
+	saved := imageDir
+	imageDir = "/var/rvn/img"
+	defer func() { imageDir = saved }()
+
+	tests := []struct{ ref, path string }{
+		{"", "/var/rvn/img/netboot"},
+		{"debian-stretch", "/var/rvn/img/debian-stretch"},
+		{"./my.qcow2", "/var/rvn/img/user/my.qcow2"},
+		{"/home/me/images/my.qcow2", "/var/rvn/img/user/my.qcow2"},
+		{"https://example.com/rvn/fedora-27",
+			"/var/rvn/img/user/example.com/rvn/fedora-27"},
+	}
+
+	for _, x := range tests {
+		path, err := ImagePath(x.ref)
+		if err != nil {
+			t.Errorf("%s: %v", x.ref, err)
+			continue
+		}
+		if path != x.path {
+			t.Errorf("%s: expected %s, got %s", x.ref, x.path, path)
+		}
+	}
+
+}
+
+func TestImageStore(t *testing.T) {
+
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		os.MkdirAll(imageDir, 0755)
+		for _, x := range []string{"debian-stretch", "cumulusvx-3.5"} {
+			err := ioutil.WriteFile(filepath.Join(imageDir, x), []byte(x), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// pulling an image that is present is a no-op, a local image is copied
+		// into the store
+		ioutil.WriteFile("local.qcow2", []byte("local"), 0644)
+		topo := testTopo
+		topo.Nodes = append(topo.Nodes, Node{Host{Name: "c", Image: "./local.qcow2"}})
+		err := PullImages(topo)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		images, err := ListImages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, x := range images {
+			names = append(names, x.Name)
+		}
+		if strings.Join(names, " ") != "cumulusvx-3.5 debian-stretch user/local.qcow2" {
+			t.Errorf("unexpected images %v", names)
+		}
+
+		// once created the topology's instance images are backed by the store
+		err = Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = RemoveImage("debian-stretch")
+		if err == nil || !strings.Contains(err.Error(),
+			"in use by lifecycle/a, lifecycle/b") {
+			t.Errorf("expected image in use error, got %v", err)
+		}
+
+		// topologies the runtime has no record of are found by their domains
+		LoadRuntime().RemoveTopology("lifecycle")
+		err = RemoveImage("debian-stretch")
+		if err == nil || !strings.Contains(err.Error(),
+			"in use by lifecycle/a, lifecycle/b") {
+			t.Errorf("expected image in use error without a runtime record, got %v",
+				err)
+		}
+
+		info, err := GetImageInfo("./local.qcow2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name != "user/local.qcow2" || info.VirtualSize != 5 {
+			t.Errorf("unexpected image info %+v", info)
+		}
+		err = RemoveImage("user/local.qcow2")
+		if err != nil {
+			t.Errorf("expected unused image to be removed, got %v", err)
+		}
+		_, err = GetImageInfo("./local.qcow2")
+		if err == nil {
+			t.Errorf("expected removed image to be gone")
+		}
+
+		// once destroyed the images are free to go
+		err = Destroy()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = RemoveImage("debian-stretch")
+		if err != nil {
+			t.Errorf("expected image to be removed after destroy, got %v", err)
+		}
+
+	})
+
+}
+
+func TestSaveImage(t *testing.T) {
+
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		err := Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Domains["lifecycle_sw"].Active = true
+
+		path, err := SaveImage("sw", "my-switch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != filepath.Join(imageDir, "user", "my-switch") {
+			t.Errorf("unexpected image path %s", path)
+		}
+
+		wd, _ := WkDir()
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "flattened "+wd+"/sw" {
+			t.Errorf("expected flattened instance image, got '%s'", data)
+		}
+		if _, err := os.Stat(path + ".part"); !os.IsNotExist(err) {
+			t.Errorf("partial image left behind")
+		}
+		if !b.Domains["lifecycle_sw"].Active {
+			t.Errorf("expected sw to be restarted")
+		}
+
+		// the saved image carries the manifest of the image it came from
+		m, err := LoadImageManifest("user/my-switch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m == nil || m.Platform != "x86_64" || m.OS != "linux" ||
+			m.Disktype == nil || m.Disktype.Bus != "virtio" {
+			t.Errorf("unexpected manifest %+v", m)
+		}
+
+		// a stopped host stays stopped
+		_, err = SaveImage("a", "my-node")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Domains["lifecycle_a"].Active {
+			t.Errorf("expected a to stay down")
+		}
+
+		_, err = SaveImage("a", "my-node")
+		if err == nil || !strings.Contains(err.Error(), "already exists") {
+			t.Errorf("expected image exists error, got %v", err)
+		}
+		_, err = SaveImage("walrus", "my-walrus")
+		if err == nil || !strings.Contains(err.Error(), "not found") {
+			t.Errorf("expected host not found error, got %v", err)
+		}
+		_, err = SaveImage("a", "../escape")
+		if err == nil || !strings.Contains(err.Error(), "bad image name") {
+			t.Errorf("expected bad image name error, got %v", err)
+		}
+
+		// a failed conversion leaves nothing behind and restarts the host
+		b.Domains["lifecycle_b"].Active = true
+		b.Fail["convert:"+wd+"/b"] = fmt.Errorf("disk full")
+		_, err = SaveImage("b", "my-b")
+		if err == nil {
+			t.Errorf("expected convert failure")
+		}
+		if _, err := os.Stat(filepath.Join(imageDir, "user", "my-b")); err == nil {
+			t.Errorf("failed save left an image behind")
+		}
+		if !b.Domains["lifecycle_b"].Active {
+			t.Errorf("expected b to be restarted after a failed save")
+		}
+
+	})
+
+}
+
+func TestPullImageSources(t *testing.T) {
+
+	s := newImageServer(testImage())
+	s.Close()
+	mirror := httptest.NewTLSServer(s.Config.Handler)
+	defer mirror.Close()
+
+	savedClient := httpClient
+	httpClient = mirror.Client()
+	defer func() { httpClient = savedClient }()
+
+	withTestEnv(t, testTopo, func(b *memBackend, m memStore) {
+
+		// an empty local source, a local source with a checksummed image and a
+		// mirror serving 'img'
+		sources := filepath.Join(filepath.Dir(imageDir), "sources")
+		empty := filepath.Join(sources, "empty")
+		local := filepath.Join(sources, "local")
+		os.MkdirAll(empty, 0755)
+		os.MkdirAll(local, 0755)
+		ioutil.WriteFile(filepath.Join(local, "debian-stretch"), []byte("debian"), 0644)
+		ioutil.WriteFile(filepath.Join(local, "debian-stretch.sha256"), []byte(
+			"81d93757457f988523814ae0009837ae893f38d3fe123f2c37896f118b4c7804"),
+			0644)
+		ioutil.WriteFile(filepath.Join(local, "debian-stretch.manifest"),
+			[]byte("os: linux\nuser: debian\n"), 0644)
+		ioutil.WriteFile(filepath.Join(local, "bad"), []byte("bad"), 0644)
+		ioutil.WriteFile(filepath.Join(local, "bad.sha256"), []byte(
+			strings.Repeat("0", 64)), 0644)
+
+		settings := fmt.Sprintf("image-sources: [%s, %s, %s]\n",
+			empty, local, mirror.URL)
+		ioutil.WriteFile(settingsFile, []byte(settings), 0644)
+
+		path, err := PullImage("debian-stretch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadFile(path)
+		if string(data) != "debian" {
+			t.Errorf("expected image from local source, got %q", data)
+		}
+		mf, err := LoadImageManifest("debian-stretch")
+		if err != nil || mf == nil || mf.User != "debian" {
+			t.Errorf("expected manifest to be pulled with image, got %+v %v", mf, err)
+		}
+		images, err := ListImages()
+		if err != nil || len(images) != 1 {
+			t.Errorf("expected manifest to not be listed as an image, got %d %v",
+				len(images), err)
+		}
+
+		path, err = PullImage("img")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDownload(t, path, s.image)
+
+		_, err = PullImage("bad")
+		if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+			t.Errorf("expected checksum error, got %v", err)
+		}
+
+		// offline, the mirror is not consulted
+		requests := len(s.ranges)
+		ioutil.WriteFile(settingsFile, []byte(settings+"offline: true\n"), 0644)
+		os.Remove(filepath.Join(imageDir, "img"))
+		_, err = PullImage("img")
+		if err == nil || !strings.Contains(err.Error(),
+			"image img is not in the image store or any local image source "+
+				"and rvn is offline") {
+			t.Errorf("expected offline error, got %v", err)
+		}
+		_, err = PullImage("https://example.com/rvn/fedora-27")
+		if err == nil || !strings.Contains(err.Error(), "rvn is offline") {
+			t.Errorf("expected offline error, got %v", err)
+		}
+		if len(s.ranges) != requests {
+			t.Errorf("mirror accessed while offline")
+		}
+
+		// the environment overrides the settings file
+		os.Setenv("RVN_OFFLINE", "false")
+		os.Setenv("RVN_IMAGE_SOURCES", mirror.URL)
+		defer os.Unsetenv("RVN_OFFLINE")
+		defer os.Unsetenv("RVN_IMAGE_SOURCES")
+		_, err = PullImage("img")
+		if err != nil {
+			t.Errorf("expected pull from mirror, got %v", err)
+		}
+
+	})
+
+}
+
+func TestPullImageManifestChecksum(t *testing.T) {
+
+	s := newImageServer(testImage())
+	s.Close()
+	mirror := httptest.NewTLSServer(s.Config.Handler)
+	defer mirror.Close()
+
+	savedClient := httpClient
+	httpClient = mirror.Client()
+	defer func() { httpClient = savedClient }()
+
+	withTestEnv(t, testTopo, func(b *memBackend, m memStore) {
+
+		// the manifest checksum wins over the sidecar
+		ref := mirror.URL + "/img"
+		s.manifest = "os: linux\nsha256: " + strings.Repeat("0", 64) + "\n"
+		_, err := PullImage(ref)
+		if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+			t.Fatalf("expected checksum error, got %v", err)
+		}
+		path, _ := ImagePath(ref)
+		for _, x := range []string{path, path + ".manifest"} {
+			if _, err := os.Stat(x); !os.IsNotExist(err) {
+				t.Errorf("%s left behind by a failed pull", x)
+			}
+		}
+
+		s.manifest = "os: linux\nsha256: " + s.sum + "\n"
+		path, err = PullImage(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDownload(t, path, s.image)
+		mf, err := LoadImageManifest(ref)
+		if err != nil || mf == nil || mf.SHA256 != s.sum {
+			t.Errorf("expected manifest to be pulled with image, got %+v %v", mf, err)
+		}
+
+	})
+
+}
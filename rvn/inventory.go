@@ -0,0 +1,293 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements ansible inventories of whole topologies. Every host of
+ * a topology is in the 'nodes' or 'switches' group and in a group for each of
+ * its tags. Each host carries its login along with facts about it as host
+ * variables, so a playbook can address any group of hosts and look up the
+ * addresses and interfaces of other hosts, e.g.
+ *
+ *   hostvars['sw']['rvn_interfaces']['a_0-sw_1']['nic']
+ *
+ * An inventory is rendered as an INI file or as the JSON output of a dynamic
+ * inventory script.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Types ======================================================================
+
+// Inventory is an ansible inventory of a topology.
+type Inventory struct {
+	// Hosts are the names of all hosts, in topology order
+	Hosts []string
+	// Groups maps each group to the names of its hosts
+	Groups map[string][]string
+	// HostVars maps each host to its variables
+	HostVars map[string]map[string]interface{}
+}
+
+// Interface is a link interface of a host.
+type Interface struct {
+	// NIC is the index of the interface among the interfaces of the host, the
+	// test network interface comes first
+	NIC int `json:"nic"`
+	// Port is the port of the host on the link
+	Port int `json:"port"`
+}
+
+// Variables ==================================================================
+
+var (
+	// the groups every topology has
+	builtinGroups = []string{"all", "ungrouped", "nodes", "switches"}
+
+	groupRx = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// values that can go in an INI inventory unquoted
+	plainRx = regexp.MustCompile(`^[A-Za-z0-9_./:@-]+$`)
+)
+
+// Functions ==================================================================
+
+// LoadInventory returns the inventory of the topology in the working
+// directory, with the current addresses of its hosts.
+func LoadInventory() (*Inventory, error) {
+
+	topo, err := LoadTopo()
+	if err != nil {
+		return nil, err
+	}
+
+	status := Status()
+	if status == nil {
+		return nil, fmt.Errorf("failed to get status of %s", topo.Name)
+	}
+	addrs := hostAddrs(
+		status["nodes"].(map[string]DomStatus),
+		status["switches"].(map[string]DomStatus),
+	)
+
+	return NewInventory(topo, addrs)
+
+}
+
+// NewInventory returns the inventory of a topology, given the test network
+// addresses of its hosts. Hosts without an address are in the inventory but
+// have no ansible_host.
+func NewInventory(topo Topo, addrs map[string]string) (*Inventory, error) {
+
+	inv := &Inventory{
+		Groups:   make(map[string][]string),
+		HostVars: make(map[string]map[string]interface{}),
+	}
+
+	// work out the link interfaces of each host the way the domains are built,
+	// on copies of the hosts so the caller's are left alone
+	topo.Nodes = append([]Node(nil), topo.Nodes...)
+	topo.Switches = append([]Zwitch(nil), topo.Switches...)
+	err := resolveLinks(&topo)
+	if err != nil {
+		return nil, err
+	}
+
+	add := func(group string, h *Host) error {
+
+		inv.Hosts = append(inv.Hosts, h.Name)
+		inv.Groups[group] = append(inv.Groups[group], h.Name)
+		for _, t := range h.Tags {
+			inv.Groups[t] = append(inv.Groups[t], h.Name)
+		}
+
+		login, err := hostLogin(*h)
+		if err != nil {
+			return err
+		}
+		vars := map[string]interface{}{
+			"ansible_user":                 login.User,
+			"ansible_become_method":        login.Become,
+			"ansible_become_pass":          login.BecomePass,
+			"ansible_ssh_private_key_file": sshKey,
+			"rvn_platform":                 h.Platform,
+			"rvn_image":                    h.Image,
+			"rvn_telnet_port":              h.TelnetPort,
+			"rvn_interfaces":               hostInterfaces(h),
+		}
+		if login.Python != "" {
+			vars["ansible_python_interpreter"] = login.Python
+		}
+		if ip, ok := addrs[h.Name]; ok {
+			vars["ansible_host"] = ip
+			vars["rvn_mgmt_ip"] = ip
+		}
+		inv.HostVars[h.Name] = vars
+
+		return nil
+
+	}
+
+	for i := range topo.Nodes {
+		err := add("nodes", &topo.Nodes[i].Host)
+		if err != nil {
+			return nil, nodeError(topo.Nodes[i].Name, "inventory", err)
+		}
+	}
+	for i := range topo.Switches {
+		err := add("switches", &topo.Switches[i].Host)
+		if err != nil {
+			return nil, switchError(topo.Switches[i].Name, "inventory", err)
+		}
+	}
+
+	return inv, nil
+
+}
+
+// WriteInventory writes the inventory of the topology in the working
+// directory to the working directory as an INI file and returns its path.
+func WriteInventory() (string, error) {
+
+	inv, err := LoadInventory()
+	if err != nil {
+		return "", err
+	}
+	return saveInventory(inv)
+
+}
+
+// Methods ====================================================================
+
+// GroupNames returns the names of the groups of the inventory, sorted.
+func (inv *Inventory) GroupNames() []string {
+	var names []string
+	for g := range inv.Groups {
+		names = append(names, g)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// INI renders the inventory as an INI file. Every host is listed once with
+// its variables, the groups then list the hosts by name.
+func (inv *Inventory) INI() string {
+
+	var b bytes.Buffer
+
+	for _, h := range inv.Hosts {
+		b.WriteString(h)
+		vars := inv.HostVars[h]
+		var keys []string
+		for k := range vars {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(&b, " %s=%s", k, iniValue(vars[k]))
+		}
+		b.WriteString("\n")
+	}
+
+	for _, g := range inv.GroupNames() {
+		fmt.Fprintf(&b, "\n[%s]\n", g)
+		for _, h := range inv.Groups[g] {
+			b.WriteString(h + "\n")
+		}
+	}
+
+	return b.String()
+
+}
+
+// JSON renders the inventory as the --list output of a dynamic inventory
+// script.
+func (inv *Inventory) JSON() ([]byte, error) {
+
+	doc := map[string]interface{}{
+		"_meta": map[string]interface{}{"hostvars": inv.HostVars},
+		"all":   map[string]interface{}{"children": inv.GroupNames()},
+	}
+	for g, hosts := range inv.Groups {
+		doc[g] = map[string]interface{}{"hosts": hosts}
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+
+}
+
+// Helper Functions ===========================================================
+
+// saveInventory writes an inventory to the working directory as an INI file
+// and returns its path.
+func saveInventory(inv *Inventory) (string, error) {
+
+	path, err := inventoryPath()
+	if err != nil {
+		return "", err
+	}
+
+	err = ioutil.WriteFile(path, []byte(inv.INI()), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+
+}
+
+// inventoryPath returns the path of the inventory in the working directory.
+func inventoryPath() (string, error) {
+	wd, err := WkDir()
+	if err != nil {
+		return "", err
+	}
+	return wd + "/inventory", nil
+}
+
+// hostInterfaces returns the link interfaces of a host with resolved links,
+// by link name.
+func hostInterfaces(h *Host) map[string]Interface {
+
+	ifxs := make(map[string]Interface)
+	nic := 0
+	if !h.NoTestNet {
+		nic = 1
+	}
+	for _, p := range h.ports {
+		ifxs[p.Link] = Interface{NIC: nic, Port: p.Index}
+		nic++
+	}
+	return ifxs
+
+}
+
+// iniValue renders a host variable for an INI inventory. Strings are quoted
+// when needed, anything else is written as JSON, which ansible reads back as
+// the corresponding python literal.
+func iniValue(v interface{}) string {
+
+	if s, ok := v.(string); ok {
+		if plainRx.MatchString(s) {
+			return s
+		}
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "''"
+	}
+	if bytes.ContainsAny(data, "{[ ") {
+		return "'" + string(data) + "'"
+	}
+	return string(data)
+
+}
@@ -0,0 +1,124 @@
+package rvn
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInventory(t *testing.T) {
+
+	topo := testTopo
+	topo.Nodes = []Node{
+		{Host{Name: "a", Image: "debian-stretch", OS: "linux", Platform: "x86_64",
+			Tags: []string{"ceph", "osd"}}},
+		{Host{Name: "b", Image: "freebsd-11", OS: "freebsd", Platform: "x86_64",
+			Tags: []string{"ceph"}, TelnetPort: 4001}},
+	}
+
+	withTestEnv(t, topo, func(b *memBackend, s memStore) {
+
+		inv, err := NewInventory(topo, map[string]string{
+			"a": "172.22.0.2", "sw": "172.22.0.4",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		groups := map[string][]string{
+			"nodes":    {"a", "b"},
+			"switches": {"sw"},
+			"ceph":     {"a", "b"},
+			"osd":      {"a"},
+		}
+		if !reflect.DeepEqual(inv.Groups, groups) {
+			t.Errorf("unexpected groups %v", inv.Groups)
+		}
+
+		a := inv.HostVars["a"]
+		if a["ansible_host"] != "172.22.0.2" || a["rvn_mgmt_ip"] != "172.22.0.2" ||
+			a["ansible_user"] != "rvn" || a["rvn_image"] != "debian-stretch" ||
+			a["rvn_platform"] != "x86_64" {
+			t.Errorf("unexpected vars for a %v", a)
+		}
+		if _, ok := inv.HostVars["b"]["ansible_host"]; ok {
+			t.Errorf("b has no address but got an ansible_host")
+		}
+		if inv.HostVars["b"]["ansible_python_interpreter"] !=
+			"/usr/local/bin/python2" || inv.HostVars["b"]["rvn_telnet_port"] != 4001 {
+			t.Errorf("unexpected vars for b %v", inv.HostVars["b"])
+		}
+
+		// the test network interface comes first
+		ifxs := map[string]Interface{
+			"a_0-sw_1": {NIC: 1, Port: 1},
+			"b_0-sw_2": {NIC: 2, Port: 2},
+		}
+		if !reflect.DeepEqual(inv.HostVars["sw"]["rvn_interfaces"], ifxs) {
+			t.Errorf("unexpected interfaces for sw %v",
+				inv.HostVars["sw"]["rvn_interfaces"])
+		}
+		if len(topo.Switches[0].ports) != 0 {
+			t.Errorf("inventory resolved the links of the caller's topology")
+		}
+
+		ini := inv.INI()
+		for _, x := range []string{
+			"a ansible_become_method=sudo ansible_become_pass=rvn " +
+				"ansible_host=172.22.0.2 ",
+			` rvn_interfaces='{"a_0-sw_1":{"nic":1,"port":0}}' `,
+			"\n[ceph]\na\nb\n",
+			"\n[switches]\nsw\n",
+		} {
+			if !strings.Contains(ini, x) {
+				t.Errorf("expected %q in inventory\n%s", x, ini)
+			}
+		}
+
+		data, err := inv.JSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc struct {
+			Meta struct {
+				HostVars map[string]map[string]interface{}
+			} `json:"_meta"`
+			All  struct{ Children []string }
+			Ceph struct{ Hosts []string }
+		}
+		err = json.Unmarshal(data, &doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(doc.All.Children, ",") != "ceph,nodes,osd,switches" ||
+			strings.Join(doc.Ceph.Hosts, ",") != "a,b" ||
+			doc.Meta.HostVars["sw"]["ansible_host"] != "172.22.0.4" {
+			t.Errorf("unexpected dynamic inventory\n%s", data)
+		}
+
+	})
+
+}
+
+func TestIniValue(t *testing.T) {
+
+	tests := []struct {
+		value    interface{}
+		expected string
+	}{
+		{"rvn", "rvn"},
+		{"/usr/local/bin/python2", "/usr/local/bin/python2"},
+		{"two words", `"two words"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{"", `""`},
+		{4001, "4001"},
+		{map[string]int{"x": 1}, `'{"x":1}'`},
+	}
+	for _, x := range tests {
+		if v := iniValue(x.value); v != x.expected {
+			t.Errorf("%v: expected %s, got %s", x.value, x.expected, v)
+		}
+	}
+
+}
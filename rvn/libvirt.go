@@ -1,20 +1,22 @@
 package rvn
 
-// TODO
-//   - better error diagnostics and propagation
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements the libvirt backend of rvn. Domains and networks are
+ * managed through a qemu:///session libvirt connection, instance images are
+ * created with qemu-img and host networking is plumbed with iptables.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
 
 import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"net/url"
 	"os"
 	"os/exec"
-	"sort"
-	"strconv"
+	"path/filepath"
 	"strings"
 
-	"github.com/fatih/color"
 	"github.com/libvirt/libvirt-go"
 	xlibvirt "github.com/libvirt/libvirt-go-xml"
 	log "github.com/sirupsen/logrus"
@@ -22,390 +24,152 @@ import (
 
 // Types ======================================================================
 
-// DomStatus encapsulates various information about a libvirt domain for
-// purposes of serialization and presentation.
-type DomStatus struct {
-	Name        string
-	State       string
-	ConfigState string
-	IP          string
-	Macs        []string
-	VNC         int
-}
+// LibvirtBackend is the default rvn backend.
+type LibvirtBackend struct{}
 
 // Variables ==================================================================
 
 var conn *libvirt.Connect
 
-// Functions ==================================================================
+// Methods ====================================================================
 
-// Create creates a libvirt definition for the supplied topology.  It does not
-// launch the system. For that functionality use the Launch function. If a
-// topology with the same name as the topology provided as an argument exists,
-// that topology will be overwritten by the system generated from the argument.
-func Create() {
-	//TODO need to return an error if shizz goes sideways
+// Domains --------------------------------------------------------------------
 
-	wd, err := WkDir()
-	if err != nil {
-		log.Printf("create: failed to get working dir")
-		return
-	}
+func (b *LibvirtBackend) DefineDomain(d *xlibvirt.Domain) error {
+	checkConnect()
 
-	topo, err := LoadTopo()
+	xml, err := d.Marshal()
 	if err != nil {
-		log.Printf("create failed to load topo")
-		return
-	}
-
-	topoDir := wd
-	os.MkdirAll(topoDir, 0755)
-
-	doms := make(map[string]*xlibvirt.Domain)
-	nets := make(map[string]*xlibvirt.Network)
-
-	subnet := LoadRuntime().AllocateSubnet(topo.Name)
-	topo.MgmtIp = fmt.Sprintf("172.22.%d.1", subnet)
-
-	nets["test"] = &xlibvirt.Network{
-		Name: topo.QualifyName("test"),
-		IPs: []xlibvirt.NetworkIP{
-			xlibvirt.NetworkIP{
-				Address: topo.MgmtIp,
-				Netmask: "255.255.255.0",
-				DHCP: &xlibvirt.NetworkDHCP{
-					Ranges: []xlibvirt.NetworkDHCPRange{
-						xlibvirt.NetworkDHCPRange{
-							Start: fmt.Sprintf("172.22.%d.2", subnet),
-							End:   fmt.Sprintf("172.22.%d.254", subnet),
-						},
-					},
-				},
-			},
-		},
-		Domain: &xlibvirt.NetworkDomain{
-			Name:      topo.Name + ".net",
-			LocalOnly: "yes",
-		},
-		Forward: &xlibvirt.NetworkForward{
-			Mode: "nat",
-		},
-	}
-
-	for _, node := range topo.Nodes {
-		d := newDom(&node.Host, &topo)
-		GenConfig(node.Host, topo)
-		doms[node.Name] = d
-		if !node.NoTestNet {
-			domConnect(topo.QualifyName("test"), &node.Host, d, nil)
-		}
-	}
-
-	for _, zwitch := range topo.Switches {
-		d := newDom(&zwitch.Host, &topo)
-		GenConfig(zwitch.Host, topo)
-		doms[zwitch.Name] = d
-		if !zwitch.NoTestNet {
-			domConnect(topo.QualifyName("test"), &zwitch.Host, d, nil)
-		}
-	}
-
-	for _, link := range topo.Links {
-
-		n := &xlibvirt.Network{
-			Name:   topo.QualifyName(link.Name),
-			Bridge: &xlibvirt.NetworkBridge{Delay: "0", STP: "off"},
-		}
-
-		nets[link.Name] = n
-
+		return fmt.Errorf("error marshalling domain %s - %v", d.Name, err)
 	}
 
-	resolveLinks(&topo)
-
-	for _, x := range topo.Nodes {
-		for _, p := range x.ports {
-			domConnect(
-				topo.QualifyName(p.Link),
-				&x.Host,
-				doms[x.Name],
-				topo.getLink(p.Link).Props)
-		}
+	err = destroyDomain(d.Name)
+	if err != nil {
+		return err
 	}
-	for _, x := range topo.Switches {
-		for _, p := range x.ports {
-			domConnect(
-				topo.QualifyName(p.Link),
-				&x.Host,
-				doms[x.Name],
-				topo.getLink(p.Link).Props)
-		}
+	x, err := conn.DomainDefineXML(xml)
+	if err != nil {
+		return err
 	}
+	x.Free()
+	return nil
+}
 
-	data, _ := json.MarshalIndent(topo, "", "  ")
-	ioutil.WriteFile(topoDir+"/topo.json", []byte(data), 0644)
-
+func (b *LibvirtBackend) UndefineDomain(name string) error {
 	checkConnect()
-
-	for _, d := range doms {
-		xml, err := d.Marshal()
-		if err != nil {
-			log.Printf("error marshalling domain %v", err)
-		}
-		ioutil.WriteFile(topoDir+"/dom_"+d.Name+".xml", []byte(xml), 0644)
-
-		dd, err := conn.LookupDomainByName(d.Name)
-		if err != nil {
-			_, err := conn.DomainDefineXML(xml)
-			if err != nil {
-				log.Printf("error defining domain %v", err)
-			}
-		} else {
-			dd.Destroy()
-			dd.Undefine()
-			conn.DomainDefineXML(xml)
-			dd.Free()
-		}
-	}
-
-	for _, n := range nets {
-		xml, _ := n.Marshal()
-		ioutil.WriteFile(topoDir+"/net_"+n.Name+".xml", []byte(xml), 0644)
-
-		nn, err := conn.LookupNetworkByName(n.Name)
-		if err != nil {
-			conn.NetworkDefineXML(xml)
-		} else {
-			nn.Destroy()
-			nn.Undefine()
-			conn.NetworkDefineXML(xml)
-			nn.Free()
-		}
-	}
-
-	//create NFS exports
-	ExportNFS(topo)
-
+	return destroyDomain(name)
 }
 
-// Destroy completely wipes out a topology with the given name. If the system
-// is running within libvirt it is torn down. The entire definition of the
-// system is also removed from libvirt.
-func Destroy() {
-	//TODO return error on sideways
+func (b *LibvirtBackend) StartDomain(name string) error {
 	checkConnect()
-	dbCheckConnection()
-
-	wd, err := WkDir()
+	x, err := conn.LookupDomainByName(name)
 	if err != nil {
-		log.Printf("newdom: failed to get working dir")
-		return
+		return err
 	}
+	defer x.Free()
+	return x.Create()
+}
 
-	topo, err := LoadTopo()
+func (b *LibvirtBackend) ShutdownDomain(name string) error {
+	checkConnect()
+	x, err := conn.LookupDomainByName(name)
 	if err != nil {
-		//log.Printf("destroy: failed to load topo - %v", err)
-		//nothing to destroy
-		return
-	}
-	topoDir := wd
-	os.RemoveAll(topoDir)
-
-	for _, x := range topo.Nodes {
-		destroyDomain(topo.QualifyName(x.Name), conn)
-		if x.Host.TelnetPort != 0 {
-			LoadRuntime().FreeTelnetPort(x.Host.TelnetPort)
-		}
-		state_key := fmt.Sprintf("config_state:%s:%s", topo.Name, x.Name)
-		db.Del(state_key)
-	}
-	for _, x := range topo.Switches {
-		if x.Host.TelnetPort != 0 {
-			LoadRuntime().FreeTelnetPort(x.Host.TelnetPort)
-		}
-		destroyDomain(topo.QualifyName(x.Name), conn)
-		state_key := fmt.Sprintf("config_state:%s:%s", topo.Name, x.Name)
-		db.Del(state_key)
+		return fmt.Errorf("request to shutdown unknown vm %s", name)
 	}
+	defer x.Free()
 
-	for _, x := range topo.Links {
-		cleanupLinkNetwork(topo.QualifyName(x.Name), conn)
-		destroyNetwork(topo.QualifyName(x.Name), conn)
+	x.ShutdownFlags(libvirt.DOMAIN_SHUTDOWN_ACPI_POWER_BTN)
+	active, err := x.IsActive()
+	if err == nil && active {
+		log.Printf("shutting down %s", name)
+		return x.Shutdown()
 	}
-	cleanupTestNetwork(topo.QualifyName("test"), conn)
-	destroyNetwork(topo.QualifyName("test"), conn)
-	LoadRuntime().FreeSubnet(topo.Name)
-	UnexportNFS(topo.Name)
+	return err
 }
 
-// Shutdown turns of a virtual machine gracefully
-func Shutdown() []error {
+func (b *LibvirtBackend) RebootDomain(name string, reset bool) error {
 	checkConnect()
-	dbCheckConnection()
-
-	topo, err := LoadTopo()
+	x, err := conn.LookupDomainByName(name)
 	if err != nil {
-		if strings.Contains(err.Error(), "topo.json: no such file or directory") {
-			log.Printf("Topology not built. Use `rvn build` first")
-			return []error{}
-		}
-		return []error{fmt.Errorf("shutdown: failed to load topo")}
+		return err
 	}
+	defer x.Free()
 
-	errs := []error{}
-	for _, x := range topo.Nodes {
-		err := shutdownDomain(topo.QualifyName(x.Name), conn)
-		if err != nil {
-			errs = append(errs, err)
-		}
+	if reset {
+		return x.Reset(0)
 	}
-	for _, x := range topo.Switches {
-		err := shutdownDomain(topo.QualifyName(x.Name), conn)
-		if err != nil {
-			errs = append(errs, err)
-		}
-	}
-	if len(errs) > 0 {
-		return errs
-	}
-	return nil
+	return x.Reboot(libvirt.DOMAIN_REBOOT_DEFAULT)
 }
 
-func WipeNode(topo Topo, name string) error {
+func (b *LibvirtBackend) DomainActive(name string) (bool, error) {
 	checkConnect()
-	dbCheckConnection()
-	h := topo.getHost(name)
-	if h == nil {
-		return fmt.Errorf("host %s does not exist", name)
-	}
-	destroyDomain(topo.QualifyName(name), conn)
-	d := newDom(h, &topo)
-
-	if !h.NoTestNet {
-		domConnect(topo.QualifyName("test"), h, d, nil)
-	}
-	resolveLinks(&topo)
-	for _, p := range h.ports {
-		domConnect(
-			topo.QualifyName(p.Link),
-			h,
-			d,
-			topo.getLink(p.Link).Props)
-	}
-
-	xml, err := d.Marshal()
-	if err != nil {
-		return fmt.Errorf("error marshalling domain %v", err)
-	}
-
-	dom, err := conn.DomainDefineXML(xml)
+	x, err := conn.LookupDomainByName(name)
 	if err != nil {
-		return fmt.Errorf("error defining domain %v", err)
+		return false, err
 	}
-	return dom.Create()
+	defer x.Free()
+	return x.IsActive()
 }
 
-// Launch brings up the system with the given name. This system must exist
-// visa-vis the create function before calling Launch. The return value is
-// a list of diagnostic strings that were provided by libvirt when launching
-// the system. The existence of diagnostics does not necessarily indicate
-// an error in launching. This function is asynchronous, when it returns the
-// system is still launching. Use the Status function to check up on a the
-// launch process.
-func Launch() []string {
-	//TODO name should probably be something more like 'deploy'
+func (b *LibvirtBackend) DomainState(name string) (DomStatus, error) {
 	checkConnect()
 
-	topo, err := LoadTopo()
+	var status DomStatus
+	x, err := conn.LookupDomainByName(name)
 	if err != nil {
-		if strings.Contains(err.Error(), "topo.json: no such file or directory") {
-			log.Printf("Topology not built. Use `rvn build` first")
-			return []string{}
-		}
-		err := fmt.Errorf("failed to load topo %v", err)
-		return []string{fmt.Sprintf("%v", err)}
-	}
-
-	//collect all the doamins and networks first so we know everything we need
-	//exists
-	var errors []string
-	var doms []*libvirt.Domain
-	var nets []*libvirt.Network
-
-	for _, x := range topo.Nodes {
-		d, err := conn.LookupDomainByName(topo.QualifyName(x.Name))
-		if err != nil {
-			errors = append(errors, fmt.Sprintf("%s: %v", x.Name, err))
-		} else {
-			doms = append(doms, d)
-		}
-	}
-	for _, x := range topo.Switches {
-		d, err := conn.LookupDomainByName(topo.QualifyName(x.Name))
-		if err != nil {
-			errors = append(errors, fmt.Sprintf("%s: %v", x.Name, err))
-		} else {
-			doms = append(doms, d)
-		}
+		return status, err
 	}
+	defer x.Free()
 
-	for _, x := range topo.Links {
-		n, err := conn.LookupNetworkByName(topo.QualifyName(x.Name))
-		if err != nil {
-			errors = append(errors, fmt.Sprintf("%s: %v", x.Name, err))
-		} else {
-			nets = append(nets, n)
-		}
+	info, err := x.GetInfo()
+	if err != nil {
+		return status, err
 	}
+	switch info.State {
+	case libvirt.DOMAIN_NOSTATE:
+		status.State = "nostate"
+	case libvirt.DOMAIN_RUNNING:
+		status.State = "running"
+		addrs, err := x.ListAllInterfaceAddresses(
+			libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE)
+		if err == nil {
 
-	//test network
-	n, err := conn.LookupNetworkByName(topo.QualifyName("test"))
-	allowRpcBind(n)
-	if err != nil {
-		errors = append(errors, fmt.Sprintf("%s: %v", "test", err))
-	} else {
-		nets = append(nets, n)
-	}
-
-	for _, net := range nets {
-		active, err := net.IsActive()
-		if err == nil && !active {
-			err := net.Create()
-			name, _ := net.GetName()
-			if err != nil {
-				errors = append(errors, fmt.Sprintf("%s: %v", name, err))
+			for _, a := range addrs {
+				status.Macs = append(status.Macs, a.Hwaddr)
 			}
-			if name != topo.QualifyName("test") {
-				setBridgeProperties(net)
-			}
-			net.Free()
-		}
-	}
 
-	for _, dom := range doms {
-		active, err := dom.IsActive()
-		if err == nil && !active {
-			err := dom.Create()
-			if err != nil {
-				name, _ := dom.GetName()
-				errors = append(errors, fmt.Sprintf("%s: %v", name, err))
+			if len(addrs) > 0 {
+				ifx := addrs[0]
+				if len(ifx.Addrs) > 0 {
+					status.IP = ifx.Addrs[0].Addr
+				}
 			}
-			dom.Free()
+
 		}
+	case libvirt.DOMAIN_BLOCKED:
+		status.State = "blocked"
+	case libvirt.DOMAIN_PAUSED:
+		status.State = "paused"
+	case libvirt.DOMAIN_SHUTDOWN:
+		status.State = "shutdown"
+	case libvirt.DOMAIN_CRASHED:
+		status.State = "crashed"
+	case libvirt.DOMAIN_PMSUSPENDED:
+		status.State = "suspended"
+	case libvirt.DOMAIN_SHUTOFF:
+		status.State = "off"
 	}
-
-	return errors
+	return status, nil
 }
 
-// Domain info fetches the libvirt domain information about host within a
-// raven topology
-func DomainInfo(topo, name string) (*xlibvirt.Domain, error) {
-
+func (b *LibvirtBackend) DomainInfo(name string) (*xlibvirt.Domain, error) {
 	checkConnect()
-	dom, err := conn.LookupDomainByName(topo + "_" + name)
+	dom, err := conn.LookupDomainByName(name)
 	if err != nil {
 		return nil, err
 	}
+	defer dom.Free()
+
 	xmldoc, err := dom.GetXMLDesc(0)
 	if err != nil {
 		return nil, err
@@ -418,683 +182,438 @@ func DomainInfo(topo, name string) (*xlibvirt.Domain, error) {
 	}
 
 	return xdom, nil
-
 }
 
-// The status function returns the runtime status of a topology, node by node
-// and network by network.
-func Status() map[string]interface{} {
-
-	status := make(map[string]interface{})
-
+func (b *LibvirtBackend) ListDomains() ([]string, error) {
 	checkConnect()
-
-	topo, err := LoadTopo()
+	doms, err := conn.ListAllDomains(0)
 	if err != nil {
-		if strings.Contains(err.Error(), "topo.json: no such file or directory") {
-			log.Printf("Topology not built. Use `rvn build` first")
-			return nil
-		}
-		log.Printf("status: failed to load topo - %v", err)
-		return nil
+		return nil, err
 	}
 
-	nodes := make(map[string]DomStatus)
-	status["nodes"] = nodes
+	var names []string
+	for i := range doms {
+		name, err := doms[i].GetName()
+		if err == nil {
+			names = append(names, name)
+		}
+		doms[i].Free()
+	}
+	return names, nil
+}
 
-	switches := make(map[string]DomStatus)
-	status["switches"] = switches
+// Networks -------------------------------------------------------------------
 
-	links := make(map[string]string)
-	status["links"] = links
+func (b *LibvirtBackend) DefineNetwork(n *xlibvirt.Network) error {
+	checkConnect()
 
-	for _, x := range topo.Nodes {
-		nodes[x.Name] =
-			domainStatus(topo.Name, x.Name, topo.QualifyName(x.Name), conn)
-	}
-	for _, x := range topo.Switches {
-		switches[x.Name] =
-			domainStatus(topo.Name, x.Name, topo.QualifyName(x.Name), conn)
+	xml, err := n.Marshal()
+	if err != nil {
+		return fmt.Errorf("error marshalling network %s - %v", n.Name, err)
 	}
 
-	for _, x := range topo.Links {
-		links[x.Name] = networkStatus(topo.QualifyName(x.Name), conn)
+	err = destroyNetwork(n.Name)
+	if err != nil {
+		return err
 	}
-
-	subnet, ok := LoadRuntime().SubnetReverseTable[topo.Name]
-	if ok {
-		status["mgmtip"] = fmt.Sprintf("172.22.%d.1", subnet)
+	x, err := conn.NetworkDefineXML(xml)
+	if err != nil {
+		return err
 	}
+	x.Free()
+	return nil
+}
 
-	return status
+func (b *LibvirtBackend) UndefineNetwork(name string) error {
+	checkConnect()
+	return destroyNetwork(name)
 }
 
-// Domain status returns the current state of a domain (host) within a libvirt
-// topology.
-func DomainStatus(topo, name string) (DomStatus, error) {
+func (b *LibvirtBackend) StartNetwork(name string) error {
 	checkConnect()
-	return domainStatus(topo, name, topo+"_"+name, conn), nil
+	x, err := conn.LookupNetworkByName(name)
+	if err != nil {
+		return err
+	}
+	defer x.Free()
+	return x.Create()
 }
 
-// Reboot attempts to gracefully reboot a raven host
-func Reboot(rr RebootRequest) error {
+func (b *LibvirtBackend) NetworkActive(name string) (bool, error) {
 	checkConnect()
+	x, err := conn.LookupNetworkByName(name)
+	if err != nil {
+		return false, err
+	}
+	defer x.Free()
+	return x.IsActive()
+}
 
-	topo, err := LoadTopo()
+func (b *LibvirtBackend) EmulateLink(name string, e *Emulation) error {
+	checkConnect()
+	x, err := conn.LookupNetworkByName(name)
 	if err != nil {
 		return err
 	}
+	defer x.Free()
 
-	for _, x := range rr.Nodes {
+	br, err := x.GetBridgeName()
+	if err != nil {
+		return fmt.Errorf("error getting bridge for %s - %v", name, err)
+	}
 
-		d, err := conn.LookupDomainByName(fmt.Sprintf("%s_%s", rr.Topo, x))
+	ifxs, err := ioutil.ReadDir(fmt.Sprintf("/sys/class/net/%s/brif", br))
+	if err != nil {
+		return fmt.Errorf("error listing interfaces of bridge %s - %v", br, err)
+	}
+	for _, ifx := range ifxs {
+		err := netem(ifx.Name(), e)
 		if err != nil {
-			continue
+			return err
 		}
-
-		//seabios is not responsive to a reboot request, have to pull the plug
-		h := topo.getHost(x)
-		if h != nil && h.OS == "netboot" {
-			d.Reset(0)
-		} else {
-			d.Reboot(libvirt.DOMAIN_REBOOT_DEFAULT)
-		}
-
 	}
 
 	return nil
-
 }
 
-// Helper Functions ===========================================================
-
-func connect() {
-	var err error
-	conn, err = libvirt.NewConnect("qemu:///session")
+func (b *LibvirtBackend) SetLinkState(name string, up bool) error {
+	checkConnect()
+	x, err := conn.LookupNetworkByName(name)
 	if err != nil {
-		log.Printf("libvirt connect failure: %v", err)
+		return err
 	}
-}
+	defer x.Free()
 
-func isAlive() bool {
-	result, err := conn.IsAlive()
+	br, err := x.GetBridgeName()
 	if err != nil {
-		log.Printf("error assesing connection liveness - %v", err)
-		return false
+		return fmt.Errorf("error getting bridge for %s - %v", name, err)
 	}
-	return result
-}
 
-func checkConnect() {
-	for conn == nil {
-		connect()
+	state := "down"
+	if up {
+		state = "up"
 	}
-
-	for !isAlive() {
-		connect()
+	out, err := exec.Command("ip", "link", "set", "dev", br, state).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error setting bridge %s %s %s - %v", br, state, out, err)
 	}
-}
-
-func newDom(h *Host, t *Topo) *xlibvirt.Domain {
 
-	switch h.Platform {
-
-	case "x86_64":
-		return x86Dom(h, t)
-
-	case "arm7":
-		return arm7Dom(h, t)
+	return nil
+}
 
-	default:
-		log.Printf("unrecognized platform - using x86_64")
-		return x86Dom(h, t)
+// Host plumbing --------------------------------------------------------------
 
-	}
+func (b *LibvirtBackend) SetupLinkNetwork(name string) error {
+	return withNetwork(name, setBridgeProperties)
 }
 
-func createModel(h *Host) *xlibvirt.DomainCPUModel {
-	if h.CPU.Model == "" {
-		return nil
-	} else {
-		return &xlibvirt.DomainCPUModel{Value: h.CPU.Model}
-	}
+func (b *LibvirtBackend) CleanupLinkNetwork(name string) error {
+	return withNetwork(name, cleanupBOOTP)
 }
 
-func x86Dom(h *Host, t *Topo) *xlibvirt.Domain {
-
-	instanceImage := createImage(h)
-	if instanceImage == "" {
-		return nil
-	}
-
-	d := &xlibvirt.Domain{
-		Type: "kvm",
-		Name: t.QualifyName(h.Name),
-		Features: &xlibvirt.DomainFeatureList{
-			ACPI: &xlibvirt.DomainFeature{},
-			APIC: &xlibvirt.DomainFeatureAPIC{},
-		},
-		OS: &xlibvirt.DomainOS{
-			Type:    &xlibvirt.DomainOSType{Type: "hvm"},
-			Kernel:  findKernel(h),
-			Initrd:  findInitrd(h),
-			Cmdline: h.Cmdline,
-		},
-		CPU: &xlibvirt.DomainCPU{
-
-			Match: "minimum",
-			//TODO: plumb this capability in ....
-			//Mode: "host-passthrough",
-			Model: createModel(h),
-			Topology: &xlibvirt.DomainCPUTopology{
-				Sockets: h.CPU.Sockets,
-				Cores:   h.CPU.Cores,
-				Threads: h.CPU.Threads,
-			},
-		},
-		VCPU: &xlibvirt.DomainVCPU{
-			Value: h.CPU.Sockets * h.CPU.Cores * h.CPU.Threads,
-		},
-		Memory: &xlibvirt.DomainMemory{
-			Value: uint(h.Memory.Capacity.Value),
-			Unit:  h.Memory.Capacity.Unit,
-		},
-		Devices: &xlibvirt.DomainDeviceList{
-			Serials: []xlibvirt.DomainSerial{
-				xlibvirt.DomainSerial{
-					Source: &xlibvirt.DomainChardevSource{
-						Pty: &xlibvirt.DomainChardevSourcePty{},
-					},
-				},
-				xlibvirt.DomainSerial{
-					Source: &xlibvirt.DomainChardevSource{
-						TCP: &xlibvirt.DomainChardevSourceTCP{
-							Mode:    "bind",
-							Host:    "localhost",
-							Service: fmt.Sprintf("%d", h.TelnetPort),
-						},
-					},
-					Protocol: &xlibvirt.DomainChardevProtocol{
-						Type: "telnet",
-					},
-				},
-			},
-			Consoles: []xlibvirt.DomainConsole{
-				xlibvirt.DomainConsole{
-					Source: &xlibvirt.DomainChardevSource{
-						Pty: &xlibvirt.DomainChardevSourcePty{},
-					},
-					Target: &xlibvirt.DomainConsoleTarget{Type: "serial"},
-				},
-			},
-			Graphics: []xlibvirt.DomainGraphic{
-				createGraphics(t),
-				/*
-					xlibvirt.DomainGraphic{
-						VNC: &xlibvirt.DomainGraphicVNC{
-							Port:     -1,
-							AutoPort: "yes",
-						},
-					},
-				*/
-			},
-			Disks: []xlibvirt.DomainDisk{
-				xlibvirt.DomainDisk{
-					Device: "disk",
-					Driver: &xlibvirt.DomainDiskDriver{Name: "qemu", Type: "qcow2"},
-					Source: &xlibvirt.DomainDiskSource{
-						File: &xlibvirt.DomainDiskSourceFile{
-							File: instanceImage,
-						},
-					},
-					Target: &xlibvirt.DomainDiskTarget{
-						Dev: h.DefaultDisktype.Dev + "a",
-						Bus: h.DefaultDisktype.Bus,
-					},
-				},
-			},
-		},
-	}
-
-	return d
-
+func (b *LibvirtBackend) SetupTestNetwork(name string) error {
+	return withNetwork(name, allowRpcBind)
 }
 
-func createGraphics(t *Topo) xlibvirt.DomainGraphic {
-	switch t.Options.Display {
-	case "local":
-		return xlibvirt.DomainGraphic{
-			Desktop: &xlibvirt.DomainGraphicDesktop{
-				Display: "gtk",
-			},
-		}
-	default:
-		return xlibvirt.DomainGraphic{
-			VNC: &xlibvirt.DomainGraphicVNC{
-				Port:     -1,
-				AutoPort: "yes",
-			},
-		}
-	}
+func (b *LibvirtBackend) CleanupTestNetwork(name string) error {
+	return withNetwork(name, cleanupRpcBind)
 }
 
-func createImage(h *Host) string {
+func (b *LibvirtBackend) Export(name, path string) error {
 
-	wd, err := WkDir()
+	os.MkdirAll("/etc/exports.d", 0755)
+	out, err := exec.Command("cp", path, "/etc/exports.d/").CombinedOutput()
 	if err != nil {
-		log.Printf("newdom: failed to get working dir")
-		return ""
-	}
-
-	// location of baseImage depends on how image was imported
-	baseImage := "/var/rvn/img/"
-	// the instance name/location will depend on how it is parsed
-	// if name is empty, then load netboot from /rvn/img
-	if h.Image == "" {
-		baseImage += "netboot"
-		// if name points to a local path or to url
-	} else if len(strings.Split(h.Image, "/")) > 1 {
-		baseImage += "user/"
-		parsedURL, err := url.Parse(h.Image)
-		if err != nil {
-			log.Errorf("error validating URL: %v\n", err)
-		}
-		remoteHost := parsedURL.Host
-		// if remoteHost is empty, its a local image
-		if remoteHost == "" {
-			path := strings.Split(h.Image, "/")
-			baseImage += path[len(path)-1]
-		} else {
-			subPath, imageName, err := ParseURL(parsedURL)
-			if err != nil {
-				log.Errorf("error parsing URL: %v\n", err)
-			}
-			baseImage += subPath + imageName
-		}
-		// this only leaves names, which default to deterlab and /rvn/img location
-	} else {
-		baseImage += h.Image
+		return fmt.Errorf("unable to create exports directory %s - %v", out, err)
 	}
 
-	instanceImage := wd + "/" + h.Name
-	os.RemoveAll(instanceImage)
-
-	out, err := exec.Command(
-		"qemu-img",
-		"create",
-		"-f",
-		"qcow2",
-		"-o", "backing_file="+baseImage,
-		instanceImage).CombinedOutput()
-
+	out, err = exec.Command("exportfs", "-ra").CombinedOutput()
 	if err != nil {
-		log.Printf("error creating image file for %s", h.Name)
-		log.Printf("%v", err)
-		log.Printf("%s", out)
+		return fmt.Errorf("exportfs failed %s - %v", out, err)
 	}
 
-	return instanceImage
-
+	return nil
 }
 
-func arm7Dom(h *Host, t *Topo) *xlibvirt.Domain {
+func (b *LibvirtBackend) Unexport(name string) error {
 
-	instanceImage := createImage(h)
-	if instanceImage == "" {
-		return nil
+	path := fmt.Sprintf("/etc/exports.d/%s.exports", name)
+	_, err := exec.Command("rm", "-f", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error removing exports file %s - %v", path, err)
 	}
 
-	// construct the vm
-	d := &xlibvirt.Domain{
-		Type: "qemu",
-		Name: t.QualifyName(h.Name),
-		OS: &xlibvirt.DomainOS{
-			Type: &xlibvirt.DomainOSType{
-				Type:    "hvm",
-				Arch:    h.Arch,
-				Machine: h.Machine,
-			},
-			Kernel: findKernel(h),
-		},
-		CPU: &xlibvirt.DomainCPU{
-			Mode:  "custom",
-			Match: "exact",
-			Topology: &xlibvirt.DomainCPUTopology{
-				Sockets: h.CPU.Sockets,
-				Cores:   h.CPU.Cores,
-				Threads: h.CPU.Threads,
-			},
-			Model: &xlibvirt.DomainCPUModel{
-				Value: h.CPU.Model,
-			},
-		},
-		VCPU: &xlibvirt.DomainVCPU{
-			Value: h.CPU.Sockets * h.CPU.Cores * h.CPU.Threads,
-		},
-		Memory: &xlibvirt.DomainMemory{
-			Value: uint(h.Memory.Capacity.Value),
-			Unit:  h.Memory.Capacity.Unit,
-		},
-		Devices: &xlibvirt.DomainDeviceList{
-			Emulator: "/usr/bin/qemu-system-arm",
-			Serials: []xlibvirt.DomainSerial{
-				xlibvirt.DomainSerial{
-					Source: &xlibvirt.DomainChardevSource{
-						TCP: &xlibvirt.DomainChardevSourceTCP{
-							Mode:    "bind",
-							Host:    "localhost",
-							Service: fmt.Sprintf("%d", h.TelnetPort),
-						},
-					},
-					Protocol: &xlibvirt.DomainChardevProtocol{
-						Type: "telnet",
-					},
-				},
-			},
-			Disks: []xlibvirt.DomainDisk{
-				xlibvirt.DomainDisk{
-					Device: "disk",
-					Driver: &xlibvirt.DomainDiskDriver{Name: "qemu", Type: "qcow2"},
-					Source: &xlibvirt.DomainDiskSource{
-						File: &xlibvirt.DomainDiskSourceFile{
-							File: instanceImage,
-						},
-					},
-					Target: &xlibvirt.DomainDiskTarget{
-						Dev: h.DefaultDisktype.Dev + "a",
-						Bus: h.DefaultDisktype.Bus,
-					},
-				},
-			},
-		},
-	}
-
-	return d
+	out, err := exec.Command("exportfs", "-ra").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exportfs failed %s - %v", out, err)
+	}
 
+	return nil
 }
 
-func nextPort(min, max int) int {
+// Images ---------------------------------------------------------------------
 
-	ports := portsInUse(min, max)
-	ports = append(ports, min-1)
+func (b *LibvirtBackend) CreateImage(path, backing string, size int64) error {
 
-	port := nextInt(ports)
+	args := []string{
+		"create",
+		"-f",
+		"qcow2",
+		"-o", "backing_file=" + backing,
+		path,
+	}
+	if size > 0 {
+		args = append(args, fmt.Sprintf("%d", size))
+	}
+	out, err := exec.Command("qemu-img", args...).CombinedOutput()
 
-	if port > max {
-		log.Printf(
-			"warning: first available port is beyond specified max %d", port)
+	if err != nil {
+		return fmt.Errorf("qemu-img create failed %s - %v", out, err)
 	}
 
-	return port
+	return nil
 }
 
-func portsInUse(from, to int) []int {
+func (b *LibvirtBackend) CreateDisk(path, format string, size int64) error {
 
-	cmd := exec.Command(
-		"ss", "-lnt", fmt.Sprintf("( sport >= %d and sport < %d )", from, to))
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		fmt.Println(string(out))
-		log.Fatal(err)
-	}
+	out, err := exec.Command(
+		"qemu-img",
+		"create",
+		"-f", format,
+		path,
+		fmt.Sprintf("%d", size)).CombinedOutput()
 
-	var result []int
-	lines := strings.Split(string(out), "\n")
-	lines = lines[1 : len(lines)-1]
-	for _, line := range lines {
-		fields := strings.Fields(line)
-		local := fields[3]
-		parts := strings.Split(local, ":")
-		port, _ := strconv.Atoi(parts[len(parts)-1])
-		result = append(result, port)
+	if err != nil {
+		return fmt.Errorf("qemu-img create failed %s - %v", out, err)
 	}
 
-	return result
-
+	return nil
 }
 
-func nextInt(ports []int) int {
+func (b *LibvirtBackend) ConvertImage(src, dst string, compress bool) error {
 
-	sort.Ints(ports)
-	for i := 0; i < len(ports)-1; i++ {
-		if ports[i+1] > ports[i]+1 {
-			return ports[i] + 1
-		}
+	args := []string{"convert", "-O", "qcow2"}
+	if compress {
+		args = append(args, "-c")
 	}
+	out, err := exec.Command("qemu-img", append(args, src, dst)...).CombinedOutput()
 
-	return ports[len(ports)-1] + 1
+	if err != nil {
+		return fmt.Errorf("qemu-img convert failed %s - %v", out, err)
+	}
 
+	return nil
 }
 
-func nextIntFrom(ports []int, start int) int {
+func (b *LibvirtBackend) CreateISO(
+	path, label string, files map[string][]byte) error {
 
-	if len(ports) == 0 {
-		return start
+	dir, err := ioutil.TempDir("", "rvn-iso")
+	if err != nil {
+		return err
 	}
+	defer os.RemoveAll(dir)
 
-	sort.Ints(ports)
-	for i := 0; i < len(ports)-1; i++ {
-		if ports[i+1] > ports[i]+1 {
-			return ports[i] + 1
+	args := []string{"-output", path, "-volid", label, "-joliet", "-rock"}
+	for name, data := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644)
+		if err != nil {
+			return err
 		}
+		args = append(args, filepath.Join(dir, name))
 	}
 
-	return ports[len(ports)-1] + 1
+	out, err := exec.Command("genisoimage", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("genisoimage failed %s - %v", out, err)
+	}
 
+	return nil
 }
 
-func domConnect(
-	net string, h *Host, dom *xlibvirt.Domain, props map[string]interface{}) {
-
-	var boot *xlibvirt.DomainDeviceBoot = nil
-	if strings.ToLower(h.OS) == "netboot" {
-		if props != nil {
-			boot_order, ok := props["boot"]
-			if ok {
-				boot_order_num, ok := boot_order.(float64)
-				if ok {
-					boot = &xlibvirt.DomainDeviceBoot{
-						Order: uint(boot_order_num),
-					}
-				}
-			}
-		}
-	}
+func (b *LibvirtBackend) ImageInfo(path string) (*ImageInfo, error) {
 
-	hostNicModel := h.DefaultNic
-	hostProps_, ok := props[h.Name]
-	if ok {
-		hostProps, ok := hostProps_.(map[string]interface{})
-		if ok {
-			hostNic_, ok := hostProps["nic"]
-			if ok {
-				hostNic, ok := hostNic_.(string)
-				if ok {
-					hostNicModel = hostNic
-				}
-			}
+	// force-share so images in use by running domains can be inspected
+	out, err := exec.Command(
+		"qemu-img",
+		"info",
+		"--output=json",
+		"--backing-chain",
+		"--force-share",
+		path).Output()
+
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("qemu-img info failed %s - %v", ee.Stderr, err)
 		}
+		return nil, fmt.Errorf("qemu-img info failed - %v", err)
 	}
 
-	dom.Devices.Interfaces = append(dom.Devices.Interfaces,
-		xlibvirt.DomainInterface{
-			Source: &xlibvirt.DomainInterfaceSource{
-				Network: &xlibvirt.DomainInterfaceSourceNetwork{
-					Network: net,
-				},
-			},
-			Model: &xlibvirt.DomainInterfaceModel{Type: hostNicModel},
-			Boot:  boot,
-		})
-}
-
-func resolveLinks(t *Topo) {
-
-	// 'plug in' the link to each node
-	for _, l := range t.Links {
-		for _, e := range l.Endpoints {
-			h := t.getHost(e.Name)
-			if h == nil {
-				log.Fatalf("could not find host '%s' - referenced by link", red(e.Name))
-			}
-			h.ports = append(h.ports, Port{l.Name, e.Port})
-		}
+	// the first element of the chain is the image itself
+	var chain []struct {
+		Filename    string `json:"filename"`
+		Format      string `json:"format"`
+		VirtualSize int64  `json:"virtual-size"`
+		ActualSize  int64  `json:"actual-size"`
+	}
+	err = json.Unmarshal(out, &chain)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse qemu-img info - %v", err)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("qemu-img info returned nothing for %s", path)
 	}
 
-	// sort the links at each node by index
-	for i := 0; i < len(t.Nodes); i++ {
-		n := &t.Nodes[i]
-		sort.Slice(n.ports, func(i, j int) bool {
-			return n.ports[i].Index < n.ports[j].Index
-		})
+	info := &ImageInfo{
+		Path:        path,
+		Format:      chain[0].Format,
+		VirtualSize: chain[0].VirtualSize,
+		ActualSize:  chain[0].ActualSize,
+	}
+	for _, x := range chain[1:] {
+		info.Backing = append(info.Backing, x.Filename)
 	}
 
+	return info, nil
 }
 
-func domainStatus(
-	topo, name, qname string, conn *libvirt.Connect,
-) DomStatus {
+// Helper Functions ===========================================================
 
-	var status DomStatus
-	status.Name = name
-	x, err := conn.LookupDomainByName(qname)
+func connect() {
+	var err error
+	conn, err = libvirt.NewConnect("qemu:///session")
 	if err != nil {
-		status.State = "non-existant"
-	} else {
-		info, _ := x.GetInfo()
-		switch info.State {
-		case libvirt.DOMAIN_NOSTATE:
-			status.State = "nostate"
-		case libvirt.DOMAIN_RUNNING:
-			status.State = "running"
-			addrs, err := x.ListAllInterfaceAddresses(
-				libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE)
-			if err == nil {
-
-				for _, a := range addrs {
-					status.Macs = append(status.Macs, a.Hwaddr)
-				}
-
-				if len(addrs) > 0 {
-					ifx := addrs[0]
-					if len(ifx.Addrs) > 0 {
-						status.IP = ifx.Addrs[0].Addr
-					}
-				}
-
-			}
-			status.ConfigState = configStatus(topo, name)
-		case libvirt.DOMAIN_BLOCKED:
-			status.State = "blocked"
-		case libvirt.DOMAIN_PAUSED:
-			status.State = "paused"
-		case libvirt.DOMAIN_SHUTDOWN:
-			status.State = "shutdown"
-		case libvirt.DOMAIN_CRASHED:
-			status.State = "crashed"
-		case libvirt.DOMAIN_PMSUSPENDED:
-			status.State = "suspended"
-		case libvirt.DOMAIN_SHUTOFF:
-			status.State = "off"
-		}
-		x.Free()
+		log.Printf("libvirt connect failure: %v", err)
 	}
-	return status
 }
 
-func configStatus(topo, name string) string {
-	dbCheckConnection()
-	state_key := fmt.Sprintf("config_state:%s:%s", topo, name)
-	val, err := db.Get(state_key).Result()
-	if err == nil {
-		return val
-	} else {
-		return ""
+func isAlive() bool {
+	result, err := conn.IsAlive()
+	if err != nil {
+		log.Printf("error assesing connection liveness - %v", err)
+		return false
 	}
+	return result
 }
 
-func networkStatus(name string, conn *libvirt.Connect) string {
-	x, err := conn.LookupNetworkByName(name)
-	if err != nil {
-		return "non-existant"
-	} else {
-		active, _ := x.IsActive()
-		if active {
-			return "up"
-		} else {
-			return "down"
-		}
-		x.Free()
+func checkConnect() {
+	for conn == nil {
+		connect()
+	}
+
+	for !isAlive() {
+		connect()
 	}
-	return "?"
 }
 
-func destroyDomain(name string, conn *libvirt.Connect) {
+// destroyDomain stops and undefines a domain. It is not an error for there
+// to be no such domain.
+func destroyDomain(name string) error {
 	x, err := conn.LookupDomainByName(name)
 	if err != nil {
 		//ok nothing to destroy
-	} else {
-		x.Destroy()
-		x.Undefine()
-		x.Free()
+		return nil
 	}
-}
+	defer x.Free()
 
-func shutdownDomain(name string, conn *libvirt.Connect) error {
-	x, err := conn.LookupDomainByName(name)
+	active, err := x.IsActive()
 	if err != nil {
-		return fmt.Errorf("request to shutdown unknown vm %s", name)
-	} else {
-		x.ShutdownFlags(libvirt.DOMAIN_SHUTDOWN_ACPI_POWER_BTN)
-		active, err := x.IsActive()
-		if err == nil && active {
-			log.Printf("shutting down %s", name)
-			return x.Shutdown()
+		return fmt.Errorf("error getting state of %s - %v", name, err)
+	}
+	if active {
+		err = x.Destroy()
+		if err != nil {
+			return fmt.Errorf("error destroying %s - %v", name, err)
 		}
-		return err
 	}
+	err = x.Undefine()
+	if err != nil {
+		return fmt.Errorf("error undefining %s - %v", name, err)
+	}
+	return nil
 }
 
-func cleanupLinkNetwork(name string, conn *libvirt.Connect) {
+// destroyNetwork stops and undefines a network. It is not an error for there
+// to be no such network.
+func destroyNetwork(name string) error {
 	x, err := conn.LookupNetworkByName(name)
 	if err != nil {
-		//ok nothing to clean up
-	} else {
-		cleanupBOOTP(x)
+		//ok nothing to destroy
+		return nil
+	}
+	defer x.Free()
+
+	active, err := x.IsActive()
+	if err != nil {
+		return fmt.Errorf("error getting state of %s - %v", name, err)
 	}
+	if active {
+		err = x.Destroy()
+		if err != nil {
+			return fmt.Errorf("error destroying %s - %v", name, err)
+		}
+	}
+	err = x.Undefine()
+	if err != nil {
+		return fmt.Errorf("error undefining %s - %v", name, err)
+	}
+	return nil
 }
 
-func cleanupTestNetwork(name string, conn *libvirt.Connect) {
+func withNetwork(name string, f func(*libvirt.Network) error) error {
+	checkConnect()
 	x, err := conn.LookupNetworkByName(name)
 	if err != nil {
-		//ok nothing to clean up
-	} else {
-		cleanupRpcBind(x)
+		//ok nothing to do
+		return nil
 	}
+	defer x.Free()
+	return f(x)
 }
 
-func destroyNetwork(name string, conn *libvirt.Connect) {
-	x, err := conn.LookupNetworkByName(name)
+// netem sets the root qdisc of the interface to a netem qdisc implementing the
+// emulation, or restores the default qdisc if the emulation is empty.
+func netem(ifx string, e *Emulation) error {
+
+	if e.Empty() {
+		out, err := exec.Command(
+			"tc", "qdisc", "del", "dev", ifx, "root").CombinedOutput()
+		if err != nil {
+			// nothing to delete, the interface has its default qdisc
+			if strings.Contains(string(out), "handle of zero") ||
+				strings.Contains(string(out), "No such file or directory") {
+				return nil
+			}
+			return fmt.Errorf("error clearing emulation on %s %s - %v",
+				ifx, out, err)
+		}
+		return nil
+	}
+
+	args := append(
+		[]string{"qdisc", "replace", "dev", ifx, "root", "netem"},
+		e.NetemArgs()...,
+	)
+	out, err := exec.Command("tc", args...).CombinedOutput()
 	if err != nil {
-		//ok nothing to destroy
-	} else {
-		x.Destroy()
-		x.Undefine()
-		x.Free()
+		return fmt.Errorf("error applying emulation on %s %s - %v", ifx, out, err)
 	}
+
+	return nil
 }
 
-func setBridgeProperties(net *libvirt.Network) {
-	allowLLDP(net)
-	allowBOOTP(net)
+func setBridgeProperties(net *libvirt.Network) error {
+	var errs ErrorList
+	errs.Add(allowLLDP(net))
+	errs.Add(allowBOOTP(net))
+	return errs.Err()
 }
 
-func allowLLDP(net *libvirt.Network) {
+func allowLLDP(net *libvirt.Network) error {
 	name, _ := net.GetName()
 	br, err := net.GetBridgeName()
 	if err != nil {
-		log.Printf("error getting bridge for %s - %v", name, err)
-		return
+		return fmt.Errorf("error getting bridge for %s - %v", name, err)
 	}
 
 	err = ioutil.WriteFile(
@@ -1104,20 +623,21 @@ func allowLLDP(net *libvirt.Network) {
 	)
 
 	if err != nil {
-		log.Printf("unable to set group forwarding mask on bridge %s - %v",
+		return fmt.Errorf(
+			"unable to set group forwarding mask on bridge %s - %v",
 			name,
 			err,
 		)
-		return
 	}
+
+	return nil
 }
 
-func allowBOOTP(net *libvirt.Network) {
+func allowBOOTP(net *libvirt.Network) error {
 	name, _ := net.GetName()
 	br, err := net.GetBridgeName()
 	if err != nil {
-		log.Printf("error getting bridge for %s - %v", name, err)
-		return
+		return fmt.Errorf("error getting bridge for %s - %v", name, err)
 	}
 
 	out, err := exec.Command("iptables", "-A", "FORWARD",
@@ -1126,18 +646,18 @@ func allowBOOTP(net *libvirt.Network) {
 		"-j", "ACCEPT").CombinedOutput()
 
 	if err != nil {
-		log.Printf("error allowing bootp through iptables %s - %v", out, err)
-		return
+		return fmt.Errorf("error allowing bootp through iptables %s - %v",
+			out, err)
 	}
 
+	return nil
 }
 
-func cleanupBOOTP(net *libvirt.Network) {
+func cleanupBOOTP(net *libvirt.Network) error {
 	name, _ := net.GetName()
 	br, err := net.GetBridgeName()
 	if err != nil {
-		log.Printf("error getting bridge for %s - %v", name, err)
-		return
+		return fmt.Errorf("error getting bridge for %s - %v", name, err)
 	}
 
 	out, err := exec.Command("iptables", "-D", "FORWARD",
@@ -1150,20 +670,20 @@ func cleanupBOOTP(net *libvirt.Network) {
 		// and there is nothing to do. This can happen when a system is built but not
 		// run for example because the iptables rules only get created on launch
 		if strings.Contains(string(out), "Bad rule") {
-			return
+			return nil
 		}
-		log.Printf("error cleaning bootp iptables rules %s - %v", out, err)
-		return
+		return fmt.Errorf("error cleaning bootp iptables rules %s - %v",
+			out, err)
 	}
 
+	return nil
 }
 
-func allowRpcBind(net *libvirt.Network) {
+func allowRpcBind(net *libvirt.Network) error {
 	name, _ := net.GetName()
 	br, err := net.GetBridgeName()
 	if err != nil {
-		log.Printf("error getting bridge for %s - %v", name, err)
-		return
+		return fmt.Errorf("error getting bridge for %s - %v", name, err)
 	}
 
 	out, err := exec.Command("iptables", "-I", "INPUT",
@@ -1173,8 +693,8 @@ func allowRpcBind(net *libvirt.Network) {
 		"-j", "ACCEPT").CombinedOutput()
 
 	if err != nil {
-		log.Printf("error allowing rpcbind tcp through iptables %s - %v", out, err)
-		return
+		return fmt.Errorf(
+			"error allowing rpcbind tcp through iptables %s - %v", out, err)
 	}
 
 	out, err = exec.Command("iptables", "-I", "INPUT",
@@ -1184,8 +704,8 @@ func allowRpcBind(net *libvirt.Network) {
 		"-j", "ACCEPT").CombinedOutput()
 
 	if err != nil {
-		log.Printf("error allowing rpcbind udp through iptables %s - %v", out, err)
-		return
+		return fmt.Errorf(
+			"error allowing rpcbind udp through iptables %s - %v", out, err)
 	}
 
 	out, err = exec.Command("iptables", "-I", "INPUT",
@@ -1195,18 +715,17 @@ func allowRpcBind(net *libvirt.Network) {
 		"-j", "ACCEPT").CombinedOutput()
 
 	if err != nil {
-		log.Printf("error allowing nfs through iptables %s - %v", out, err)
-		return
+		return fmt.Errorf("error allowing nfs through iptables %s - %v", out, err)
 	}
 
+	return nil
 }
 
-func cleanupRpcBind(net *libvirt.Network) {
+func cleanupRpcBind(net *libvirt.Network) error {
 	name, _ := net.GetName()
 	br, err := net.GetBridgeName()
 	if err != nil {
-		log.Printf("error getting bridge for %s - %v", name, err)
-		return
+		return fmt.Errorf("error getting bridge for %s - %v", name, err)
 	}
 
 	out, err := exec.Command("iptables", "-D", "INPUT",
@@ -1220,10 +739,10 @@ func cleanupRpcBind(net *libvirt.Network) {
 		// and there is nothing to do. This can happen when a system is built but not
 		// run for example because the iptables rules only get created on launch
 		if strings.Contains(string(out), "Bad rule") {
-			return
+			return nil
 		}
-		log.Printf("error cleaning up iptables rpcbind tcp rule %s - %v", out, err)
-		return
+		return fmt.Errorf(
+			"error cleaning up iptables rpcbind tcp rule %s - %v", out, err)
 	}
 
 	out, err = exec.Command("iptables", "-D", "INPUT",
@@ -1233,8 +752,8 @@ func cleanupRpcBind(net *libvirt.Network) {
 		"-j", "ACCEPT").CombinedOutput()
 
 	if err != nil {
-		log.Printf("error cleaning up iptables rpcbind udp rule %s - %v", out, err)
-		return
+		return fmt.Errorf(
+			"error cleaning up iptables rpcbind udp rule %s - %v", out, err)
 	}
 
 	out, err = exec.Command("iptables", "-D", "INPUT",
@@ -1244,10 +763,9 @@ func cleanupRpcBind(net *libvirt.Network) {
 		"-j", "ACCEPT").CombinedOutput()
 
 	if err != nil {
-		log.Printf("error cleaning up nfs iptables tcp rule%s - %v", out, err)
-		return
+		return fmt.Errorf("error cleaning up nfs iptables tcp rule %s - %v",
+			out, err)
 	}
 
+	return nil
 }
-
-var red = color.New(color.FgRed).SprintFunc()
@@ -0,0 +1,84 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements runtime manipulation of the links of a topology. Links
+ * can be taken down, brought back up and have their emulation changed while
+ * the system is running. Changes are saved to topo.json so they show up in
+ * the status of the system and survive a redeploy.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	"fmt"
+)
+
+// SetLinkState brings the named link of the current topology up or down.
+func SetLinkState(name string, up bool) error {
+
+	topo, link, err := loadLink(name)
+	if err != nil {
+		return err
+	}
+
+	active, err := backend.NetworkActive(topo.QualifyName(name))
+	if err == nil && active {
+		err = backend.SetLinkState(topo.QualifyName(name), up)
+		if err != nil {
+			return linkError(name, "state", err)
+		}
+	}
+
+	link.Down = !up
+	return linkError(name, "save", SaveTopo(topo))
+
+}
+
+// SetLinkEmulation applies the key=value emulation settings, e.g.
+// [delay=50ms loss=1%], to the named link of the current topology. Settings
+// not mentioned keep their current value. If clear is true the existing
+// emulation of the link is discarded first.
+func SetLinkEmulation(name string, settings []string, clear bool) error {
+
+	topo, link, err := loadLink(name)
+	if err != nil {
+		return err
+	}
+
+	base := link.Emulation
+	if clear {
+		base = nil
+	}
+	e, err := ParseEmulation(settings, base)
+	if err != nil {
+		return linkError(name, "emulation", err)
+	}
+
+	active, err := backend.NetworkActive(topo.QualifyName(name))
+	if err == nil && active {
+		err = backend.EmulateLink(topo.QualifyName(name), e)
+		if err != nil {
+			return linkError(name, "emulation", err)
+		}
+	}
+
+	link.Emulation = e
+	return linkError(name, "save", SaveTopo(topo))
+
+}
+
+func loadLink(name string) (Topo, *Link, error) {
+
+	topo, err := LoadTopo()
+	if err != nil {
+		return topo, nil, fmt.Errorf("failed to load topo - %v", err)
+	}
+
+	link := topo.getLink(name)
+	if link == nil {
+		return topo, nil, linkError(name, "lookup", fmt.Errorf("no such link"))
+	}
+
+	return topo, link, nil
+
+}
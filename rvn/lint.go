@@ -0,0 +1,420 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements topology validation. Lint checks a topology for
+ * mistakes that would otherwise only surface part way through materializing
+ * it, after images, domains and networks have been created. Every problem is
+ * reported at once, each with its location in the model.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Types ======================================================================
+
+// LintError is a problem found in a topology. The location is the path of the
+// offending value within the model, e.g. 'nodes[2](walrus).mounts[0].source'.
+type LintError struct {
+	Location string
+	Msg      string
+}
+
+// Variables ==================================================================
+
+var (
+	// host names are the hostnames of the guests within the topology's DNS
+	// domain '<topo>.net', so they must be valid DNS labels
+	hostnameRx = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+
+	// platforms fillInMissing knows how to provide defaults for
+	platforms = []string{"x86_64", "arm7", "android"}
+
+	// memory units understood by libvirt
+	memoryUnits = []string{
+		"b", "bytes",
+		"k", "kb", "kib",
+		"m", "mb", "mib",
+		"g", "gb", "gib",
+		"t", "tb", "tib",
+	}
+)
+
+const (
+	// maximum length of a DNS label
+	maxLabel = 63
+	// maximum length of a fully qualified domain name
+	maxFQDN = 253
+	// maximum length of a libvirt network name, libvirt keeps the state of a
+	// network in files named after it, e.g. <name>.hostsfile, which have to
+	// fit in a file name
+	maxNetName = 255 - len(".hostsfile")
+)
+
+// Functions ==================================================================
+
+// Lint checks the topology for mistakes. Relative mount sources are resolved
+// against dir, the directory holding the model. The result is an ErrorList of
+// LintErrors, or nil if the topology is fine.
+func Lint(topo Topo, dir string) error {
+
+	var errs ErrorList
+	lint := func(location, format string, args ...interface{}) {
+		errs.Add(&LintError{location, fmt.Sprintf(format, args...)})
+	}
+
+	if topo.Name == "" {
+		lint("name", "topology has no name")
+	} else if !hostnameRx.MatchString(topo.Name) || len(topo.Name) > maxLabel {
+		lint("name", "'%s' is not a valid DNS label, topology names are used "+
+			"as the DNS domain of the topology", topo.Name)
+	}
+
+	lintSize := func(location string, u UnitValue) {
+		_, err := u.Bytes()
+		if err != nil {
+			lint(location+".unit", "%v", err)
+		}
+		if u.Value <= 0 {
+			lint(location+".value", "size must be positive")
+		}
+	}
+
+	// hosts ---------------------------------------------------------------------
+
+	hosts := make(map[string]string)
+	lintHost := func(location string, h *Host) {
+
+		switch {
+		case h.Name == "":
+			lint(location+".name", "host has no name")
+		case hosts[h.Name] != "":
+			lint(location+".name", "duplicate host name, also used by %s",
+				hosts[h.Name])
+		default:
+			hosts[h.Name] = location
+		}
+
+		if h.Name != "" && !hostnameRx.MatchString(h.Name) {
+			lint(location+".name", "'%s' is not a valid hostname, only letters, "+
+				"digits and '-' are allowed", h.Name)
+		}
+		if len(h.Name) > maxLabel {
+			lint(location+".name", "name is %d characters, the limit is %d",
+				len(h.Name), maxLabel)
+		}
+		fqdn := fmt.Sprintf("%s.%s.net", h.Name, topo.Name)
+		if len(fqdn) > maxFQDN {
+			lint(location+".name", "qualified name '%s' is longer than %d characters",
+				fqdn, maxFQDN)
+		}
+
+		if !contains(platforms, h.Platform) {
+			lint(location+".platform", "unknown platform '%s', expected one of %s",
+				h.Platform, strings.Join(platforms, ", "))
+		}
+
+		if h.Memory != nil {
+			c := h.Memory.Capacity
+			if !contains(memoryUnits, strings.ToLower(c.Unit)) {
+				lint(location+".memory.capacity.unit", "unknown memory unit '%s'",
+					c.Unit)
+			}
+			if c.Value < 0 {
+				lint(location+".memory.capacity.value", "negative memory capacity")
+			}
+		}
+
+		if h.DiskSize != nil {
+			lintSize(location+".disksize", *h.DiskSize)
+		}
+		for i, d := range h.Disks {
+			dloc := fmt.Sprintf("%s.disks[%d]", location, i)
+			lintSize(dloc+".size", d.Size)
+			if d.Bus != "" && busDevs[d.Bus] == "" {
+				lint(dloc+".bus", "unknown disk bus '%s'", d.Bus)
+			}
+			if d.Format != "" && !contains(diskFormats, d.Format) {
+				lint(dloc+".format", "unknown disk format '%s', expected one of %s",
+					d.Format, strings.Join(diskFormats, ", "))
+			}
+			if d.Shared && d.Format != "raw" {
+				lint(dloc+".format", "shared disks must be raw")
+			}
+		}
+
+		for i, m := range h.Mounts {
+			mloc := fmt.Sprintf("%s.mounts[%d]", location, i)
+			if m.Point == "" {
+				lint(mloc+".point", "mount has no mount point")
+			}
+			if m.Type != "" && !contains(mountTypes, m.Type) {
+				lint(mloc+".type", "unknown mount type '%s', expected one of %s",
+					m.Type, strings.Join(mountTypes, ", "))
+			}
+			if m.IsNFS() && h.NoTestNet {
+				lint(mloc+".type", "nfs mounts need the test network, use 9p or "+
+					"virtiofs on hosts without it")
+			}
+			if m.Source == "" {
+				lint(mloc+".source", "mount has no source")
+				continue
+			}
+			if m.IsNFS() && !filepath.IsAbs(m.Source) {
+				lint(mloc+".source", "nfs source '%s' is not an absolute path, nfs "+
+					"sources are exported as given", m.Source)
+				continue
+			}
+			source := m.Source
+			if !filepath.IsAbs(source) {
+				source = filepath.Join(dir, source)
+			}
+			_, err := os.Stat(source)
+			if err != nil {
+				lint(mloc+".source", "source '%s' does not exist", m.Source)
+			}
+		}
+
+		for i, tag := range h.Tags {
+			tloc := fmt.Sprintf("%s.tags[%d]", location, i)
+			switch {
+			case !groupRx.MatchString(tag):
+				lint(tloc, "'%s' is not a valid group name, only letters, digits "+
+					"and '_' are allowed", tag)
+			case contains(builtinGroups, tag):
+				lint(tloc, "'%s' is a built in group", tag)
+			}
+		}
+
+		for i, s := range h.Provision {
+			ploc := fmt.Sprintf("%s.provision[%d]", location, i)
+			if s.kinds() != 1 {
+				lint(ploc, "a step needs exactly one of upload, template, command "+
+					"or reboot")
+				continue
+			}
+			f, floc := s.Upload, ploc+".upload"
+			if s.Template != nil {
+				f, floc = s.Template, ploc+".template"
+			}
+			if f == nil {
+				continue
+			}
+			if !path.IsAbs(f.Dest) {
+				lint(floc+".dest", "destination '%s' is not an absolute path", f.Dest)
+			}
+			if f.Mode != "" && !validMode(f.Mode) {
+				lint(floc+".mode", "'%s' is not an octal file mode", f.Mode)
+			}
+			source := f.Source
+			if !filepath.IsAbs(source) {
+				source = filepath.Join(dir, source)
+			}
+			_, err := os.Stat(source)
+			if f.Source == "" || err != nil {
+				lint(floc+".source", "source '%s' does not exist", f.Source)
+			}
+		}
+
+	}
+
+	for i := range topo.Nodes {
+		h := &topo.Nodes[i].Host
+		lintHost(fmt.Sprintf("nodes[%d]%s", i, label(h.Name)), h)
+	}
+	for i := range topo.Switches {
+		h := &topo.Switches[i].Host
+		lintHost(fmt.Sprintf("switches[%d]%s", i, label(h.Name)), h)
+	}
+
+	// configuration order -------------------------------------------------------
+
+	var names []string
+	lintOrder := func(location string, h *Host) {
+		names = append(names, h.Name)
+		if h.Stage < 0 {
+			lint(location+".stage", "negative stage %d", h.Stage)
+		}
+		for i, a := range h.After {
+			aloc := fmt.Sprintf("%s.after[%d]", location, i)
+			switch {
+			case a == h.Name:
+				lint(aloc, "host is configured after itself")
+			case hosts[a] == "":
+				lint(aloc, "unknown host '%s'", a)
+			}
+		}
+	}
+	for i := range topo.Nodes {
+		h := &topo.Nodes[i].Host
+		lintOrder(fmt.Sprintf("nodes[%d]%s", i, label(h.Name)), h)
+	}
+	for i := range topo.Switches {
+		h := &topo.Switches[i].Host
+		lintOrder(fmt.Sprintf("switches[%d]%s", i, label(h.Name)), h)
+	}
+	deps := configDeps(topo, names)
+	for name := range deps {
+		// a host configured after itself is already reported
+		deps[name] = removeString(deps[name], name)
+	}
+	if c := findCycle(names, deps); c != nil {
+		// stages alone can not form a cycle, so some host on it has an after
+		at := c[0]
+		for _, x := range c {
+			if h := topo.getHost(x); h != nil && len(h.After) > 0 {
+				at = x
+				break
+			}
+		}
+		lint(hosts[at]+".after", "configuration order has a cycle: %s",
+			strings.Join(c, " -> "))
+	}
+
+	// links ---------------------------------------------------------------------
+
+	links := make(map[string]string)
+	// host -> port -> location of the endpoint using the port
+	ports := make(map[string]map[int]string)
+
+	for i, l := range topo.Links {
+
+		location := fmt.Sprintf("links[%d]%s", i, label(l.Name))
+
+		switch {
+		case l.Name == "":
+			lint(location+".name", "link has no name")
+		case links[l.Name] != "":
+			lint(location+".name", "duplicate link name, also used by %s",
+				links[l.Name])
+		default:
+			links[l.Name] = location
+		}
+		if strings.ContainsAny(l.Name, "/ \t\n") {
+			lint(location+".name", "link names may not contain '/' or whitespace")
+		}
+		if net := topo.QualifyName(l.Name); len(net) > maxNetName {
+			lint(location+".name", "network name '%s' is longer than %d characters",
+				net, maxNetName)
+		}
+
+		if len(l.Endpoints) < 2 {
+			lint(location+".endpoints",
+				"a link needs at least 2 endpoints, got %d", len(l.Endpoints))
+		}
+
+		for j, e := range l.Endpoints {
+			eloc := fmt.Sprintf("%s.endpoints[%d]", location, j)
+			if hosts[e.Name] == "" {
+				lint(eloc+".name", "unknown host '%s'", e.Name)
+				continue
+			}
+			if e.Port < 0 {
+				lint(eloc+".port", "negative port %d", e.Port)
+				continue
+			}
+			if ports[e.Name] == nil {
+				ports[e.Name] = make(map[int]string)
+			}
+			if other, ok := ports[e.Name][e.Port]; ok {
+				lint(eloc+".port", "port %d of %s is already used by %s",
+					e.Port, e.Name, other)
+				continue
+			}
+			ports[e.Name][e.Port] = eloc
+		}
+
+		err := l.Emulation.Validate()
+		if err != nil {
+			lint(location+".emulation", "%v", err)
+		}
+
+	}
+
+	// shared disks --------------------------------------------------------------
+
+	disks := make(map[string]string)
+	for i, d := range topo.Disks {
+
+		location := fmt.Sprintf("disks[%d]%s", i, label(d.Name))
+
+		switch {
+		case d.Name == "":
+			lint(location+".name", "disk has no name")
+		case disks[d.Name] != "":
+			lint(location+".name", "duplicate disk name, also used by %s",
+				disks[d.Name])
+		default:
+			disks[d.Name] = location
+		}
+		if d.Name != "" && !hostnameRx.MatchString(d.Name) {
+			lint(location+".name", "'%s' is not a valid disk name, only letters, "+
+				"digits and '-' are allowed", d.Name)
+		}
+
+		lintSize(location+".size", d.Size)
+		if d.Bus != "" && busDevs[d.Bus] == "" {
+			lint(location+".bus", "unknown disk bus '%s'", d.Bus)
+		}
+
+		if len(d.Hosts) == 0 {
+			lint(location+".hosts", "disk is not attached to any host")
+		}
+		for j, h := range d.Hosts {
+			if hosts[h] == "" {
+				lint(fmt.Sprintf("%s.hosts[%d]", location, j), "unknown host '%s'", h)
+			}
+			if contains(d.Hosts[:j], h) {
+				lint(fmt.Sprintf("%s.hosts[%d]", location, j),
+					"disk is attached to %s more than once", h)
+			}
+		}
+
+	}
+
+	return errs.Err()
+
+}
+
+// Methods ====================================================================
+
+func (e *LintError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Location, e.Msg)
+}
+
+// Helper Functions ===========================================================
+
+// label formats a name for use in a location, e.g. nodes[2](walrus)
+func label(name string) string {
+	if name == "" {
+		return ""
+	}
+	return "(" + name + ")"
+}
+
+// removeString returns xs without any x.
+func removeString(xs []string, x string) []string {
+	var result []string
+	for _, y := range xs {
+		if y != x {
+			result = append(result, y)
+		}
+	}
+	return result
+}
+
+func contains(xs []string, x string) bool {
+	for _, y := range xs {
+		if x == y {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+package rvn
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// lintTopo runs the topology through ReadTopo, so defaults are applied just
+// like they are for a model, and lints it against dir.
+func lintTopo(t *testing.T, topo Topo, dir string) ErrorList {
+
+	buf, err := json.Marshal(topo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo, err = ReadTopo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Lint(topo, dir)
+	if err == nil {
+		return nil
+	}
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("expected an ErrorList, got %T", err)
+	}
+	return errs
+
+}
+
+func TestLintOk(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "rvn-lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "src"), 0755)
+
+	topo := testTopo
+	topo.Nodes = []Node{
+		{Host{Name: "a", Mounts: []Mount{
+			{Point: "/src", Source: "src", Type: "9p"}}}},
+		{Host{Name: "b", Mounts: []Mount{
+			{Point: "/src", Source: filepath.Join(dir, "src")}}}},
+		{Host{Name: "c", DiskSize: &UnitValue{20, "GiB"}, Disks: []Disk{
+			{Size: UnitValue{10, "G"}},
+			{Size: UnitValue{1, "TB"}, Bus: "scsi", Format: "raw", Shared: true},
+		}}},
+	}
+	topo.Disks = []SharedDisk{
+		{Name: "quorum", Size: UnitValue{1, "GiB"}, Hosts: []string{"a", "b"}},
+	}
+	topo.Links = append(topo.Links, Link{
+		Name:      "lan0",
+		Endpoints: []Endpoint{{"a", 1}, {"b", 1}, {"sw", 3}},
+		Emulation: &Emulation{Delay: "10ms"},
+	})
+
+	errs := lintTopo(t, topo, dir)
+	if errs != nil {
+		t.Fatalf("expected no lint errors, got\n%v", errs)
+	}
+
+}
+
+func TestLintErrors(t *testing.T) {
+
+	topo := Topo{
+		Name: "lint",
+		Nodes: []Node{
+			{Host{Name: "a", Platform: "sparc"}},
+			{Host{Name: "a", Mounts: []Mount{{Point: "/x", Source: "/rvn/nope"}}}},
+			{Host{Name: "c", Memory: &Memory{UnitValue{4, "GiBs"}}, NoTestNet: true,
+				Mounts: []Mount{
+					{Point: "/x", Source: ".", Type: "smb"},
+					{Point: "/y", Source: "."},
+					{Point: "/z", Source: ".", Type: "9p"},
+				}}},
+			{Host{Name: "bad_name", Tags: []string{"ceph", "osd-0", "nodes"},
+				Provision: []ProvisionStep{
+					{Command: "true", Reboot: true},
+					{Upload: &FileCopy{Source: "nope", Dest: "etc/x", Mode: "0999"}},
+					{Template: &FileCopy{Source: ".", Dest: "/etc/x", Mode: "0600"}},
+				}}},
+			{Host{Name: strings.Repeat("x", 64)}},
+		},
+		Switches: []Zwitch{
+			{Host{Name: "sw"}},
+			{Host{Name: "sw2", DiskSize: &UnitValue{0, "GB"}, Disks: []Disk{
+				{Size: UnitValue{1, "XB"}, Bus: "floppy", Format: "vmdk"},
+				{Size: UnitValue{1, "GB"}, Shared: true},
+			}}},
+		},
+		Disks: []SharedDisk{
+			{Name: "quorum", Size: UnitValue{1, "GB"}, Hosts: []string{"a", "x", "a"}},
+			{Name: "quorum", Size: UnitValue{1, "GB"}, Bus: "floppy"},
+		},
+		Links: []Link{
+			{Name: "a_0-sw_1", Endpoints: []Endpoint{{"a", 0}, {"sw", 1}}},
+			{Name: "a_0-sw_2", Endpoints: []Endpoint{{"a", 0}, {"sw", 2}}},
+			{Name: "c_0-d_0", Endpoints: []Endpoint{{"c", 0}, {"d", 0}}},
+			{Name: "lan0", Endpoints: []Endpoint{{"c", 1}}},
+			{Name: strings.Repeat("l", 245), Endpoints: []Endpoint{
+				{"c", 3}, {"sw", 4}}},
+			{Name: "a_0-sw_1", Endpoints: []Endpoint{{"c", 2}, {"sw", 3}},
+				Emulation: &Emulation{Delay: "fast"}},
+		},
+	}
+
+	errs := lintTopo(t, topo, ".")
+
+	expected := []string{
+		"nodes[0](a).platform: unknown platform 'sparc'",
+		"nodes[1](a).name: duplicate host name, also used by nodes[0](a)",
+		"nodes[1](a).mounts[0].source: source '/rvn/nope' does not exist",
+		"nodes[2](c).memory.capacity.unit: unknown memory unit 'GiBs'",
+		"nodes[2](c).mounts[0].type: unknown mount type 'smb'",
+		"nodes[2](c).mounts[1].type: nfs mounts need the test network",
+		"nodes[2](c).mounts[1].source: nfs source '.' is not an absolute path",
+		"nodes[3](bad_name).name: 'bad_name' is not a valid hostname",
+		"nodes[3](bad_name).tags[1]: 'osd-0' is not a valid group name",
+		"nodes[3](bad_name).tags[2]: 'nodes' is a built in group",
+		"nodes[3](bad_name).provision[0]: a step needs exactly one of",
+		"nodes[3](bad_name).provision[1].upload.dest: destination 'etc/x' is " +
+			"not an absolute path",
+		"nodes[3](bad_name).provision[1].upload.mode: '0999' is not an octal",
+		"nodes[3](bad_name).provision[1].upload.source: source 'nope' does not",
+		"name: name is 64 characters, the limit is 63",
+		"switches[1](sw2).disksize.value: size must be positive",
+		"switches[1](sw2).disks[0].size.unit: unknown unit 'XB'",
+		"switches[1](sw2).disks[0].bus: unknown disk bus 'floppy'",
+		"switches[1](sw2).disks[0].format: unknown disk format 'vmdk'",
+		"switches[1](sw2).disks[1].format: shared disks must be raw",
+		"disks[0](quorum).hosts[1]: unknown host 'x'",
+		"disks[0](quorum).hosts[2]: disk is attached to a more than once",
+		"disks[1](quorum).name: duplicate disk name, also used by disks[0](quorum)",
+		"disks[1](quorum).bus: unknown disk bus 'floppy'",
+		"disks[1](quorum).hosts: disk is not attached to any host",
+		"links[1](a_0-sw_2).endpoints[0].port: port 0 of a is already used by " +
+			"links[0](a_0-sw_1).endpoints[0]",
+		"links[2](c_0-d_0).endpoints[1].name: unknown host 'd'",
+		"links[3](lan0).endpoints: a link needs at least 2 endpoints, got 1",
+		"links[4](" + strings.Repeat("l", 245) + ").name: network name " +
+			"'lint_" + strings.Repeat("l", 245) + "' is longer than 245 characters",
+		"links[5](a_0-sw_1).name: duplicate link name, also used by " +
+			"links[0](a_0-sw_1)",
+		"links[5](a_0-sw_1).emulation: bad delay 'fast'",
+	}
+
+	if len(errs) != len(expected) {
+		t.Errorf("expected %d lint errors, got %d\n%v",
+			len(expected), len(errs), errs)
+	}
+
+	for _, x := range expected {
+		found := false
+		for _, e := range errs {
+			if _, ok := e.(*LintError); !ok {
+				t.Errorf("expected a LintError, got %T", e)
+			}
+			if strings.Contains(e.Error(), x) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("expected lint error %q", x)
+		}
+	}
+
+}
+
+func TestLintConfigOrder(t *testing.T) {
+
+	topo := Topo{
+		Name: "order",
+		Nodes: []Node{
+			{Host{Name: "ctl", Stage: 1, After: []string{"agent"}}},
+			{Host{Name: "agent", Stage: 2}},
+			{Host{Name: "x", Stage: -1, After: []string{"x", "nope"}}},
+		},
+	}
+
+	errs := lintTopo(t, topo, ".")
+
+	expected := []string{
+		"nodes[2](x).stage: negative stage -1",
+		"nodes[2](x).after[0]: host is configured after itself",
+		"nodes[2](x).after[1]: unknown host 'nope'",
+		"nodes[0](ctl).after: configuration order has a cycle: " +
+			"ctl -> agent -> ctl",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d lint errors, got %d\n%v",
+			len(expected), len(errs), errs)
+	}
+	for i, x := range expected {
+		if !strings.Contains(errs[i].Error(), x) {
+			t.Errorf("expected lint error %q, got %q", x, errs[i])
+		}
+	}
+
+}
+
+func TestLoadModelLint(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "rvn-lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	model := `
+topo = {
+  'name': 'lint',
+  'nodes': [Node('a'), Node('b')],
+  'links': [Link('a', 0, 'c', 0)]
+}
+`
+	err = ioutil.WriteFile(filepath.Join(dir, "model.js"), []byte(model), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadModel(dir)
+	if err == nil || !strings.Contains(err.Error(), "unknown host 'c'") {
+		t.Errorf("expected lint error, got %v", err)
+	}
+
+}
@@ -0,0 +1,156 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements the configuration logs of hosts. The output of every
+ * configure run of a host, across all of its attempts, is written to its own
+ * log in the working directory,
+ *
+ *   .rvn/logs/<host>/<timestamp>.log
+ *
+ * and .rvn/logs/<host>/latest links to the log of the most recent run.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Variables ==================================================================
+
+var (
+	// how often a followed log is checked for more output
+	followPoll = 500 * time.Millisecond
+)
+
+const (
+	logTimeFormat = "20060102T150405.000"
+)
+
+// Functions ==================================================================
+
+// ConfigLog returns the path of the latest configuration log of a host.
+func ConfigLog(host string) (string, error) {
+
+	wd, err := WkDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(wd, "logs", host, "latest"), nil
+
+}
+
+// TailLog writes the latest configuration log of a host to w. When follow is
+// set, it keeps writing output as it is added to the log, moving on to the
+// log of the next run when one starts, until stop is closed.
+func TailLog(host string, w io.Writer, follow bool, stop <-chan struct{}) error {
+
+	latest, err := ConfigLog(host)
+	if err != nil {
+		return err
+	}
+
+	path, err := filepath.EvalSymlinks(latest)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s has not been configured yet", host)
+		}
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+
+	for {
+
+		_, err = io.Copy(w, f)
+		if err != nil || !follow {
+			return err
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(followPoll):
+		}
+
+		// a new run started, finish off the old log and move to the new one
+		next, err := filepath.EvalSymlinks(latest)
+		if err == nil && next != path {
+			_, err = io.Copy(w, f)
+			if err != nil {
+				return err
+			}
+			f.Close()
+			f, err = os.Open(next)
+			if err != nil {
+				return err
+			}
+			path = next
+			fmt.Fprintf(w, "==> %s <==\n", filepath.Base(path))
+		}
+
+	}
+
+}
+
+// Helper Functions ===========================================================
+
+// createConfigLog creates the log of a new configure run of a host and points
+// the latest link of the host at it.
+func createConfigLog(host string) (*os.File, error) {
+
+	latest, err := ConfigLog(host)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(latest)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	name := time.Now().Format(logTimeFormat) + ".log"
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	// swap the link in atomically so followers never see it missing
+	tmp := latest + ".tmp"
+	os.Remove(tmp)
+	err = os.Symlink(name, tmp)
+	if err == nil {
+		err = os.Rename(tmp, latest)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to link latest log - %v", err)
+	}
+
+	return f, nil
+
+}
+
+// failedLog returns the path of the latest configuration log of a host, if
+// it has one, relative to the working directory.
+func failedLog(host string) string {
+
+	latest, err := ConfigLog(host)
+	if err != nil {
+		return ""
+	}
+	_, err = os.Stat(latest)
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(".rvn", "logs", host, "latest")
+
+}
@@ -0,0 +1,175 @@
+package rvn
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer that can be written and read concurrently.
+type syncBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.String()
+}
+
+func TestConfigLog(t *testing.T) {
+
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		saved := runConfig
+		defer func() { runConfig = saved }()
+
+		runConfig = func(ctx context.Context, run *configRun, ds DomStatus,
+			withUserConfig bool) error {
+
+			h := run.host
+
+			fmt.Fprintf(run.out, "TASK [walrus]\n")
+			if h.Name == "b" {
+				return fmt.Errorf("bad playbook")
+			}
+			return nil
+
+		}
+
+		cs := ConfigureSettings{
+			Parallel: 1,
+			Timeout:  Duration{time.Second},
+			Retries:  intPtr(0),
+		}
+
+		if failedLog("a") != "" {
+			t.Errorf("unconfigured host has a log")
+		}
+		err := TailLog("a", ioutil.Discard, false, nil)
+		if err == nil || !strings.Contains(err.Error(), "not been configured") {
+			t.Errorf("expected missing log error, got %v", err)
+		}
+
+		for _, h := range []string{"a", "b"} {
+			configureWithRetries(testTopo, Host{Name: h}, DomStatus{}, true, cs)
+		}
+
+		var out bytes.Buffer
+		err = TailLog("a", &out, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), "attempt 1") ||
+			!strings.Contains(out.String(), "TASK [walrus]\n==> success\n") {
+			t.Errorf("unexpected log of a:\n%s", out.String())
+		}
+
+		out.Reset()
+		err = TailLog("b", &out, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), "==> failed - bad playbook\n") {
+			t.Errorf("unexpected log of b:\n%s", out.String())
+		}
+		if failedLog("b") != ".rvn/logs/b/latest" {
+			t.Errorf("expected a log for b, got '%s'", failedLog("b"))
+		}
+
+		// every run gets its own log, latest points at the newest one
+		time.Sleep(5 * time.Millisecond)
+		configureWithRetries(testTopo, Host{Name: "a"}, DomStatus{}, true, cs)
+		logs, err := filepath.Glob(".rvn/logs/a/*.log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(logs) != 2 {
+			t.Fatalf("expected 2 logs for a, got %v", logs)
+		}
+		latest, err := os.Readlink(".rvn/logs/a/latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if latest != filepath.Base(logs[1]) {
+			t.Errorf("expected latest to be %s, got %s", logs[1], latest)
+		}
+
+	})
+
+}
+
+func TestTailLogFollow(t *testing.T) {
+
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		savedPoll := followPoll
+		defer func() { followPoll = savedPoll }()
+		followPoll = time.Millisecond
+
+		f, err := createConfigLog("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(f, "first\n")
+
+		var out syncBuffer
+		stop := make(chan struct{})
+		done := make(chan error)
+		go func() { done <- TailLog("a", &out, true, stop) }()
+
+		waitFor := func(s string) {
+			deadline := time.Now().Add(time.Second)
+			for !strings.Contains(out.String(), s) {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected '%s' in followed log:\n%s", s, out.String())
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		waitFor("first\n")
+		fmt.Fprintf(f, "second\n")
+		waitFor("second\n")
+
+		// a new run is picked up once the old log is drained
+		fmt.Fprintf(f, "third\n")
+		f.Close()
+		time.Sleep(5 * time.Millisecond)
+		g, err := createConfigLog("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(g, "fourth\n")
+		g.Close()
+		waitFor("fourth\n")
+
+		close(stop)
+		err = <-done
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		o := out.String()
+		if strings.Index(o, "third") > strings.Index(o, "==> ") ||
+			strings.Index(o, "==> ") > strings.Index(o, "fourth") {
+			t.Errorf("logs out of order:\n%s", o)
+		}
+
+	})
+
+}
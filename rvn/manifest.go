@@ -0,0 +1,270 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements image manifests. A manifest describes what is inside
+ * an image: the platform it runs on, its os family, the nic and disk bus it
+ * expects and how to log in to it. The defaults of a host are taken from the
+ * manifest of its image, so a model only needs to name the image.
+ *
+ * The manifest of an image lives next to it in the image store as
+ * <image>.manifest, and is pulled along with the image when its source has
+ * one. The common images of the rvn mirror have built in manifests.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Types ======================================================================
+
+// ImageManifest describes the contents of an image. Empty values are not
+// known and fall back to the rvn defaults.
+type ImageManifest struct {
+	Arch     string `json:"arch,omitempty"`
+	Platform string `json:"platform,omitempty"`
+	// OS is the os family, e.g. linux or freebsd
+	OS       string    `json:"os,omitempty"`
+	Nic      string    `json:"nic,omitempty"`
+	Disktype *Disktype `json:"disktype,omitempty"`
+
+	// User is the user ansible logs in as
+	User string `json:"user,omitempty"`
+	// Become is the ansible become method, e.g. sudo or su
+	Become     string `json:"become,omitempty"`
+	BecomePass string `json:"become-pass,omitempty"`
+	// Python is the path of the python interpreter ansible uses
+	Python string `json:"python,omitempty"`
+
+	// SHA256 is the checksum of the image, downloads of the image are
+	// verified against it
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Variables ==================================================================
+
+var (
+	// manifests of the images on the rvn mirror, these are used when an image
+	// does not carry a manifest of its own
+	builtinManifests = map[string]*ImageManifest{
+		"debian-stretch": {Arch: "x86_64", Platform: "x86_64", OS: "linux"},
+		"fedora-27":      {Arch: "x86_64", Platform: "x86_64", OS: "linux"},
+		"ubuntu-1604":    {Arch: "x86_64", Platform: "x86_64", OS: "linux"},
+		"freebsd-11":     {Arch: "x86_64", Platform: "x86_64", OS: "freebsd"},
+		"cumulusvx-3.5": {
+			Arch:     "x86_64",
+			Platform: "x86_64",
+			OS:       "linux",
+			Disktype: &Disktype{Bus: "virtio", Dev: "vd"},
+		},
+		"android-oreo": {Arch: "x86_64", Platform: "android", OS: "linux"},
+	}
+
+	// login defaults of all rvn images
+	defaultLogin = ImageManifest{
+		User:       "rvn",
+		Become:     "sudo",
+		BecomePass: "rvn",
+	}
+
+	// login defaults by os family
+	osLogin = map[string]ImageManifest{
+		"freebsd": {Python: "/usr/local/bin/python2"},
+	}
+)
+
+// Functions ==================================================================
+
+// LoadImageManifest returns the manifest of the image ref. If the image has
+// no manifest of its own the built in manifest for the image is returned, or
+// nil if there is none.
+func LoadImageManifest(ref string) (*ImageManifest, error) {
+
+	path, err := ImagePath(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := readImageManifest(path + ".manifest")
+	if m != nil || err != nil {
+		return m, err
+	}
+
+	if m, ok := builtinManifests[ref]; ok {
+		c := *m
+		return &c, nil
+	}
+
+	return nil, nil
+
+}
+
+// SaveImageManifest writes the manifest of the image at path.
+func SaveImageManifest(path string, m *ImageManifest) error {
+
+	data, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path+".manifest", data, 0644)
+
+}
+
+// AnsibleArgs returns the ansible-playbook arguments that run the playbook
+// yml against a host at ip, logging in as the image manifest of the host
+// says.
+func AnsibleArgs(yml string, h Host, ip string) ([]string, error) {
+
+	login, err := hostLogin(h)
+	if err != nil {
+		return nil, err
+	}
+
+	extra_vars := []string{
+		"ansible_become_method=" + login.Become,
+		"ansible_become_pass=" + login.BecomePass,
+	}
+	if login.Python != "" {
+		extra_vars = append(extra_vars,
+			fmt.Sprintf("ansible_python_interpreter='%s'", login.Python))
+	}
+
+	return []string{
+		"-i", ip + ",",
+		yml,
+		"--extra-vars", strings.Join(extra_vars, " "),
+		`--ssh-extra-args='-i/var/rvn/ssh/rvn'`,
+		"--user=" + login.User, "--private-key=/var/rvn/ssh/rvn",
+	}, nil
+
+}
+
+// LoginUser returns the user rvn logs in to the host name of the topology as.
+func LoginUser(topo Topo, name string) (string, error) {
+
+	h := topo.getHost(name)
+	if h == nil {
+		return "", fmt.Errorf("host %s not found", name)
+	}
+	login, err := hostLogin(*h)
+	if err != nil {
+		return "", err
+	}
+	return login.User, nil
+
+}
+
+// Helper Functions ===========================================================
+
+// readImageManifest reads the manifest file at path, which is nil if there is
+// no such file.
+func readImageManifest(path string) (*ImageManifest, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &ImageManifest{}
+	err = yaml.UnmarshalStrict(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+
+}
+
+// applyImageManifest fills in the values of a host that the user did not
+// supply from the manifest of its image.
+func applyImageManifest(h *Host) error {
+
+	m, err := LoadImageManifest(h.Image)
+	if err != nil || m == nil {
+		return err
+	}
+
+	if h.Platform == "" {
+		h.Platform = m.Platform
+	}
+	if h.OS == "" {
+		h.OS = m.OS
+	}
+	if h.DefaultNic == "" {
+		h.DefaultNic = m.Nic
+	}
+	if h.DefaultDisktype == nil && m.Disktype != nil {
+		d := *m.Disktype
+		h.DefaultDisktype = &d
+	}
+
+	return nil
+
+}
+
+// hostManifest returns the manifest of an image made from the disk of a host.
+// It is the manifest of the image the host came from, updated with what is
+// known about the host.
+func hostManifest(h Host) (*ImageManifest, error) {
+
+	m, err := LoadImageManifest(h.Image)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		m = &ImageManifest{}
+	}
+
+	m.Arch, m.Platform, m.OS, m.Nic = h.Arch, h.Platform, h.OS, h.DefaultNic
+	if h.DefaultDisktype != nil {
+		d := *h.DefaultDisktype
+		m.Disktype = &d
+	}
+
+	return m, nil
+
+}
+
+// hostLogin returns how to log in to a host, from the manifest of its image
+// falling back to the defaults for its os family and then to the defaults of
+// all rvn images.
+func hostLogin(h Host) (ImageManifest, error) {
+
+	login := ImageManifest{}
+	m, err := LoadImageManifest(h.Image)
+	if err != nil {
+		return login, err
+	}
+	if m != nil {
+		login = *m
+	}
+
+	for _, d := range []ImageManifest{
+		osLogin[strings.ToLower(h.OS)],
+		defaultLogin,
+	} {
+		if login.User == "" {
+			login.User = d.User
+		}
+		if login.Become == "" {
+			login.Become = d.Become
+		}
+		if login.BecomePass == "" {
+			login.BecomePass = d.BecomePass
+		}
+		if login.Python == "" {
+			login.Python = d.Python
+		}
+	}
+
+	return login, nil
+
+}
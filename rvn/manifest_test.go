@@ -0,0 +1,190 @@
+package rvn
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func withImageDir(t *testing.T, f func()) {
+	dir, err := ioutil.TempDir("", "rvn-img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := imageDir
+	imageDir = dir
+	defer func() {
+		imageDir = saved
+		os.RemoveAll(dir)
+	}()
+	f()
+}
+
+func TestImageManifestDefaults(t *testing.T) {
+
+	withImageDir(t, func() {
+
+		manifest := `
+arch: armv7l
+platform: arm7
+os: freebsd
+nic: e1000
+disktype: {bus: sata, dev: sd}
+user: admin
+become: doas
+python: /usr/local/bin/python3
+`
+		err := ioutil.WriteFile(
+			filepath.Join(imageDir, "myos.manifest"), []byte(manifest), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		topo, err := readModel([]byte(`{
+			"name": "manifest",
+			"nodes": [
+				{"name": "a", "image": "myos"},
+				{"name": "b", "image": "myos", "os": "linux", "defaultnic": "virtio"},
+				{"name": "c", "image": "freebsd-11"}
+			]
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a := topo.Nodes[0]
+		if a.Platform != "arm7" || a.OS != "freebsd" || a.DefaultNic != "e1000" ||
+			a.DefaultDisktype.Bus != "sata" {
+			t.Errorf("manifest not applied to a: %+v", a.Host)
+		}
+		if a.Kernel == "" {
+			t.Errorf("expected arm7 platform defaults for a")
+		}
+
+		// values given in the model win over the manifest
+		b := topo.Nodes[1]
+		if b.OS != "linux" || b.DefaultNic != "virtio" {
+			t.Errorf("model values not kept for b: %+v", b.Host)
+		}
+
+		// built in manifests apply to mirror images
+		c := topo.Nodes[2]
+		if c.OS != "freebsd" || c.Platform != "x86_64" {
+			t.Errorf("builtin manifest not applied to c: %+v", c.Host)
+		}
+
+		args, err := AnsibleArgs("a.yml", a.Host, "172.22.0.2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := strings.Join(args, " ")
+		for _, x := range []string{
+			"--user=admin",
+			"ansible_become_method=doas",
+			"ansible_become_pass=rvn",
+			"ansible_python_interpreter='/usr/local/bin/python3'",
+		} {
+			if !strings.Contains(s, x) {
+				t.Errorf("expected %s in ansible args for a: %s", x, s)
+			}
+		}
+
+		args, err = AnsibleArgs("c.yml", c.Host, "172.22.0.4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s = strings.Join(args, " ")
+		for _, x := range []string{
+			"--user=rvn",
+			"ansible_become_method=sudo",
+			"ansible_python_interpreter='/usr/local/bin/python2'",
+		} {
+			if !strings.Contains(s, x) {
+				t.Errorf("expected %s in ansible args for c: %s", x, s)
+			}
+		}
+
+		// rvn ssh logs in as the same user
+		user, err := LoginUser(topo, "a")
+		if err != nil || user != "admin" {
+			t.Errorf("expected to log in to a as admin, got %s - %v", user, err)
+		}
+		_, err = LoginUser(topo, "nope")
+		if err == nil {
+			t.Errorf("expected error for unknown host")
+		}
+
+	})
+
+}
+
+func TestImageManifestErrors(t *testing.T) {
+
+	withImageDir(t, func() {
+
+		ioutil.WriteFile(filepath.Join(imageDir, "bad.manifest"),
+			[]byte("platfrom: x86_64"), 0644)
+
+		_, err := readModel([]byte(`{
+			"name": "manifest",
+			"nodes": [{"name": "a", "image": "bad"}]
+		}`))
+		if err == nil || !strings.Contains(err.Error(), "node a: manifest") {
+			t.Errorf("expected manifest error, got %v", err)
+		}
+
+	})
+
+}
+
+func TestRunModelPullsManifests(t *testing.T) {
+
+	withTestEnv(t, testTopo, func(b *memBackend, s memStore) {
+
+		// myos and its manifest are only in a local image source, the defaults
+		// of the host come from the manifest once the image is pulled
+		local := filepath.Join(filepath.Dir(imageDir), "local")
+		os.MkdirAll(local, 0755)
+		ioutil.WriteFile(filepath.Join(local, "myos"), []byte("myos"), 0644)
+		ioutil.WriteFile(filepath.Join(local, "myos.manifest"),
+			[]byte("os: freebsd\nnic: e1000\n"), 0644)
+		ioutil.WriteFile(settingsFile,
+			[]byte(fmt.Sprintf("image-sources: [%s]\n", local)), 0644)
+
+		err := ioutil.WriteFile("model.yml", []byte(
+			"name: pulled\nnodes:\n  - name: a\n    image: myos\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = RunModel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		topo, err := LoadTopo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := topo.Nodes[0]
+		if a.OS != "freebsd" || a.DefaultNic != "e1000" {
+			t.Errorf("manifest not applied to a pulled image: %+v", a.Host)
+		}
+
+		// the manifest is saved with the topology, a manifest that goes bad
+		// later does not stop rvn from operating on it
+		ioutil.WriteFile(filepath.Join(imageDir, "myos.manifest"),
+			[]byte("platfrom: x86_64"), 0644)
+		topo, err = LoadTopo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if topo.Nodes[0].OS != "freebsd" {
+			t.Errorf("saved manifest values lost: %+v", topo.Nodes[0].Host)
+		}
+
+	})
+
+}
@@ -0,0 +1,321 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements model evaluation. A model is either a javascript
+ * program that describes a topology by assigning it to the global 'topo', or
+ * a declarative YAML or JSON file that holds the topology itself. Javascript
+ * models are evaluated in process by an embedded interpreter, in a sandbox
+ * that holds the modeling library and the environment of rvn as 'env'.
+ * Declarative models reference the environment with $VAR or ${VAR}.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dop251/goja"
+	"github.com/rcgoodfellow/raven/js"
+	"sigs.k8s.io/yaml"
+)
+
+// Variables ==================================================================
+
+// ModelFiles are the file names rvn looks for a model under, in order.
+var ModelFiles = []string{"model.js", "model.yml", "model.yaml", "model.json"}
+
+// Functions ==================================================================
+
+// FindModel returns the name of the model file in dir. It is an error for a
+// directory to contain no model or more than one.
+func FindModel(dir string) (string, error) {
+
+	var found []string
+	for _, x := range ModelFiles {
+		_, err := os.Stat(filepath.Join(dir, x))
+		if err == nil {
+			found = append(found, x)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no model found, expected one of %s",
+			strings.Join(ModelFiles, ", "))
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("more than one model found: %s",
+			strings.Join(found, ", "))
+	}
+
+}
+
+// LoadModel evaluates the model in dir and returns the topology it defines,
+// with defaults applied. The topology is linted, if there are any problems
+// with it the error is an ErrorList of LintErrors.
+func LoadModel(dir string) (Topo, error) {
+	return loadModel(dir, nil)
+}
+
+// loadModel is LoadModel, pulling the images of the topology with pull if it
+// is not nil. Hosts take their defaults from the manifests of their images, so
+// the topology is read again once the images and their manifests are in the
+// image store.
+func loadModel(dir string, pull func(Topo) error) (Topo, error) {
+
+	model, err := FindModel(dir)
+	if err != nil {
+		return Topo{}, err
+	}
+
+	out, err := EvalModelFile(filepath.Join(dir, model))
+	if err != nil {
+		return Topo{}, err
+	}
+
+	topo, err := readModel(out)
+	if err != nil {
+		return Topo{}, fmt.Errorf("%s: %v", model, err)
+	}
+
+	err = Lint(topo, dir)
+	if err != nil {
+		return Topo{}, err
+	}
+
+	if pull == nil {
+		return topo, nil
+	}
+
+	err = pull(topo)
+	if err != nil {
+		return Topo{}, err
+	}
+
+	topo, err = readModel(out)
+	if err != nil {
+		return Topo{}, fmt.Errorf("%s: %v", model, err)
+	}
+
+	err = Lint(topo, dir)
+	if err != nil {
+		return Topo{}, err
+	}
+
+	return topo, nil
+
+}
+
+// readModel reads the topology a model evaluated to. Values the user did not
+// supply are filled in, first from the image manifests and then from the
+// platform. The manifests are only consulted here, the topology saved by
+// RunModel carries what they supplied.
+func readModel(src []byte) (Topo, error) {
+	var topo Topo
+	err := json.Unmarshal(src, &topo)
+	if err != nil {
+		return topo, err
+	}
+
+	for i := 0; i < len(topo.Nodes); i++ {
+		h := &topo.Nodes[i].Host
+		err := applyImageManifest(h)
+		if err != nil {
+			return topo, nodeError(h.Name, "manifest", err)
+		}
+	}
+	for i := 0; i < len(topo.Switches); i++ {
+		h := &topo.Switches[i].Host
+		err := applyImageManifest(h)
+		if err != nil {
+			return topo, switchError(h.Name, "manifest", err)
+		}
+	}
+
+	fillInTopo(&topo)
+
+	return topo, nil
+}
+
+// EvalModelFile evaluates the model at path and returns the topology it
+// defines as JSON. The kind of model is determined by the file extension.
+func EvalModelFile(path string) ([]byte, error) {
+
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading model - %v", err)
+	}
+	name := filepath.Base(path)
+
+	switch filepath.Ext(path) {
+	case ".js":
+		return EvalModel(name, src)
+	case ".yml", ".yaml", ".json":
+		return ParseModel(name, src)
+	default:
+		return nil, fmt.Errorf("%s: unknown model type", name)
+	}
+
+}
+
+// EvalModel evaluates the javascript model src and returns the topology it
+// defines as JSON. The filename is used to locate errors within the model,
+// e.g. 'model.js:12:5: ReferenceError: nodes is not defined'.
+func EvalModel(filename string, src []byte) ([]byte, error) {
+
+	vm := goja.New()
+
+	err := vm.Set("env", environment())
+	if err != nil {
+		return nil, fmt.Errorf("failed to set model environment - %v", err)
+	}
+
+	_, err = vm.RunScript("modeling.js", js.Modeling)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load modeling library - %v", err)
+	}
+
+	program, err := goja.Compile(filename, string(src), false)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = vm.RunProgram(program)
+	if err != nil {
+		return nil, modelError(filename, err)
+	}
+
+	topo := vm.Get("topo")
+	if topo == nil || goja.IsUndefined(topo) || goja.IsNull(topo) {
+		return nil, fmt.Errorf("%s: model does not define topo", filename)
+	}
+
+	stringify, ok := goja.AssertFunction(
+		vm.Get("JSON").ToObject(vm).Get("stringify"))
+	if !ok {
+		return nil, fmt.Errorf("JSON.stringify is not a function")
+	}
+	out, err := stringify(goja.Undefined(), topo, goja.Null(), vm.ToValue(2))
+	if err != nil {
+		return nil, modelError(filename, err)
+	}
+
+	return []byte(out.String()), nil
+}
+
+// ParseModel parses the declarative YAML or JSON model src, interpolating
+// environment variables in string values, and returns the topology it
+// defines as JSON. Fields that are not part of a topology are rejected so
+// typos do not go unnoticed.
+func ParseModel(filename string, src []byte) ([]byte, error) {
+
+	var model interface{}
+	err := yaml.Unmarshal(src, &model)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if model == nil {
+		return nil, fmt.Errorf("%s: model is empty", filename)
+	}
+
+	missing := make(map[string]bool)
+	model = interpolate(model, missing)
+	if len(missing) > 0 {
+		var names []string
+		for x := range missing {
+			names = append(names, x)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("%s: undefined environment variables: %s",
+			filename, strings.Join(names, ", "))
+	}
+
+	out, err := json.MarshalIndent(model, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(out))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&Topo{})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	return out, nil
+}
+
+// Helper Functions ===========================================================
+
+// interpolate expands environment variables in every string value of a parsed
+// model, the names of variables that are not set are collected in missing. A
+// literal $ is written as $$.
+func interpolate(x interface{}, missing map[string]bool) interface{} {
+
+	switch v := x.(type) {
+	case string:
+		return os.Expand(v, func(name string) string {
+			if name == "$" {
+				return "$"
+			}
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				missing[name] = true
+			}
+			return value
+		})
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = interpolate(e, missing)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = interpolate(e, missing)
+		}
+	}
+	return x
+
+}
+
+// environment returns the environment of the current process as a map, this is
+// what models see as 'env'.
+func environment() map[string]string {
+
+	env := make(map[string]string)
+	for _, x := range os.Environ() {
+		parts := strings.SplitN(x, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	return env
+
+}
+
+// modelError turns an exception raised while evaluating a model into an error
+// that points at the line of the model that caused it. Exceptions raised from
+// within the modeling library are reported at the line of the model that
+// called into the library.
+func modelError(filename string, err error) error {
+
+	ex, ok := err.(*goja.Exception)
+	if !ok {
+		return err
+	}
+
+	for _, frame := range ex.Stack() {
+		if frame.SrcName() == filename {
+			return fmt.Errorf("%s: %s", frame.Position(), ex.Value())
+		}
+	}
+	return fmt.Errorf("%s: %s", filename, ex.Value())
+
+}
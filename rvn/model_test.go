@@ -0,0 +1,211 @@
+package rvn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEvalModel(t *testing.T) {
+
+	os.Setenv("RVN_TEST_DIR", "/src")
+
+	src := `
+nodes = Range(2).map(i => Node(` + "`n${i}`" + `, 0,
+  [{ 'source': env.RVN_TEST_DIR+'/n', 'point': '/tmp/n' }],
+  'debian-stretch', 'linux'))
+
+topo = {
+  'name': 'evaltest',
+  'nodes': nodes,
+  'switches': [Switch('sw', 1, [])],
+  'links': [
+    Link('n0', 0, 'sw', 1, {'delay': '10ms', 'mtu': 9000}),
+    Lan('lan0', [['n0', 1], ['n1', 1], ['sw', 2]]),
+  ]
+}
+`
+	out, err := EvalModel("model.js", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topo, err := ReadTopo(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if topo.Name != "evaltest" || len(topo.Nodes) != 2 || len(topo.Links) != 2 {
+		t.Fatalf("unexpected topo %+v", topo)
+	}
+	if topo.Nodes[1].Name != "n1" {
+		t.Errorf("expected node n1, got %s", topo.Nodes[1].Name)
+	}
+	if topo.Nodes[0].Mounts[0].Source != "/src/n" {
+		t.Errorf("env not visible to model, got mount %s",
+			topo.Nodes[0].Mounts[0].Source)
+	}
+	l := topo.Links[0]
+	if l.Emulation == nil || l.Emulation.Delay != "10ms" {
+		t.Errorf("expected link emulation, got %v", l.Emulation)
+	}
+	if l.Props["mtu"] != 9000.0 {
+		t.Errorf("expected mtu prop, got %v", l.Props)
+	}
+	if len(topo.Links[1].Endpoints) != 3 {
+		t.Errorf("expected 3 lan endpoints, got %d",
+			len(topo.Links[1].Endpoints))
+	}
+
+}
+
+func TestEvalModelErrors(t *testing.T) {
+
+	tests := []struct {
+		src, err string
+	}{
+		{"a = 1\nb = nodes.map(x => x)", "model.js:2:5: ReferenceError"},
+		{"a = 1\n\nb = Lan('x')", "model.js:3:8: TypeError"},
+		{"a = 1\nb = (", "model.js: Line 2"},
+		{"a = 1", "model.js: model does not define topo"},
+	}
+
+	for _, x := range tests {
+		_, err := EvalModel("model.js", []byte(x.src))
+		if err == nil {
+			t.Errorf("expected error evaluating %q", x.src)
+			continue
+		}
+		if !strings.Contains(err.Error(), x.err) {
+			t.Errorf("expected error containing %q, got %q", x.err, err)
+		}
+	}
+
+}
+
+func TestParseModel(t *testing.T) {
+
+	os.Setenv("RVN_TEST_DIR", "/src")
+
+	yml := `
+name: yamltest
+nodes:
+  - name: a
+    image: debian-stretch
+    os: linux
+    mounts:
+      - source: ${RVN_TEST_DIR}/a
+        point: /tmp/$$a
+  - name: b
+    image: debian-stretch
+    os: linux
+    memory:
+      capacity: {value: 4, unit: GiB}
+switches:
+  - name: sw
+    image: cumulusvx-3.5
+links:
+  - name: a-sw
+    endpoints: [{name: a, port: 0}, {name: sw, port: 1}]
+    emulation: {delay: 10ms, rate: 100mbit}
+  - name: lan0
+    endpoints: [{name: a, port: 1}, {name: b, port: 0}, {name: sw, port: 2}]
+`
+	out, err := ParseModel("model.yml", []byte(yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo, err := ReadTopo(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if topo.Name != "yamltest" || len(topo.Nodes) != 2 || len(topo.Links) != 2 {
+		t.Fatalf("unexpected topo %+v", topo)
+	}
+	m := topo.Nodes[0].Mounts[0]
+	if m.Source != "/src/a" || m.Point != "/tmp/$a" {
+		t.Errorf("expected interpolated mount, got %+v", m)
+	}
+	if topo.Nodes[1].Memory.Capacity.Value != 4 {
+		t.Errorf("expected 4 GiB of memory, got %+v", topo.Nodes[1].Memory)
+	}
+	// defaults are filled in just like for javascript models
+	if topo.Nodes[0].Platform == "" || topo.Switches[0].Arch == "" {
+		t.Errorf("expected defaults to be filled in, got %+v", topo.Nodes[0])
+	}
+	if topo.Links[0].Emulation.Rate != "100mbit" {
+		t.Errorf("expected emulated rate, got %v", topo.Links[0].Emulation)
+	}
+
+	// JSON models are parsed the same way
+	js := `{"name": "jsontest", "nodes": [{"name": "a", "image": "${RVN_TEST_DIR}"}]}`
+	out, err = ParseModel("model.json", []byte(js))
+	if err != nil {
+		t.Fatal(err)
+	}
+	topo, err = ReadTopo(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topo.Name != "jsontest" || topo.Nodes[0].Image != "/src" {
+		t.Errorf("unexpected topo %+v", topo)
+	}
+
+}
+
+func TestParseModelErrors(t *testing.T) {
+
+	os.Unsetenv("RVN_TEST_UNSET")
+
+	tests := []struct {
+		src, err string
+	}{
+		{"name: x\nnodez: []", `model.yml: json: unknown field "nodez"`},
+		{"name: ${RVN_TEST_UNSET}",
+			"model.yml: undefined environment variables: RVN_TEST_UNSET"},
+		{"name: [x", "model.yml: error converting YAML to JSON"},
+		{"", "model.yml: model is empty"},
+	}
+
+	for _, x := range tests {
+		_, err := ParseModel("model.yml", []byte(x.src))
+		if err == nil {
+			t.Errorf("expected error parsing %q", x.src)
+			continue
+		}
+		if !strings.Contains(err.Error(), x.err) {
+			t.Errorf("expected error containing %q, got %q", x.err, err)
+		}
+	}
+
+}
+
+func TestFindModel(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "rvn-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = FindModel(dir)
+	if err == nil {
+		t.Error("expected error for directory without a model")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "model.yml"), []byte("name: x"), 0644)
+	model, err := FindModel(dir)
+	if err != nil || model != "model.yml" {
+		t.Errorf("expected model.yml, got %q %v", model, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "model.js"), []byte("topo = {}"), 0644)
+	_, err = FindModel(dir)
+	if err == nil || !strings.Contains(err.Error(), "model.js, model.yml") {
+		t.Errorf("expected ambiguous model error, got %v", err)
+	}
+
+}
@@ -0,0 +1,106 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements the mounts of hosts that do not go through NFS. A 9p
+ * or virtiofs mount is attached to its host as a filesystem device, so it
+ * does not need the test network or an NFS client in the guest. The device
+ * is identified in the guest by a tag derived from the index of the mount,
+ * the base configuration (config.yml or its native counterpart) mounts it by
+ * that tag.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	"fmt"
+	"path/filepath"
+
+	xlibvirt "github.com/libvirt/libvirt-go-xml"
+)
+
+// Variables ==================================================================
+
+var mountTypes = []string{"nfs", "9p", "virtiofs"}
+
+// Methods ====================================================================
+
+// IsNFS returns true if the mount is served over NFS.
+func (m Mount) IsNFS() bool {
+	return m.Type == "" || m.Type == "nfs"
+}
+
+// Helper Functions ===========================================================
+
+// mountTag returns the tag of the filesystem device of the ith mount of a
+// host, config.yml uses the same tags.
+func mountTag(i int) string {
+	return fmt.Sprintf("rvn%d", i)
+}
+
+// mountEntries returns the fstab entries of the mounts of a host, with NFS
+// sources served from the test network address of the topology.
+func mountEntries(h Host, topo Topo) [][]string {
+
+	var entries [][]string
+	for i, m := range h.Mounts {
+		access := "rw"
+		if m.ReadOnly {
+			access = "ro"
+		}
+		switch m.Type {
+		case "9p":
+			entries = append(entries, []string{mountTag(i), m.Point, "9p",
+				"trans=virtio,version=9p2000.L," + access, "0", "0"})
+		case "virtiofs":
+			entries = append(entries, []string{mountTag(i), m.Point, "virtiofs",
+				access, "0", "0"})
+		default:
+			entries = append(entries, []string{topo.MgmtIp + ":" + m.Source,
+				m.Point, "nfs", access + ",soft", "0", "0"})
+		}
+	}
+	return entries
+
+}
+
+// attachMounts adds a filesystem device to the domain for every 9p and
+// virtiofs mount of the host. Relative sources are taken relative to the
+// directory of the topology.
+func attachMounts(h *Host, t *Topo, d *xlibvirt.Domain) {
+
+	for i, m := range h.Mounts {
+
+		if m.IsNFS() {
+			continue
+		}
+
+		source := m.Source
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(t.Dir, source)
+		}
+
+		fs := xlibvirt.DomainFilesystem{
+			AccessMode: "passthrough",
+			Source: &xlibvirt.DomainFilesystemSource{
+				Mount: &xlibvirt.DomainFilesystemSourceMount{Dir: source},
+			},
+			Target: &xlibvirt.DomainFilesystemTarget{Dir: mountTag(i)},
+		}
+		if m.ReadOnly {
+			fs.ReadOnly = &xlibvirt.DomainFilesystemReadOnly{}
+		}
+
+		if m.Type == "virtiofs" {
+			fs.Driver = &xlibvirt.DomainFilesystemDriver{Type: "virtiofs"}
+			// virtiofsd needs to share the memory of the guest
+			d.MemoryBacking = &xlibvirt.DomainMemoryBacking{
+				MemorySource: &xlibvirt.DomainMemorySource{Type: "memfd"},
+				MemoryAccess: &xlibvirt.DomainMemoryAccess{Mode: "shared"},
+			}
+		}
+
+		d.Devices.Filesystems = append(d.Devices.Filesystems, fs)
+
+	}
+
+}
@@ -0,0 +1,59 @@
+package rvn
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCreateMounts(t *testing.T) {
+
+	topo := testTopo
+	topo.Nodes = []Node{
+		{Host{Name: "a", Image: "debian-stretch", Mounts: []Mount{
+			{Point: "/opt/nfs", Source: "/srv/nfs"},
+			{Point: "/opt/9p", Source: "/srv/9p", Type: "9p"},
+			{Point: "/opt/vfs", Source: "vfs", Type: "virtiofs"},
+		}}},
+		{Host{Name: "b", Image: "debian-stretch", Mounts: []Mount{
+			{Point: "/opt/9p", Source: "/srv/9p", Type: "9p", ReadOnly: true},
+		}}},
+	}
+
+	withTestEnv(t, topo, func(b *memBackend, s memStore) {
+
+		err := Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		topo, _ := LoadTopo()
+
+		a := b.Domains["lifecycle_a"].Def
+		var fss []string
+		for _, fs := range a.Devices.Filesystems {
+			driver := "9p"
+			if fs.Driver != nil {
+				driver = fs.Driver.Type
+			}
+			fss = append(fss,
+				driver+":"+fs.Source.Mount.Dir+":"+fs.Target.Dir)
+		}
+		expected := "9p:/srv/9p:rvn1 virtiofs:" + topo.Dir + "/vfs:rvn2"
+		if strings.Join(fss, " ") != expected {
+			t.Errorf("unexpected filesystems %v", fss)
+		}
+		if a.MemoryBacking == nil || a.MemoryBacking.MemoryAccess.Mode != "shared" {
+			t.Errorf("virtiofs host needs shared memory")
+		}
+
+		bd := b.Domains["lifecycle_b"].Def
+		if len(bd.Devices.Filesystems) != 1 || bd.MemoryBacking != nil {
+			t.Fatalf("b should have one 9p filesystem and private memory")
+		}
+		if bd.Devices.Filesystems[0].ReadOnly == nil ||
+			a.Devices.Filesystems[0].ReadOnly != nil {
+			t.Errorf("only read only mounts should be read only")
+		}
+
+	})
+
+}
@@ -7,121 +7,121 @@ package rvn
  * through NFS. This basically involves setting up the correct exports. That
  * export setup is done here.
  *
+ * Each source is only exported to the hosts that mount it, by their address
+ * on the test network. Addresses are handed out by DHCP, so the exports are
+ * published when the topology is configured rather than when it is created.
+ *
  *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
 
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
 	"text/template"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// Export is a directory exported to the hosts that mount it.
 type Export struct {
-	Dir, Subnet string
+	Dir     string
+	Clients []ExportClient
 }
 
-func ExportNFS(topo Topo) error {
+// ExportClient is a host an export is exported to.
+type ExportClient struct {
+	Addr     string
+	ReadOnly bool
+}
 
-	//build the exports table
-	table := make(map[string]*Export)
-	for _, n := range topo.Nodes {
-		for _, m := range n.Mounts {
-			table[m.Source] = &Export{
-				Dir:    m.Source,
-				Subnet: topo.MgmtIp,
+// ExportNFS publishes the NFS exports of a topology, given the test network
+// addresses of its hosts. The sources of hosts without an address are not
+// exported.
+func ExportNFS(topo Topo, addrs map[string]string) error {
+
+	//build the exports table, source -> address -> client
+	table := make(map[string]map[string]*ExportClient)
+	addMounts := func(h Host) {
+		for _, m := range h.Mounts {
+			if !m.IsNFS() {
+				continue
+			}
+			addr := addrs[h.Name]
+			if addr == "" {
+				log.Warnf("%s has no address yet, not exporting %s to it",
+					h.Name, m.Source)
+				continue
+			}
+			if table[m.Source] == nil {
+				table[m.Source] = make(map[string]*ExportClient)
+			}
+			c, ok := table[m.Source][addr]
+			if !ok {
+				table[m.Source][addr] = &ExportClient{addr, m.ReadOnly}
+				continue
 			}
+			// a host that mounts a source more than once gets the most access
+			// any of its mounts asks for
+			c.ReadOnly = c.ReadOnly && m.ReadOnly
 		}
 	}
-
+	for _, n := range topo.Nodes {
+		addMounts(n.Host)
+	}
 	for _, n := range topo.Switches {
-		for _, m := range n.Mounts {
-			table[m.Source] = &Export{
-				Dir:    m.Source,
-				Subnet: topo.MgmtIp,
-			}
-		}
+		addMounts(n.Host)
 	}
 
-	//flatten table in to a list of exports
+	//flatten table in to a sorted list of exports
 	var exports []*Export
-	for _, x := range table {
+	for dir, clients := range table {
+		x := &Export{Dir: dir}
+		for _, c := range clients {
+			x.Clients = append(x.Clients, *c)
+		}
+		sort.Slice(x.Clients, func(i, j int) bool {
+			return x.Clients[i].Addr < x.Clients[j].Addr
+		})
 		exports = append(exports, x)
 	}
+	sort.Slice(exports, func(i, j int) bool {
+		return exports[i].Dir < exports[j].Dir
+	})
 
 	//run the exports template
-	tp_path, err := filepath.Abs("/var/rvn/template/sys.exports")
+	tp_path, err := filepath.Abs(templateDir + "/sys.exports")
 	if err != nil {
-		err = fmt.Errorf("failed to create absolute path for sys.exports - %v", err)
-		log.Printf("%v", err)
-		return err
+		return fmt.Errorf("failed to create absolute path for sys.exports - %v", err)
 	}
 	tp, err := template.ParseFiles(tp_path)
 	if err != nil {
-		err = fmt.Errorf("failed to read sys.exports - %v", err)
-		log.Printf("%v", err)
-		return err
+		return fmt.Errorf("failed to read sys.exports - %v", err)
 	}
 
 	wd, err := WkDir()
 	if err != nil {
-		log.Printf("exportnfs: failed to get working dir")
-		return err
+		return fmt.Errorf("failed to get working dir - %v", err)
 	}
 
 	path := fmt.Sprintf("/%s/%s.exports", wd, topo.Name)
 	f, err := os.Create(path)
 	if err != nil {
-		err = fmt.Errorf("failed to create path %s - %v", path, err)
-		log.Printf("%v", err)
-		return err
+		return fmt.Errorf("failed to create path %s - %v", path, err)
 	}
 	defer f.Close()
 	err = tp.Execute(f, exports)
 	if err != nil {
-		err = fmt.Errorf("failed to execute exports template for %s - %v",
+		return fmt.Errorf("failed to execute exports template for %s - %v",
 			topo.Name, err)
-		log.Printf("%v", err)
-		return err
 	}
 
-	os.MkdirAll("/etc/exports.d", 0755)
-	out, err := exec.Command("cp", path, "/etc/exports.d/").CombinedOutput()
-	if err != nil {
-		err = fmt.Errorf("unable to create exports directory %s - %v", out, err)
-		log.Printf("%v", err)
-		return err
-	}
-
-	out, err = exec.Command("exportfs", "-ra").CombinedOutput()
-	if err != nil {
-		err = fmt.Errorf("exportfs failed %s - %v", out, err)
-		log.Printf("%v", err)
-		return err
-	}
-
-	return nil
+	return backend.Export(topo.Name, path)
 
 }
 
 func UnexportNFS(topoName string) error {
 
-	path := fmt.Sprintf("/etc/exports.d/%s.exports", topoName)
-	out, err := exec.Command("rm", "-f", path).CombinedOutput()
-	if err != nil {
-		err = fmt.Errorf("error removing exports file %s - %v", path, err)
-		return err
-	}
-
-	out, err = exec.Command("exportfs", "-ra").CombinedOutput()
-	if err != nil {
-		err = fmt.Errorf("exportfs failed %s - %v", out, err)
-		log.Printf("%v", err)
-		return err
-	}
-
-	return nil
+	return backend.Unexport(topoName)
 
 }
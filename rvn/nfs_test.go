@@ -0,0 +1,47 @@
+package rvn
+
+import (
+	"testing"
+)
+
+func TestExportNFS(t *testing.T) {
+
+	topo := testTopo
+	topo.Nodes = []Node{
+		{Host{Name: "a", Mounts: []Mount{
+			{Point: "/opt/src", Source: "/srv/src"},
+			{Point: "/opt/creds", Source: "/srv/creds-a", ReadOnly: true},
+			{Point: "/opt/9p", Source: "/srv/9p", Type: "9p"},
+		}}},
+		{Host{Name: "b", Mounts: []Mount{
+			{Point: "/opt/src", Source: "/srv/src", ReadOnly: true},
+			{Point: "/opt/src2", Source: "/srv/src"},
+		}}},
+		{Host{Name: "c", Mounts: []Mount{
+			{Point: "/opt/src", Source: "/srv/src"},
+		}}},
+	}
+
+	withTestEnv(t, topo, func(b *memBackend, s memStore) {
+
+		// c has no address yet, so nothing is exported to it
+		err := ExportNFS(topo, map[string]string{
+			"a":  "172.22.0.10",
+			"b":  "172.22.0.11",
+			"sw": "172.22.0.12",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts := ",sync,no_root_squash,no_subtree_check,insecure," +
+			"anonuid=1000,anongid=1000)"
+		expected := "/srv/creds-a 172.22.0.10(ro" + opts + "\n" +
+			"/srv/src 172.22.0.10(rw" + opts + " 172.22.0.11(rw" + opts + "\n"
+		if b.Exports["lifecycle"] != expected {
+			t.Errorf("expected exports\n%s\ngot\n%s", expected, b.Exports["lifecycle"])
+		}
+
+	})
+
+}
@@ -0,0 +1,501 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements the native provisioner. It runs the provisioning steps
+ * of a host over a Go ssh client instead of through ansible-playbook, so
+ * neither the host machine nor the guest needs ansible or python. Steps are
+ * declared per host in the model and run in order, e.g.
+ *
+ *   provision: [
+ *     { upload: { source: 'walrus.conf', dest: '/etc/walrus.conf' } },
+ *     { template: { source: 'hosts.tmpl', dest: '/etc/hosts', mode: '0644' } },
+ *     { command: 'apt-get install -y walrus' },
+ *     { reboot: true },
+ *   ]
+ *
+ * Every step runs as root, through the become method of the host's image.
+ * Output is streamed line by line, prefixed with the name of the host, so the
+ * output of hosts provisioned in parallel can be told apart.
+ *
+ * Hosts with provisioning steps also get their base configuration from the
+ * native provisioner, as steps doing what config.yml does, so a topology that
+ * is only provisioned this way is configured without ansible.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Types ======================================================================
+
+// ProvisionStep is a step of the native provisioner. Exactly one of its
+// fields is set.
+type ProvisionStep struct {
+	// Upload copies a file to the host
+	Upload *FileCopy `json:"upload,omitempty"`
+	// Template renders a text/template with the host and topology and copies
+	// the result to the host
+	Template *FileCopy `json:"template,omitempty"`
+	// Command is a shell command to run on the host
+	Command string `json:"command,omitempty"`
+	// Reboot reboots the host and waits for it to come back
+	Reboot bool `json:"reboot,omitempty"`
+}
+
+// FileCopy is a file copied to a host. Relative sources are taken relative
+// to the directory of the topology.
+type FileCopy struct {
+	Source string `json:"source"`
+	Dest   string `json:"dest"`
+	// Mode is the octal mode of the file on the host, 0644 by default
+	Mode string `json:"mode,omitempty"`
+}
+
+// sshHost is an ssh connection to a host being provisioned.
+type sshHost struct {
+	h      Host
+	addr   string
+	login  ImageManifest
+	config *ssh.ClientConfig
+	client *ssh.Client
+	ctx    context.Context
+	out    io.Writer
+}
+
+// prefixWriter writes complete lines to w, each prefixed with prefix.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+	buf    []byte
+}
+
+// Variables ==================================================================
+
+var (
+	sshKey     = "/var/rvn/ssh/rvn"
+	sshTimeout = 30 * time.Second
+
+	// where the utilities installed by the base configuration are
+	utilDir = "/var/rvn/util"
+
+	// where the output of provisioning steps goes
+	provisionOutput io.Writer = os.Stdout
+	// serializes lines written to provisionOutput
+	outputMtx sync.Mutex
+)
+
+// Functions ==================================================================
+
+// Provision runs the provisioning steps of a host at ip. The output of the
+// steps is written to out. Provisioning stops when ctx is done.
+func Provision(
+	ctx context.Context, topo Topo, h Host, ip string, out io.Writer) error {
+
+	c, err := dialHost(ctx, h, ip, out)
+	if err != nil {
+		return err
+	}
+	defer func() { c.client.Close() }()
+
+	for i, s := range h.Provision {
+		err = c.step(s, topo)
+		if ee, ok := err.(*ssh.ExitError); ok {
+			return &ExitError{
+				Code: ee.ExitStatus(),
+				Err:  fmt.Errorf("provision[%d]: %s - %v", i, s, err),
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("provision[%d]: %s - %v", i, s, err)
+		}
+	}
+
+	return nil
+
+}
+
+// Methods ====================================================================
+
+func (s ProvisionStep) String() string {
+	switch {
+	case s.Upload != nil:
+		return "upload " + s.Upload.Dest
+	case s.Template != nil:
+		return "template " + s.Template.Dest
+	case s.Reboot:
+		return "reboot"
+	}
+	return "command " + s.Command
+}
+
+// kinds returns the number of kinds of step set on the step.
+func (s ProvisionStep) kinds() int {
+	n := 0
+	for _, set := range []bool{
+		s.Upload != nil, s.Template != nil, s.Command != "", s.Reboot,
+	} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *sshHost) step(s ProvisionStep, topo Topo) error {
+
+	switch {
+
+	case s.Upload != nil:
+		data, err := ioutil.ReadFile(topoPath(topo, s.Upload.Source))
+		if err != nil {
+			return err
+		}
+		return c.upload(data, s.Upload.Dest, s.Upload.Mode)
+
+	case s.Template != nil:
+		tp, err := template.ParseFiles(topoPath(topo, s.Template.Source))
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		err = tp.Execute(&buf, struct {
+			Host Host
+			Topo Topo
+		}{c.h, topo})
+		if err != nil {
+			return err
+		}
+		return c.upload(buf.Bytes(), s.Template.Dest, s.Template.Mode)
+
+	case s.Reboot:
+		return c.reboot()
+
+	}
+
+	return c.run(s.Command)
+
+}
+
+// run runs cmd as root, streaming its output.
+func (c *sshHost) run(cmd string) error {
+
+	s, err := c.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// stdout and stderr are copied concurrently, so each gets its own writer
+	stdout := &prefixWriter{prefix: c.h.Name + ": ", w: c.out}
+	stderr := &prefixWriter{prefix: c.h.Name + ": ", w: c.out}
+	defer stdout.Flush()
+	defer stderr.Flush()
+	s.Stdout = stdout
+	s.Stderr = stderr
+
+	cmd, pass := c.become(cmd)
+	s.Stdin = strings.NewReader(pass)
+
+	return s.Run(cmd)
+
+}
+
+// upload writes data to dest on the host. The data is first written to a
+// temporary file as the login user, then installed into place as root.
+func (c *sshHost) upload(data []byte, dest, mode string) error {
+
+	if mode == "" {
+		mode = "0644"
+	}
+	if !validMode(mode) {
+		return fmt.Errorf("bad mode '%s'", mode)
+	}
+
+	s, err := c.client.NewSession()
+	if err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("/tmp/rvn-upload-%d", time.Now().UnixNano())
+	s.Stdin = bytes.NewReader(data)
+	out, err := s.CombinedOutput("cat > " + shellQuote(tmp))
+	s.Close()
+	if err != nil {
+		return fmt.Errorf("%s %v", bytes.TrimSpace(out), err)
+	}
+
+	return c.run(fmt.Sprintf(
+		"mkdir -p %s && install -m %s %s %s; rc=$?; rm -f %s; exit $rc",
+		shellQuote(path.Dir(dest)), mode, shellQuote(tmp), shellQuote(dest),
+		shellQuote(tmp),
+	))
+
+}
+
+// reboot reboots the host and waits for it to accept ssh connections again.
+func (c *sshHost) reboot() error {
+
+	s, err := c.client.NewSession()
+	if err != nil {
+		return err
+	}
+	cmd, pass := c.become("reboot")
+	s.Stdin = strings.NewReader(pass)
+	defer s.Close()
+	err = s.Start(cmd)
+	if err != nil {
+		return err
+	}
+
+	// the connection drops as the host goes down, if it does not the client
+	// is closed so the wait still ends
+	down := make(chan error, 1)
+	go func() { down <- c.client.Wait() }()
+	select {
+	case <-down:
+	case <-c.ctx.Done():
+		c.client.Close()
+		return c.ctx.Err()
+	case <-time.After(bootTimeout):
+		c.client.Close()
+		return fmt.Errorf("%s did not go down within %v", c.h.Name, bootTimeout)
+	}
+	c.client.Close()
+
+	deadline := time.Now().Add(bootTimeout)
+	for time.Now().Before(deadline) && c.ctx.Err() == nil {
+		err = c.dial()
+		if err == nil {
+			return nil
+		}
+		time.Sleep(bootPoll)
+	}
+
+	return fmt.Errorf("%s did not come back within %v - %v", c.h.Name,
+		bootTimeout, err)
+
+}
+
+// dial connects to the host. The connection is cut once the context of the
+// host is done, which fails whatever is running over it.
+func (c *sshHost) dial() error {
+
+	d := net.Dialer{Timeout: c.config.Timeout}
+	conn, err := d.DialContext(c.ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := c.ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	sc, chans, reqs, err := ssh.NewClientConn(conn, c.addr, c.config)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	c.client = ssh.NewClient(sc, chans, reqs)
+	return nil
+
+}
+
+// become wraps cmd to run as root and returns it along with the input the
+// become method expects ahead of the input of cmd.
+func (c *sshHost) become(cmd string) (string, string) {
+	if c.login.User == "root" {
+		return cmd, ""
+	}
+	return fmt.Sprintf("sudo -S -p '' sh -c %s", shellQuote(cmd)),
+		c.login.BecomePass + "\n"
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+
+}
+
+// Flush writes out a trailing partial line.
+func (w *prefixWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.line(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *prefixWriter) line(l []byte) {
+	outputMtx.Lock()
+	fmt.Fprintf(w.w, "%s%s\n", w.prefix, l)
+	outputMtx.Unlock()
+}
+
+// Helper Functions ===========================================================
+
+// runProvision runs the provisioning steps of a host, stopping when ctx is
+// done. The output of the steps goes to out as well as to provisionOutput.
+func runProvision(ctx context.Context, topo Topo, h Host, s DomStatus,
+	out io.Writer) error {
+
+	if strings.ToLower(h.OS) == "netboot" {
+		return nil
+	}
+
+	err := Provision(ctx, topo, h, s.IP, io.MultiWriter(out, provisionOutput))
+	if err != nil {
+		log.Printf("failed to provision %s - %v", h.Name, err)
+		return err
+	}
+
+	return nil
+
+}
+
+// runBaseProvision runs the base configuration of a host with the native
+// provisioner, stopping when ctx is done.
+func runBaseProvision(ctx context.Context, topo Topo, h Host, s DomStatus,
+	out io.Writer) error {
+
+	h.Provision = baseSteps(h, topo)
+	return runProvision(ctx, topo, h, s, out)
+
+}
+
+// baseSteps returns the provisioning steps that do what the base
+// configuration playbook, config.yml, does for a host.
+func baseSteps(h Host, topo Topo) []ProvisionStep {
+
+	var steps []ProvisionStep
+
+	if strings.ToLower(h.OS) == "freebsd" {
+		steps = append(steps, ProvisionStep{Upload: &FileCopy{
+			Source: filepath.Join(utilDir, "iamme-freebsd"),
+			Dest:   "/usr/local/bin/iamme",
+			Mode:   "0755",
+		}})
+	} else {
+		steps = append(steps,
+			ProvisionStep{Upload: &FileCopy{
+				Source: filepath.Join(utilDir, "iamme-linux"),
+				Dest:   "/usr/local/bin/iamme",
+				Mode:   "0755",
+			}},
+			ProvisionStep{Command: "/usr/local/bin/iamme eth0 " + topo.MgmtIp},
+		)
+	}
+
+	name := shellQuote(h.Name)
+	hosts := shellQuote("127.0.0.1    " + h.Name)
+	steps = append(steps,
+		ProvisionStep{Command: fmt.Sprintf("hostname %s && "+
+			"if command -v sysrc >/dev/null; then sysrc hostname=%s; "+
+			"else echo %s > /etc/hostname; fi", name, name, name)},
+		ProvisionStep{Command: fmt.Sprintf(
+			"grep -qxF %s /etc/hosts || echo %s >> /etc/hosts", hosts, hosts)},
+	)
+
+	for _, m := range mountEntries(h, topo) {
+		point := shellQuote(m[1])
+		entry := shellQuote(strings.Join(m, " "))
+		mounted := shellQuote(" on " + m[1] + " ")
+		steps = append(steps, ProvisionStep{Command: fmt.Sprintf(
+			"mkdir -p %s && (grep -qxF %s /etc/fstab || echo %s >> /etc/fstab) "+
+				"&& (mount | grep -qF %s || mount %s)",
+			point, entry, entry, mounted, point)})
+	}
+
+	return steps
+
+}
+
+// dialHost connects to a host at ip, logging in as the image manifest of the
+// host says. Failing to connect is a TransientError.
+func dialHost(
+	ctx context.Context, h Host, ip string, out io.Writer) (*sshHost, error) {
+
+	login, err := hostLogin(h)
+	if err != nil {
+		return nil, err
+	}
+	if login.User != "root" && login.Become != "sudo" {
+		return nil, fmt.Errorf("become method '%s' is not supported by the "+
+			"ssh provisioner, use sudo", login.Become)
+	}
+
+	key, err := ioutil.ReadFile(sshKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rvn ssh key - %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rvn ssh key - %v", err)
+	}
+
+	c := &sshHost{
+		h:     h,
+		addr:  net.JoinHostPort(ip, sshPort),
+		login: login,
+		config: &ssh.ClientConfig{
+			User: login.User,
+			Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			// hosts are recreated with new keys all the time, like the ansible
+			// runs host keys are not checked
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         sshTimeout,
+		},
+		out: out,
+		ctx: ctx,
+	}
+
+	err = c.dial()
+	if err != nil {
+		return nil, &TransientError{fmt.Errorf("ssh %s - %v", c.addr, err)}
+	}
+
+	return c, nil
+
+}
+
+// topoPath returns p relative to the directory of the topology, unless it is
+// absolute.
+func topoPath(topo Topo, p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(topo.Dir, p)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// validMode returns true if mode is an octal file mode.
+func validMode(mode string) bool {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	return err == nil && m <= 07777
+}
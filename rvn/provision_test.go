@@ -0,0 +1,379 @@
+package rvn
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshCall is a command run on a fakeSSH server along with its input.
+type sshCall struct {
+	Cmd, Stdin string
+}
+
+// fakeSSH is an ssh server that records the commands run on it instead of
+// running them. Commands containing 'false' fail, commands containing 'hang'
+// never finish and a reboot drops the connection, unless the server is stuck.
+type fakeSSH struct {
+	mtx   sync.Mutex
+	calls []sshCall
+	conns int
+	stuck bool
+}
+
+// withFakeSSH runs f with the provisioner pointed at a fakeSSH server on
+// 127.0.0.1.
+func withFakeSSH(t *testing.T, f func(srv *fakeSSH)) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, err := ioutil.TempFile("", "rvn-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	defer keyFile.Close()
+	pem.Encode(keyFile, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(
+			ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	srv := &fakeSSH{}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(c, config)
+		}
+	}()
+
+	saved := struct {
+		key, port string
+		poll      time.Duration
+	}{sshKey, sshPort, bootPoll}
+	defer func() {
+		sshKey, sshPort, bootPoll = saved.key, saved.port, saved.poll
+	}()
+	sshKey = keyFile.Name()
+	_, sshPort, _ = net.SplitHostPort(l.Addr().String())
+	bootPoll = 10 * time.Millisecond
+
+	f(srv)
+
+}
+
+func (srv *fakeSSH) serve(c net.Conn, config *ssh.ServerConfig) {
+
+	conn, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		return
+	}
+	srv.mtx.Lock()
+	srv.conns++
+	srv.mtx.Unlock()
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range reqs {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var exec struct{ Command string }
+				ssh.Unmarshal(req.Payload, &exec)
+				req.Reply(true, nil)
+
+				stdin, _ := ioutil.ReadAll(ch)
+				srv.mtx.Lock()
+				srv.calls = append(srv.calls, sshCall{exec.Command, string(stdin)})
+				stuck := srv.stuck
+				srv.mtx.Unlock()
+
+				if strings.Contains(exec.Command, "reboot") && !stuck {
+					conn.Close()
+					return
+				}
+				if strings.Contains(exec.Command, "hang") || stuck {
+					conn.Wait()
+					return
+				}
+				status := uint32(0)
+				if strings.Contains(exec.Command, "false") {
+					ch.Stderr().Write([]byte("it failed"))
+					status = 1
+				} else {
+					ch.Write([]byte("did it\nall of it\n"))
+				}
+				ch.SendRequest("exit-status", false,
+					ssh.Marshal(struct{ Status uint32 }{status}))
+				ch.Close()
+			}
+		}()
+	}
+
+}
+
+func TestProvision(t *testing.T) {
+
+	topo := testTopo
+	topo.Nodes = []Node{
+		{Host{Name: "a", Image: "debian-stretch", OS: "linux",
+			Provision: []ProvisionStep{
+				{Upload: &FileCopy{Source: "walrus.conf", Dest: "/etc/walrus.conf"}},
+				{Template: &FileCopy{
+					Source: "motd.tmpl", Dest: "/etc/motd", Mode: "0600"}},
+				{Command: "systemctl restart walrus"},
+				{Reboot: true},
+				{Command: "uptime"},
+			}}},
+		{Host{Name: "b", Image: "debian-stretch", OS: "linux",
+			Provision: []ProvisionStep{
+				{Command: "false"},
+				{Command: "never"},
+			}}},
+	}
+
+	withTestEnv(t, topo, func(b *memBackend, s memStore) {
+		withFakeSSH(t, func(srv *fakeSSH) {
+
+			ioutil.WriteFile("walrus.conf", []byte("tusks: 2\n"), 0644)
+			ioutil.WriteFile("motd.tmpl", []byte("{{.Host.Name}}.{{.Topo.Name}}"),
+				0644)
+
+			topo, err := LoadTopo()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			saved := provisionOutput
+			defer func() { provisionOutput = saved }()
+			provisionOutput = &out
+
+			ds := DomStatus{IP: "127.0.0.1"}
+			err = runProvision(context.Background(), topo, topo.Nodes[0].Host, ds,
+				ioutil.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sudo := func(cmd string) sshCall {
+				return sshCall{"sudo -S -p '' sh -c " + shellQuote(cmd), "rvn\n"}
+			}
+			if len(srv.calls) != 7 {
+				t.Fatalf("expected 7 commands, got %d: %+v",
+					len(srv.calls), srv.calls)
+			}
+			tmp := strings.TrimPrefix(srv.calls[0].Cmd, "cat > ")
+			expected := []sshCall{
+				{"cat > " + tmp, "tusks: 2\n"},
+				sudo("mkdir -p '/etc' && install -m 0644 " + tmp +
+					" '/etc/walrus.conf'; rc=$?; rm -f " + tmp + "; exit $rc"),
+				{srv.calls[2].Cmd, "a.lifecycle"},
+				srv.calls[3],
+				sudo("systemctl restart walrus"),
+				sudo("reboot"),
+				sudo("uptime"),
+			}
+			for i, x := range expected {
+				if srv.calls[i] != x {
+					t.Errorf("command %d: expected %+v, got %+v", i, x, srv.calls[i])
+				}
+			}
+			if !strings.Contains(srv.calls[3].Cmd, "install -m 0600") {
+				t.Errorf("template mode not applied: %s", srv.calls[3].Cmd)
+			}
+			if srv.conns != 2 {
+				t.Errorf("expected to reconnect after reboot, got %d connections",
+					srv.conns)
+			}
+			if !strings.Contains(out.String(), "a: did it\na: all of it\n") {
+				t.Errorf("output not streamed per node:\n%s", out.String())
+			}
+
+			// a failing step stops provisioning and fails the host
+			srv.calls = nil
+			err = runProvision(context.Background(), topo, topo.Nodes[1].Host, ds,
+				ioutil.Discard)
+			if err == nil ||
+				!strings.Contains(err.Error(), "provision[0]: command false") {
+				t.Errorf("expected step failure, got %v", err)
+			}
+			if _, ok := err.(*TransientError); ok {
+				t.Errorf("a failing step is not transient")
+			}
+			if len(srv.calls) != 1 {
+				t.Errorf("steps ran after a failure: %+v", srv.calls)
+			}
+			if !strings.Contains(out.String(), "b: it failed\n") {
+				t.Errorf("partial output line not flushed:\n%s", out.String())
+			}
+
+			// a hung step is cut off when the context is done
+			h := Host{Name: "c", Image: "debian-stretch", OS: "linux",
+				Provision: []ProvisionStep{{Command: "hang"}}}
+			ctx, cancel := context.WithTimeout(context.Background(),
+				100*time.Millisecond)
+			defer cancel()
+			err = runProvision(ctx, topo, h, ds, ioutil.Discard)
+			if err == nil {
+				t.Errorf("expected hung step to fail")
+			}
+
+			// so is a reboot that never goes down
+			srv.mtx.Lock()
+			srv.stuck = true
+			srv.mtx.Unlock()
+			h = Host{Name: "c", Image: "debian-stretch", OS: "linux",
+				Provision: []ProvisionStep{{Reboot: true}}}
+			ctx, cancel = context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+			err = runProvision(ctx, topo, h, ds, ioutil.Discard)
+			if err == nil || !strings.Contains(err.Error(), "canceled") {
+				t.Errorf("expected stuck reboot to be cancelled, got %v", err)
+			}
+			srv.mtx.Lock()
+			srv.stuck = false
+			srv.mtx.Unlock()
+
+			// an unreachable host is transient
+			sshPort = "1"
+			err = runProvision(context.Background(), topo, topo.Nodes[0].Host, ds,
+				ioutil.Discard)
+			if _, ok := err.(*TransientError); !ok {
+				t.Errorf("expected a transient error, got %v", err)
+			}
+
+		})
+	})
+
+}
+
+func TestConfigureWithoutAnsible(t *testing.T) {
+
+	topo := testTopo
+	topo.Nodes = []Node{
+		{Host{Name: "a", Image: "debian-stretch", OS: "linux",
+			Mounts: []Mount{{Source: "/src/a", Point: "/tmp/a", ReadOnly: true}},
+			Provision: []ProvisionStep{
+				{Command: "uptime"},
+			}}},
+	}
+
+	withTestEnv(t, topo, func(b *memBackend, s memStore) {
+		withFakeSSH(t, func(srv *fakeSSH) {
+
+			// no ansible-playbook anywhere on the path
+			savedPath := os.Getenv("PATH")
+			defer os.Setenv("PATH", savedPath)
+			os.Setenv("PATH", "")
+
+			savedUtil := utilDir
+			defer func() { utilDir = savedUtil }()
+			utilDir = "util"
+			os.MkdirAll(utilDir, 0755)
+			ioutil.WriteFile("util/iamme-linux", []byte("iamme"), 0755)
+
+			saved := provisionOutput
+			defer func() { provisionOutput = saved }()
+			provisionOutput = ioutil.Discard
+
+			topo, err := LoadTopo()
+			if err != nil {
+				t.Fatal(err)
+			}
+			topo.MgmtIp = "172.22.0.1"
+
+			cs := ConfigureSettings{
+				Parallel: 1,
+				Timeout:  Duration{time.Second},
+				Retries:  intPtr(0),
+			}
+			err = configureWithRetries(topo, topo.Nodes[0].Host,
+				DomStatus{IP: "127.0.0.1"}, true, cs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s["config_state:lifecycle:a"] != "user: success (1 attempt)" {
+				t.Errorf("unexpected state '%s'", s["config_state:lifecycle:a"])
+			}
+
+			var cmds []string
+			for _, c := range srv.calls {
+				cmds = append(cmds, c.Cmd)
+			}
+			all := strings.Join(cmds, "\n")
+			for _, x := range []string{
+				"iamme eth0 172.22.0.1",
+				"hostname '\\''a'\\''",
+				"172.22.0.1:/src/a /tmp/a nfs ro,soft 0 0",
+				"uptime",
+			} {
+				if !strings.Contains(all, x) {
+					t.Errorf("expected '%s' to run, got:\n%s", x, all)
+				}
+			}
+			if !strings.HasSuffix(all, "'uptime'") {
+				t.Errorf("expected provisioning steps after base config:\n%s", all)
+			}
+
+			// the seed of a cloud-init host without nfs mounts did its base
+			// config, only its provisioning steps run
+			srv.calls = nil
+			h := Host{Name: "c", Image: "debian-stretch", OS: "linux",
+				Mounts:    []Mount{{Source: "/src/c", Point: "/tmp/c", Type: "9p"}},
+				CloudInit: &CloudInit{},
+				Provision: []ProvisionStep{{Command: "uptime"}}}
+			err = configureWithRetries(topo, h, DomStatus{IP: "127.0.0.1"}, true, cs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(srv.calls) != 1 || !strings.Contains(srv.calls[0].Cmd, "uptime") {
+				t.Errorf("expected only provisioning steps, got %+v", srv.calls)
+			}
+
+		})
+	})
+
+}
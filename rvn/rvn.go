@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 
 	xir "github.com/ceftb/xir/lang/go"
 	log "github.com/sirupsen/logrus"
@@ -16,6 +15,10 @@ import (
 type Mount struct {
 	Point  string `json:"point"`
 	Source string `json:"source"`
+	// Type is how the source is shared with the host: nfs (the default), 9p or
+	// virtiofs
+	Type     string `json:"type,omitempty"`
+	ReadOnly bool   `json:"readonly,omitempty"`
 }
 
 type UnitValue struct {
@@ -44,6 +47,30 @@ type Disktype struct {
 	Dev string `json:"dev"`
 }
 
+// Disk is a blank data disk attached to a host in addition to its root disk.
+type Disk struct {
+	Size UnitValue `json:"size"`
+	// Bus defaults to the bus of the host's default disk type
+	Bus string `json:"bus,omitempty"`
+	// Format is qcow2 (the default) or raw
+	Format string `json:"format,omitempty"`
+	// Shared disks are marked shareable and are not cached by the host, they
+	// must be raw
+	Shared bool `json:"shared,omitempty"`
+}
+
+// SharedDisk is a disk declared once in a topology and attached to several
+// hosts, e.g. for testing clustered filesystems. Shared disks are raw,
+// shareable and not cached by the host.
+type SharedDisk struct {
+	Name string    `json:"name"`
+	Size UnitValue `json:"size"`
+	// Hosts is the names of the hosts the disk is attached to
+	Hosts []string `json:"hosts"`
+	// Bus defaults to the bus of each host's default disk type
+	Bus string `json:"bus,omitempty"`
+}
+
 type Host struct {
 	Name            string    `json:"name"`
 	Arch            string    `json:"arch"`
@@ -60,6 +87,22 @@ type Host struct {
 	Memory          *Memory   `json:"memory,omitempty"`
 	DefaultNic      string    `json:"defaultnic"`
 	DefaultDisktype *Disktype `json:"defaultdisktype"`
+	// DiskSize is the size of the root disk, when set the image of the host is
+	// grown to it
+	DiskSize *UnitValue `json:"disksize,omitempty"`
+	Disks    []Disk     `json:"disks,omitempty"`
+	// CloudInit, when set, provisions the host through a NoCloud seed
+	CloudInit *CloudInit `json:"cloud-init,omitempty"`
+	// Provision are steps run by the native provisioner after the base and
+	// user configuration
+	Provision []ProvisionStep `json:"provision,omitempty"`
+	// Tags are ansible inventory groups the host is in
+	Tags []string `json:"tags,omitempty"`
+	// Stage is the configure stage of the host, hosts are configured after
+	// every host in an earlier stage
+	Stage int `json:"stage,omitempty"`
+	// After are hosts the host is configured after
+	After []string `json:"after,omitempty"`
 
 	TelnetPort int
 
@@ -80,10 +123,14 @@ type Endpoint struct {
 	Port int    `json:"port"`
 }
 
+// Link connects hosts through a dedicated network. A point to point link has
+// two endpoints, a LAN has any number of them.
 type Link struct {
 	Name      string                 `json:"name"`
-	Endpoints [2]Endpoint            `json:"endpoints"`
+	Endpoints []Endpoint             `json:"endpoints"`
 	Props     map[string]interface{} `json:"props"`
+	Emulation *Emulation             `json:"emulation,omitempty"`
+	Down      bool                   `json:"down,omitempty"`
 }
 
 type Options struct {
@@ -91,19 +138,22 @@ type Options struct {
 }
 
 type Topo struct {
-	Name     string   `json:"name"`
-	Nodes    []Node   `json:"nodes"`
-	Switches []Zwitch `json:"switches"`
-	Links    []Link   `json:"links"`
-	Dir      string   `json:"dir"`
-	MgmtIp   string   `json:"mgmtip"`
-	Options  Options  `json:"options"`
+	Name     string       `json:"name"`
+	Nodes    []Node       `json:"nodes"`
+	Switches []Zwitch     `json:"switches"`
+	Links    []Link       `json:"links"`
+	Disks    []SharedDisk `json:"disks,omitempty"`
+	Dir      string       `json:"dir"`
+	MgmtIp   string       `json:"mgmtip"`
+	Options  Options      `json:"options"`
 }
 
 type Runtime struct {
 	SubnetTable        [256]bool
 	SubnetReverseTable map[string]int
 	TelnetPorts        []int
+	// Topologies maps the name of every created topology to its directory
+	Topologies map[string]string
 }
 
 type RebootRequest struct {
@@ -111,6 +161,16 @@ type RebootRequest struct {
 	Nodes []string `json:"nodes"`
 }
 
+// Variables ==================================================================
+
+// Locations of rvn state and resources on the host. These are variables so
+// they can be pointed elsewhere, e.g. for testing.
+var (
+	runtimeFile = "/var/rvn/run"
+	templateDir = "/var/rvn/template"
+	imageDir    = "/var/rvn/img"
+)
+
 // Default Values =============================================================
 //
 // The default values are organized by platform. Each platform provides a basic
@@ -357,6 +417,16 @@ func (t *Topo) getHost(name string) *Host {
 	return nil
 }
 
+// hostKind returns 'switch' if name refers to a switch and 'node' otherwise.
+func (t *Topo) hostKind(name string) string {
+	for _, x := range t.Switches {
+		if x.Name == name {
+			return "switch"
+		}
+	}
+	return "node"
+}
+
 func (t *Topo) getLink(name string) *Link {
 	for i, x := range t.Links {
 		if x.Name == name {
@@ -396,14 +466,14 @@ func (r *Runtime) Save() {
 		return
 	}
 
-	err = ioutil.WriteFile("/var/rvn/run", []byte(data), 0644)
+	err = ioutil.WriteFile(runtimeFile, []byte(data), 0644)
 	if err != nil {
 		log.Printf("error saving runtime state - %v", err)
 	}
 }
 
 func LoadRuntime() *Runtime {
-	data, err := ioutil.ReadFile("/var/rvn/run")
+	data, err := ioutil.ReadFile(runtimeFile)
 	if err != nil {
 		log.Fatalf("error reading rvn runtime file - %v", err)
 	}
@@ -416,9 +486,24 @@ func LoadRuntime() *Runtime {
 	if rt.SubnetReverseTable == nil {
 		rt.SubnetReverseTable = make(map[string]int)
 	}
+	if rt.Topologies == nil {
+		rt.Topologies = make(map[string]string)
+	}
 	return rt
 }
 
+func (r *Runtime) AddTopology(name, dir string) {
+	r.Topologies[name] = dir
+	r.Save()
+}
+
+func (r *Runtime) RemoveTopology(name string) {
+	if _, ok := r.Topologies[name]; ok {
+		delete(r.Topologies, name)
+		r.Save()
+	}
+}
+
 func (r *Runtime) AllocateSubnet(tag string) int {
 	i, ok := r.SubnetReverseTable[tag]
 	if ok {
@@ -483,25 +568,13 @@ func remove(s []int, i int) []int {
 
 func RunModel() error {
 
-	// execute the javascript model
-	out, err := exec.Command(
-		"nodejs",
-		"/usr/local/lib/rvn/run_model.js",
-		"model.js",
-	).CombinedOutput()
-
+	// evaluate and lint the model and pull the images it uses
+	topo, err := loadModel(".", PullImages)
 	if err != nil {
-		log.Printf("error running model")
-		log.Printf(string(out))
 		return err
 	}
 
 	// save the result of the model execution in the working directory
-	topo, err := ReadTopo(out)
-	if err != nil {
-		log.Printf("error reading topo %v", err)
-		return err
-	}
 	wd, err := os.Getwd()
 	if err != nil {
 		log.Printf("cannot determine working directory %v", err)
@@ -557,6 +630,22 @@ func LoadTopoFile(path string) (Topo, error) {
 
 }
 
+// SaveTopo writes the topology to the topo.json of the working directory,
+// this is the topology all other rvn commands operate on.
+func SaveTopo(topo Topo) error {
+
+	wd, err := WkDir()
+	if err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(topo, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(wd+"/topo.json", buf, 0644)
+
+}
+
 func WkDir() (string, error) {
 	wd, err := os.Getwd()
 	if err != nil {
@@ -575,6 +664,9 @@ func SrcDir() (string, error) {
 	return wd, nil
 }
 
+// ReadTopo reads a topology and fills in the platform defaults of any values
+// not supplied by the user. Defaults from image manifests are applied when a
+// model is loaded and saved with the topology, see readModel.
 func ReadTopo(src []byte) (Topo, error) {
 	var topo Topo
 	err := json.Unmarshal(src, &topo)
@@ -582,16 +674,19 @@ func ReadTopo(src []byte) (Topo, error) {
 		return topo, err
 	}
 
-	// apply defaults to any values not supplied by user
+	fillInTopo(&topo)
+
+	return topo, nil
+}
+
+// fillInTopo fills in the platform defaults of every host in the topology.
+func fillInTopo(topo *Topo) {
 	for i := 0; i < len(topo.Nodes); i++ {
 		fillInMissing(&topo.Nodes[i].Host)
 	}
-
 	for i := 0; i < len(topo.Switches); i++ {
 		fillInMissing(&topo.Switches[i].Host)
 	}
-
-	return topo, nil
 }
 
 func Rvn2Xir(t *Topo) *xir.Net {
@@ -605,17 +700,19 @@ func Rvn2Xir(t *Topo) *xir.Net {
 		net.Node().Set(xir.Props{"name": x.Name})
 	}
 	for _, x := range t.Links {
-		a := net.GetNodeByName(x.Endpoints[0].Name)
-		if a == nil {
-			log.Errorf("bad node name %s", x.Endpoints[0].Name)
-			continue
+		var endpoints []*xir.Endpoint
+		for _, e := range x.Endpoints {
+			n := net.GetNodeByName(e.Name)
+			if n == nil {
+				log.Errorf("bad node name %s", e.Name)
+				continue
+			}
+			endpoints = append(endpoints, n.Endpoint())
 		}
-		b := net.GetNodeByName(x.Endpoints[1].Name)
-		if b == nil {
-			log.Errorf("bad node name %s", x.Endpoints[1].Name)
+		if len(endpoints) < 2 {
 			continue
 		}
-		net.Link(a.Endpoint(), b.Endpoint())
+		net.Link(endpoints...)
 	}
 
 	return net
@@ -0,0 +1,199 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements the host wide settings of rvn. Settings are read from
+ * /etc/rvn/rvn.yml if it exists, e.g.
+ *
+ *   image-sources:
+ *     - /mnt/images
+ *     - https://mirror.deterlab.net/rvn/img/
+ *   offline: true
+ *   configure:
+ *     parallel: 10
+ *     timeout: 30m
+ *     retries: 2
+ *     backoff: 10s
+ *
+ * and may be overridden from the environment with RVN_IMAGE_SOURCES, a comma
+ * separated list of sources, RVN_OFFLINE, RVN_CONFIGURE_PARALLEL,
+ * RVN_CONFIGURE_TIMEOUT and RVN_CONFIGURE_RETRIES.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Types ======================================================================
+
+// Settings are the host wide settings of rvn.
+type Settings struct {
+	// ImageSources are the places images referred to by name are pulled from,
+	// in order. A source is either an https mirror or a local directory.
+	ImageSources []string `json:"image-sources,omitempty"`
+	// Offline disables all network access when pulling images, an image that
+	// is not in the image store or a local image source is an error.
+	Offline bool `json:"offline,omitempty"`
+	// Configure controls how hosts are configured
+	Configure ConfigureSettings `json:"configure,omitempty"`
+}
+
+// ConfigureSettings control how hosts are configured.
+type ConfigureSettings struct {
+	// Parallel is the most hosts configured at once
+	Parallel int `json:"parallel,omitempty"`
+	// Timeout is how long an attempt to configure a host may take, an attempt
+	// that takes longer is stopped and retried
+	Timeout Duration `json:"timeout,omitempty"`
+	// Retries is how many times the configuration of a host is retried when
+	// the host can not be reached or an attempt times out
+	Retries *int `json:"retries,omitempty"`
+	// Backoff is how long to wait before the first retry, the wait doubles
+	// with every retry
+	Backoff Duration `json:"backoff,omitempty"`
+}
+
+// Duration is a time.Duration written as a string, e.g. 30m.
+type Duration struct {
+	time.Duration
+}
+
+// Variables ==================================================================
+
+var (
+	settingsFile = "/etc/rvn/rvn.yml"
+
+	defaultImageSources = []string{"https://mirror.deterlab.net/rvn/img/"}
+
+	defaultConfigure = ConfigureSettings{
+		Parallel: 10,
+		Timeout:  Duration{30 * time.Minute},
+		Retries:  intPtr(2),
+		Backoff:  Duration{10 * time.Second},
+	}
+)
+
+// Functions ==================================================================
+
+// LoadSettings reads the rvn settings file and applies any overrides from the
+// environment. A missing settings file is not an error, the defaults are used.
+func LoadSettings() (*Settings, error) {
+
+	s := &Settings{}
+
+	data, err := ioutil.ReadFile(settingsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading settings - %v", err)
+	}
+	if err == nil {
+		err = yaml.UnmarshalStrict(data, s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", settingsFile, err)
+		}
+	}
+
+	if v, ok := os.LookupEnv("RVN_IMAGE_SOURCES"); ok {
+		s.ImageSources = nil
+		for _, x := range strings.Split(v, ",") {
+			x = strings.TrimSpace(x)
+			if x != "" {
+				s.ImageSources = append(s.ImageSources, x)
+			}
+		}
+	}
+
+	if v, ok := os.LookupEnv("RVN_OFFLINE"); ok {
+		s.Offline, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad RVN_OFFLINE '%s' - expected true or false", v)
+		}
+	}
+
+	if v, ok := os.LookupEnv("RVN_CONFIGURE_PARALLEL"); ok {
+		s.Configure.Parallel, err = strconv.Atoi(v)
+		if err != nil || s.Configure.Parallel < 1 {
+			return nil, fmt.Errorf("bad RVN_CONFIGURE_PARALLEL '%s' - expected a "+
+				"positive number", v)
+		}
+	}
+
+	if v, ok := os.LookupEnv("RVN_CONFIGURE_TIMEOUT"); ok {
+		s.Configure.Timeout.Duration, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad RVN_CONFIGURE_TIMEOUT '%s' - expected a "+
+				"duration, e.g. 30m", v)
+		}
+	}
+
+	if v, ok := os.LookupEnv("RVN_CONFIGURE_RETRIES"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad RVN_CONFIGURE_RETRIES '%s' - expected a "+
+				"number", v)
+		}
+		s.Configure.Retries = &n
+	}
+
+	if len(s.ImageSources) == 0 {
+		s.ImageSources = defaultImageSources
+	}
+
+	c := &s.Configure
+	if c.Parallel < 0 || c.Timeout.Duration < 0 || c.Backoff.Duration < 0 ||
+		(c.Retries != nil && *c.Retries < 0) {
+		return nil, fmt.Errorf("%s: configure settings may not be negative",
+			settingsFile)
+	}
+	if c.Parallel == 0 {
+		c.Parallel = defaultConfigure.Parallel
+	}
+	if c.Timeout.Duration == 0 {
+		c.Timeout = defaultConfigure.Timeout
+	}
+	if c.Retries == nil {
+		c.Retries = defaultConfigure.Retries
+	}
+	if c.Backoff.Duration == 0 {
+		c.Backoff = defaultConfigure.Backoff
+	}
+
+	for _, x := range s.ImageSources {
+		if strings.HasPrefix(x, "http://") {
+			return nil, fmt.Errorf("image source %s: http is not supported, "+
+				"please use https", x)
+		}
+	}
+
+	return s, nil
+
+}
+
+// Methods ====================================================================
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(d.String())), nil
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	s, err := strconv.Unquote(string(data))
+	if err != nil {
+		return fmt.Errorf("bad duration %s - expected a string, e.g. \"30m\"",
+			data)
+	}
+	d.Duration, err = time.ParseDuration(s)
+	return err
+}
+
+// Helper Functions ===========================================================
+
+func intPtr(i int) *int {
+	return &i
+}
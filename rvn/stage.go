@@ -0,0 +1,205 @@
+package rvn
+
+/*~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+ *
+ * This file implements the configuration order of hosts. By default every
+ * host is configured at once. A host may declare a configure stage, hosts are
+ * only configured once every host in an earlier stage is, and hosts it comes
+ * after, e.g.
+ *
+ *   switches: stage 0, controller: stage 1, agents: after: ['controller']
+ *
+ * Together these form a graph of dependencies between hosts that is run
+ * with as much parallelism as it allows. When a host fails, the hosts that
+ * depend on it are skipped rather than configured against a broken
+ * prerequisite.
+ *
+ *~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~*/
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Functions ==================================================================
+
+// configDeps returns the hosts each of the given hosts has to wait for before
+// it is configured. Only dependencies among the given hosts are considered,
+// hosts that are not being configured are taken to be configured already.
+func configDeps(topo Topo, hosts []string) map[string][]string {
+
+	in := make(map[string]bool)
+	for _, h := range hosts {
+		in[h] = true
+	}
+
+	deps := make(map[string][]string)
+	for _, name := range hosts {
+		h := topo.getHost(name)
+		if h == nil {
+			continue
+		}
+		for _, other := range hosts {
+			o := topo.getHost(other)
+			if o != nil && o.Stage < h.Stage {
+				deps[name] = append(deps[name], other)
+			}
+		}
+		for _, a := range h.After {
+			if in[a] && !contains(deps[name], a) {
+				deps[name] = append(deps[name], a)
+			}
+		}
+	}
+
+	return deps
+
+}
+
+// findCycle returns a cycle in the dependencies of the hosts, as the list of
+// hosts along it starting and ending with the same host, or nil if there is
+// none.
+func findCycle(hosts []string, deps map[string][]string) []string {
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var path []string
+
+	var visit func(h string) []string
+	visit = func(h string) []string {
+		state[h] = visiting
+		path = append(path, h)
+		for _, d := range deps[h] {
+			switch state[d] {
+			case visiting:
+				for i, x := range path {
+					if x == d {
+						return append(append([]string{}, path[i:]...), d)
+					}
+				}
+			case unvisited:
+				if c := visit(d); c != nil {
+					return c
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[h] = visited
+		return nil
+	}
+
+	for _, h := range hosts {
+		if state[h] == unvisited {
+			if c := visit(h); c != nil {
+				return c
+			}
+		}
+	}
+	return nil
+
+}
+
+// runDAG runs f on every host, each as soon as the hosts it depends on are
+// done, with at most parallel hosts running at once, and returns the outcome
+// for each host. Hosts that depend on a host that failed or was skipped are
+// skipped with a SkipError. The dependencies must not have cycles.
+func runDAG(hosts []string, deps map[string][]string, parallel int,
+	f func(string) error) map[string]error {
+
+	// hosts only take a slot once they are ready to run, so hosts waiting on
+	// others never hold up hosts that could run
+	slots := make(chan struct{}, parallel)
+
+	done := make(map[string]chan struct{})
+	for _, h := range hosts {
+		done[h] = make(chan struct{})
+	}
+
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	results := make(map[string]error)
+
+	for _, h := range hosts {
+		wg.Add(1)
+		go func(h string) {
+
+			defer wg.Done()
+			defer close(done[h])
+
+			var err error
+			for _, d := range deps[h] {
+				<-done[d]
+				mtx.Lock()
+				derr := results[d]
+				mtx.Unlock()
+				if derr != nil && err == nil {
+					err = &SkipError{Prereq: d, Err: derr}
+				}
+			}
+
+			if err != nil {
+				log.Printf("skipping %s - %v", h, err)
+			} else {
+				slots <- struct{}{}
+				err = f(h)
+				<-slots
+			}
+
+			mtx.Lock()
+			results[h] = err
+			mtx.Unlock()
+
+		}(h)
+	}
+
+	wg.Wait()
+	return results
+
+}
+
+// configureHosts configures the named hosts in the order their stages and
+// dependencies call for, as the configure settings say. The returned
+// ErrorList has an entry for every host that failed or was skipped.
+func configureHosts(topo Topo, hosts []string, status map[string]DomStatus,
+	withUserConfig bool) error {
+
+	settings, err := LoadSettings()
+	if err != nil {
+		return topoError(topo.Name, "configure", err)
+	}
+	cs := settings.Configure
+
+	deps := configDeps(topo, hosts)
+	if c := findCycle(hosts, deps); c != nil {
+		return topoError(topo.Name, "configure",
+			fmt.Errorf("configuration order has a cycle: %s",
+				strings.Join(c, " -> ")))
+	}
+
+	results := runDAG(hosts, deps, cs.Parallel, func(host string) error {
+		h := topo.getHost(host)
+		s, ok := status[host]
+		if h == nil || !ok {
+			return fmt.Errorf("not in topology")
+		}
+		return configureWithRetries(topo, *h, s, withUserConfig, cs)
+	})
+
+	var errs ErrorList
+	for _, h := range hosts {
+		err := results[h]
+		if _, ok := err.(*SkipError); ok {
+			store.Set(stateKey(topo.Name, h), "skipped")
+		}
+		errs.Add(resourceError(topo.hostKind(h), h, "configure", err))
+	}
+	return errs.Err()
+
+}
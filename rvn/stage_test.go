@@ -0,0 +1,144 @@
+package rvn
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var orderTopo = Topo{
+	Name: "order",
+	Nodes: []Node{
+		{Host{Name: "ctl", Stage: 1}},
+		{Host{Name: "agent0", Stage: 1, After: []string{"ctl"}}},
+		{Host{Name: "agent1", Stage: 1, After: []string{"ctl"}}},
+		{Host{Name: "db"}},
+	},
+	Switches: []Zwitch{
+		{Host{Name: "sw"}},
+	},
+}
+
+func TestConfigDeps(t *testing.T) {
+
+	hosts := []string{"ctl", "agent0", "agent1", "db", "sw"}
+	deps := configDeps(orderTopo, hosts)
+	expected := map[string][]string{
+		"ctl":    {"db", "sw"},
+		"agent0": {"db", "sw", "ctl"},
+		"agent1": {"db", "sw", "ctl"},
+	}
+	if !reflect.DeepEqual(deps, expected) {
+		t.Errorf("unexpected deps %v", deps)
+	}
+
+	// hosts that are not being configured are not waited for
+	deps = configDeps(orderTopo, []string{"agent0", "sw"})
+	expected = map[string][]string{"agent0": {"sw"}}
+	if !reflect.DeepEqual(deps, expected) {
+		t.Errorf("unexpected deps %v", deps)
+	}
+
+	if c := findCycle(hosts, configDeps(orderTopo, hosts)); c != nil {
+		t.Errorf("unexpected cycle %v", c)
+	}
+
+	c := findCycle([]string{"a", "b", "c", "d"}, map[string][]string{
+		"a": {"b"}, "b": {"c"}, "c": {"d", "b"},
+	})
+	if !reflect.DeepEqual(c, []string{"b", "c", "b"}) {
+		t.Errorf("unexpected cycle %v", c)
+	}
+
+}
+
+func TestRunDAG(t *testing.T) {
+
+	hosts := []string{"ctl", "agent0", "agent1", "db", "sw"}
+	deps := configDeps(orderTopo, hosts)
+
+	var mtx sync.Mutex
+	finished := make(map[string]time.Time)
+	started := make(map[string]time.Time)
+	run := func(fail string) func(string) error {
+		return func(h string) error {
+			mtx.Lock()
+			started[h] = time.Now()
+			mtx.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mtx.Lock()
+			finished[h] = time.Now()
+			mtx.Unlock()
+			if h == fail {
+				return fmt.Errorf("boom")
+			}
+			return nil
+		}
+	}
+
+	results := runDAG(hosts, deps, len(hosts), run(""))
+	for _, h := range hosts {
+		if results[h] != nil {
+			t.Errorf("%s: unexpected error %v", h, results[h])
+		}
+		for _, d := range deps[h] {
+			if started[h].Before(finished[d]) {
+				t.Errorf("%s started before %s finished", h, d)
+			}
+		}
+	}
+	// hosts without a dependency between them run at the same time
+	if !started["agent0"].Before(finished["agent1"]) ||
+		!started["db"].Before(finished["sw"]) {
+		t.Errorf("independent hosts did not run in parallel")
+	}
+
+	// at most parallel hosts run at once
+	running, most := 0, 0
+	runDAG(hosts, deps, 2, func(h string) error {
+		mtx.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mtx.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mtx.Lock()
+		running--
+		mtx.Unlock()
+		return nil
+	})
+	if most != 2 {
+		t.Errorf("expected at most 2 hosts at once, got %d", most)
+	}
+
+	started = make(map[string]time.Time)
+	results = runDAG(hosts, deps, len(hosts), run("sw"))
+	if len(started) != 2 {
+		t.Errorf("dependents of sw ran: %v", started)
+	}
+	if results["sw"] == nil || results["db"] != nil {
+		t.Errorf("unexpected results %v", results)
+	}
+	skip, ok := results["agent0"].(*SkipError)
+	if !ok || skip.Prereq != "sw" {
+		t.Errorf("expected agent0 to be skipped for sw, got %v", results["agent0"])
+	}
+	if results["ctl"].Error() != "skipped, sw failed" ||
+		results["agent1"].Error() != "skipped, sw failed" {
+		t.Errorf("unexpected skip reasons %v", results)
+	}
+
+	started = make(map[string]time.Time)
+	results = runDAG(hosts, deps, len(hosts), run("ctl"))
+	if len(started) != 3 || results["agent0"].Error() != "skipped, ctl failed" {
+		t.Errorf("unexpected results %v", results)
+	}
+	chained := &SkipError{Prereq: "agent0", Err: results["agent0"]}
+	if chained.Error() != "skipped, agent0 was skipped" {
+		t.Errorf("unexpected skip reason %v", chained)
+	}
+
+}
@@ -0,0 +1,1025 @@
+package rvn
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	xlibvirt "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+)
+
+// Types ======================================================================
+
+// DomStatus encapsulates various information about a libvirt domain for
+// purposes of serialization and presentation.
+type DomStatus struct {
+	Name        string
+	State       string
+	ConfigState string
+	IP          string
+	Macs        []string
+	VNC         int
+
+	// ConfigLog is the latest configuration log of a domain that failed to
+	// configure
+	ConfigLog string `json:",omitempty"`
+}
+
+// LinkStatus encapsulates the state of a link for purposes of serialization
+// and presentation.
+type LinkStatus struct {
+	Name      string
+	State     string
+	Emulation *Emulation
+}
+
+// Functions ==================================================================
+
+// Create creates a libvirt definition for the supplied topology.  It does not
+// launch the system. For that functionality use the Launch function. If a
+// topology with the same name as the topology provided as an argument exists,
+// that topology will be overwritten by the system generated from the argument.
+// Create keeps going when individual resources fail, the returned ErrorList
+// holds a ResourceError for every node, link or step that failed.
+func Create() error {
+
+	wd, err := WkDir()
+	if err != nil {
+		return fmt.Errorf("create: failed to get working dir - %v", err)
+	}
+
+	topo, err := LoadTopo()
+	if err != nil {
+		return fmt.Errorf("create: failed to load topo - %v", err)
+	}
+
+	topoDir := wd
+	os.MkdirAll(topoDir, 0755)
+
+	var errs ErrorList
+	doms := make(map[string]*xlibvirt.Domain)
+	nets := make(map[string]*xlibvirt.Network)
+
+	subnet := LoadRuntime().AllocateSubnet(topo.Name)
+	if subnet < 0 {
+		return topoError(topo.Name, "subnet", fmt.Errorf("no free subnets"))
+	}
+	topo.MgmtIp = fmt.Sprintf("172.22.%d.1", subnet)
+	LoadRuntime().AddTopology(topo.Name, topo.Dir)
+
+	nets["test"] = &xlibvirt.Network{
+		Name: topo.QualifyName("test"),
+		IPs: []xlibvirt.NetworkIP{
+			xlibvirt.NetworkIP{
+				Address: topo.MgmtIp,
+				Netmask: "255.255.255.0",
+				DHCP: &xlibvirt.NetworkDHCP{
+					Ranges: []xlibvirt.NetworkDHCPRange{
+						xlibvirt.NetworkDHCPRange{
+							Start: fmt.Sprintf("172.22.%d.2", subnet),
+							End:   fmt.Sprintf("172.22.%d.254", subnet),
+						},
+					},
+				},
+			},
+		},
+		Domain: &xlibvirt.NetworkDomain{
+			Name:      topo.Name + ".net",
+			LocalOnly: "yes",
+		},
+		Forward: &xlibvirt.NetworkForward{
+			Mode: "nat",
+		},
+	}
+
+	// shared disks are attached to their hosts as the hosts are created
+	errs.Add(createSharedDisks(&topo))
+
+	for _, node := range topo.Nodes {
+		d, err := newDom(&node.Host, &topo)
+		if err != nil {
+			errs.Add(nodeError(node.Name, "image", err))
+			continue
+		}
+		errs.Add(nodeError(node.Name, "genconfig", GenConfig(node.Host, topo)))
+		errs.Add(nodeError(node.Name, "genseed", GenSeed(node.Host, topo)))
+		doms[node.Name] = d
+		if !node.NoTestNet {
+			domConnect(topo.QualifyName("test"), &node.Host, d, nil)
+		}
+	}
+
+	for _, zwitch := range topo.Switches {
+		d, err := newDom(&zwitch.Host, &topo)
+		if err != nil {
+			errs.Add(switchError(zwitch.Name, "image", err))
+			continue
+		}
+		errs.Add(
+			switchError(zwitch.Name, "genconfig", GenConfig(zwitch.Host, topo)))
+		errs.Add(
+			switchError(zwitch.Name, "genseed", GenSeed(zwitch.Host, topo)))
+		doms[zwitch.Name] = d
+		if !zwitch.NoTestNet {
+			domConnect(topo.QualifyName("test"), &zwitch.Host, d, nil)
+		}
+	}
+
+	for _, link := range topo.Links {
+
+		n := &xlibvirt.Network{
+			Name:   topo.QualifyName(link.Name),
+			Bridge: &xlibvirt.NetworkBridge{Delay: "0", STP: "off"},
+		}
+
+		nets[link.Name] = n
+
+	}
+
+	err = resolveLinks(&topo)
+	if err != nil {
+		errs.Add(err)
+		return errs
+	}
+
+	for _, x := range topo.Nodes {
+		d, ok := doms[x.Name]
+		if !ok {
+			continue
+		}
+		for _, p := range x.ports {
+			domConnect(
+				topo.QualifyName(p.Link),
+				&x.Host,
+				d,
+				topo.getLink(p.Link).Props)
+		}
+	}
+	for _, x := range topo.Switches {
+		d, ok := doms[x.Name]
+		if !ok {
+			continue
+		}
+		for _, p := range x.ports {
+			domConnect(
+				topo.QualifyName(p.Link),
+				&x.Host,
+				d,
+				topo.getLink(p.Link).Props)
+		}
+	}
+
+	err = SaveTopo(topo)
+	if err != nil {
+		errs.Add(topoError(topo.Name, "save", err))
+		return errs
+	}
+
+	for name, d := range doms {
+		xml, err := d.Marshal()
+		if err != nil {
+			errs.Add(resourceError(topo.hostKind(name), name, "marshal", err))
+			continue
+		}
+		ioutil.WriteFile(topoDir+"/dom_"+d.Name+".xml", []byte(xml), 0644)
+
+		errs.Add(resourceError(
+			topo.hostKind(name), name, "define", backend.DefineDomain(d)))
+	}
+
+	for name, n := range nets {
+		xml, err := n.Marshal()
+		if err != nil {
+			errs.Add(networkError(name, "marshal", err))
+			continue
+		}
+		ioutil.WriteFile(topoDir+"/net_"+n.Name+".xml", []byte(xml), 0644)
+
+		errs.Add(networkError(name, "define", backend.DefineNetwork(n)))
+	}
+
+	return errs.Err()
+
+}
+
+// Destroy completely wipes out a topology with the given name. If the system
+// is running within libvirt it is torn down. The entire definition of the
+// system is also removed from libvirt. Like Create, Destroy keeps going when
+// individual resources fail and returns an ErrorList of all failures.
+func Destroy() error {
+
+	wd, err := WkDir()
+	if err != nil {
+		return fmt.Errorf("destroy: failed to get working dir - %v", err)
+	}
+
+	topo, err := LoadTopo()
+	if os.IsNotExist(err) {
+		//nothing to destroy
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("destroy: failed to load topology - %v", err)
+	}
+	topoDir := wd
+
+	var errs ErrorList
+
+	for _, x := range topo.Nodes {
+		errs.Add(nodeError(x.Name, "undefine",
+			backend.UndefineDomain(topo.QualifyName(x.Name))))
+		if x.Host.TelnetPort != 0 {
+			LoadRuntime().FreeTelnetPort(x.Host.TelnetPort)
+		}
+		errs.Add(nodeError(x.Name, "clear-state", store.Del(
+			stateKey(topo.Name, x.Name), historyKey(topo.Name, x.Name))))
+	}
+	for _, x := range topo.Switches {
+		if x.Host.TelnetPort != 0 {
+			LoadRuntime().FreeTelnetPort(x.Host.TelnetPort)
+		}
+		errs.Add(switchError(x.Name, "undefine",
+			backend.UndefineDomain(topo.QualifyName(x.Name))))
+		errs.Add(switchError(x.Name, "clear-state", store.Del(
+			stateKey(topo.Name, x.Name), historyKey(topo.Name, x.Name))))
+	}
+
+	for _, x := range topo.Links {
+		errs.Add(linkError(x.Name, "cleanup",
+			backend.CleanupLinkNetwork(topo.QualifyName(x.Name))))
+		errs.Add(linkError(x.Name, "undefine",
+			backend.UndefineNetwork(topo.QualifyName(x.Name))))
+	}
+	errs.Add(networkError("test", "cleanup",
+		backend.CleanupTestNetwork(topo.QualifyName("test"))))
+	errs.Add(networkError("test", "undefine",
+		backend.UndefineNetwork(topo.QualifyName("test"))))
+	LoadRuntime().FreeSubnet(topo.Name)
+	LoadRuntime().RemoveTopology(topo.Name)
+	errs.Add(topoError(topo.Name, "nfs-unexport", UnexportNFS(topo.Name)))
+
+	errs.Add(topoError(topo.Name, "cleanup", os.RemoveAll(topoDir)))
+
+	return errs.Err()
+}
+
+// Shutdown turns of a virtual machine gracefully
+func Shutdown() []error {
+
+	topo, err := LoadTopo()
+	if err != nil {
+		if strings.Contains(err.Error(), "topo.json: no such file or directory") {
+			log.Printf("Topology not built. Use `rvn build` first")
+			return []error{}
+		}
+		return []error{fmt.Errorf("shutdown: failed to load topo")}
+	}
+
+	errs := []error{}
+	for _, x := range topo.Nodes {
+		err := backend.ShutdownDomain(topo.QualifyName(x.Name))
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, x := range topo.Switches {
+		err := backend.ShutdownDomain(topo.QualifyName(x.Name))
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func WipeNode(topo Topo, name string) error {
+	h := topo.getHost(name)
+	if h == nil {
+		return fmt.Errorf("host %s does not exist", name)
+	}
+	err := backend.UndefineDomain(topo.QualifyName(name))
+	if err != nil {
+		return nodeError(name, "undefine", err)
+	}
+	d, err := newDom(h, &topo)
+	if err != nil {
+		return nodeError(name, "image", err)
+	}
+
+	if !h.NoTestNet {
+		domConnect(topo.QualifyName("test"), h, d, nil)
+	}
+	err = resolveLinks(&topo)
+	if err != nil {
+		return err
+	}
+	for _, p := range h.ports {
+		domConnect(
+			topo.QualifyName(p.Link),
+			h,
+			d,
+			topo.getLink(p.Link).Props)
+	}
+
+	err = backend.DefineDomain(d)
+	if err != nil {
+		return nodeError(name, "define", err)
+	}
+	err = backend.StartDomain(d.Name)
+	if err != nil {
+		return nodeError(name, "start", err)
+	}
+
+	// the new domain has fresh interfaces, so the emulation of its links has to
+	// be reapplied
+	for _, p := range h.ports {
+		l := topo.getLink(p.Link)
+		if l.Emulation.Empty() {
+			continue
+		}
+		err := backend.EmulateLink(topo.QualifyName(l.Name), l.Emulation)
+		if err != nil {
+			return linkError(l.Name, "emulation", err)
+		}
+	}
+
+	return nil
+}
+
+// Launch brings up the system with the given name. This system must exist
+// visa-vis the create function before calling Launch. The return value is
+// a list of diagnostic strings that were provided by libvirt when launching
+// the system. The existence of diagnostics does not necessarily indicate
+// an error in launching. This function is asynchronous, when it returns the
+// system is still launching. Use the Status function to check up on a the
+// launch process.
+func Launch() []string {
+	//TODO name should probably be something more like 'deploy'
+
+	topo, err := LoadTopo()
+	if err != nil {
+		if strings.Contains(err.Error(), "topo.json: no such file or directory") {
+			log.Printf("Topology not built. Use `rvn build` first")
+			return []string{}
+		}
+		err := fmt.Errorf("failed to load topo %v", err)
+		return []string{fmt.Sprintf("%v", err)}
+	}
+
+	//collect all the doamins and networks first so we know everything we need
+	//exists
+	var errors []string
+	var doms []string
+	var nets []string
+
+	for _, x := range topo.Nodes {
+		name := topo.QualifyName(x.Name)
+		_, err := backend.DomainActive(name)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %v", x.Name, err))
+		} else {
+			doms = append(doms, name)
+		}
+	}
+	for _, x := range topo.Switches {
+		name := topo.QualifyName(x.Name)
+		_, err := backend.DomainActive(name)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %v", x.Name, err))
+		} else {
+			doms = append(doms, name)
+		}
+	}
+
+	for _, x := range topo.Links {
+		name := topo.QualifyName(x.Name)
+		_, err := backend.NetworkActive(name)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %v", x.Name, err))
+		} else {
+			nets = append(nets, name)
+		}
+	}
+
+	//test network
+	_, err = backend.NetworkActive(topo.QualifyName("test"))
+	if err != nil {
+		errors = append(errors, fmt.Sprintf("%s: %v", "test", err))
+	} else {
+		nets = append(nets, topo.QualifyName("test"))
+	}
+
+	for _, name := range nets {
+		active, err := backend.NetworkActive(name)
+		if err == nil && !active {
+			err := backend.StartNetwork(name)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("%s: %v", name, err))
+				continue
+			}
+			if name != topo.QualifyName("test") {
+				err = backend.SetupLinkNetwork(name)
+				if err != nil {
+					errors = append(errors, fmt.Sprintf("%s: %v", name, err))
+				}
+			}
+		}
+		// rpcbind is opened up to the test network on every launch, whether or
+		// not the network was already running
+		if name == topo.QualifyName("test") {
+			err := backend.SetupTestNetwork(name)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("%s: %v", name, err))
+			}
+		}
+	}
+
+	// links that have been taken down stay down across deployments
+	for _, x := range topo.Links {
+		if !x.Down {
+			continue
+		}
+		err := backend.SetLinkState(topo.QualifyName(x.Name), false)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %v", x.Name, err))
+		}
+	}
+
+	for _, name := range doms {
+		active, err := backend.DomainActive(name)
+		if err == nil && !active {
+			err := backend.StartDomain(name)
+			if err != nil {
+				errors = append(errors, fmt.Sprintf("%s: %v", name, err))
+			}
+		}
+	}
+
+	// link emulation is applied to the domain side of each link so it can only
+	// happen once the domains are up
+	for _, x := range topo.Links {
+		if x.Emulation.Empty() {
+			continue
+		}
+		err := backend.EmulateLink(topo.QualifyName(x.Name), x.Emulation)
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %v", x.Name, err))
+		}
+	}
+
+	return errors
+}
+
+// Domain info fetches the libvirt domain information about host within a
+// raven topology
+func DomainInfo(topo, name string) (*xlibvirt.Domain, error) {
+
+	return backend.DomainInfo(topo + "_" + name)
+
+}
+
+// The status function returns the runtime status of a topology, node by node
+// and network by network.
+func Status() map[string]interface{} {
+
+	status := make(map[string]interface{})
+
+	topo, err := LoadTopo()
+	if err != nil {
+		if strings.Contains(err.Error(), "topo.json: no such file or directory") {
+			log.Printf("Topology not built. Use `rvn build` first")
+			return nil
+		}
+		log.Printf("status: failed to load topo - %v", err)
+		return nil
+	}
+
+	nodes := make(map[string]DomStatus)
+	status["nodes"] = nodes
+
+	switches := make(map[string]DomStatus)
+	status["switches"] = switches
+
+	links := make(map[string]LinkStatus)
+	status["links"] = links
+
+	for _, x := range topo.Nodes {
+		nodes[x.Name] = domainStatus(topo.Name, x.Name)
+	}
+	for _, x := range topo.Switches {
+		switches[x.Name] = domainStatus(topo.Name, x.Name)
+	}
+
+	for _, x := range topo.Links {
+		state := networkStatus(topo.QualifyName(x.Name))
+		if state == "up" && x.Down {
+			state = "down"
+		}
+		links[x.Name] = LinkStatus{
+			Name:      x.Name,
+			State:     state,
+			Emulation: x.Emulation,
+		}
+	}
+
+	subnet, ok := LoadRuntime().SubnetReverseTable[topo.Name]
+	if ok {
+		status["mgmtip"] = fmt.Sprintf("172.22.%d.1", subnet)
+	}
+
+	return status
+}
+
+// Domain status returns the current state of a domain (host) within a libvirt
+// topology.
+func DomainStatus(topo, name string) (DomStatus, error) {
+	return domainStatus(topo, name), nil
+}
+
+// Reboot attempts to gracefully reboot a raven host
+func Reboot(rr RebootRequest) error {
+
+	topo, err := LoadTopo()
+	if err != nil {
+		return err
+	}
+
+	var errs ErrorList
+	for _, x := range rr.Nodes {
+
+		//seabios is not responsive to a reboot request, have to pull the plug
+		h := topo.getHost(x)
+		reset := h != nil && h.OS == "netboot"
+
+		err := backend.RebootDomain(fmt.Sprintf("%s_%s", rr.Topo, x), reset)
+		if topo.hostKind(x) == "switch" {
+			errs.Add(switchError(x, "reboot", err))
+		} else {
+			errs.Add(nodeError(x, "reboot", err))
+		}
+
+	}
+
+	return errs.Err()
+
+}
+
+// Helper Functions ===========================================================
+
+func newDom(h *Host, t *Topo) (*xlibvirt.Domain, error) {
+
+	switch h.Platform {
+
+	case "x86_64":
+		return x86Dom(h, t)
+
+	case "arm7":
+		return arm7Dom(h, t)
+
+	default:
+		log.Printf("unrecognized platform - using x86_64")
+		return x86Dom(h, t)
+
+	}
+}
+
+func createModel(h *Host) *xlibvirt.DomainCPUModel {
+	if h.CPU.Model == "" {
+		return nil
+	} else {
+		return &xlibvirt.DomainCPUModel{Value: h.CPU.Model}
+	}
+}
+
+func x86Dom(h *Host, t *Topo) (*xlibvirt.Domain, error) {
+
+	instanceImage, err := createImage(h)
+	if err != nil {
+		return nil, err
+	}
+
+	disks, err := createDisks(h, t)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &xlibvirt.Domain{
+		Type: "kvm",
+		Name: t.QualifyName(h.Name),
+		Features: &xlibvirt.DomainFeatureList{
+			ACPI: &xlibvirt.DomainFeature{},
+			APIC: &xlibvirt.DomainFeatureAPIC{},
+		},
+		OS: &xlibvirt.DomainOS{
+			Type:    &xlibvirt.DomainOSType{Type: "hvm"},
+			Kernel:  findKernel(h),
+			Initrd:  findInitrd(h),
+			Cmdline: h.Cmdline,
+		},
+		CPU: &xlibvirt.DomainCPU{
+
+			Match: "minimum",
+			//TODO: plumb this capability in ....
+			//Mode: "host-passthrough",
+			Model: createModel(h),
+			Topology: &xlibvirt.DomainCPUTopology{
+				Sockets: h.CPU.Sockets,
+				Cores:   h.CPU.Cores,
+				Threads: h.CPU.Threads,
+			},
+		},
+		VCPU: &xlibvirt.DomainVCPU{
+			Value: h.CPU.Sockets * h.CPU.Cores * h.CPU.Threads,
+		},
+		Memory: &xlibvirt.DomainMemory{
+			Value: uint(h.Memory.Capacity.Value),
+			Unit:  h.Memory.Capacity.Unit,
+		},
+		Devices: &xlibvirt.DomainDeviceList{
+			Serials: []xlibvirt.DomainSerial{
+				xlibvirt.DomainSerial{
+					Source: &xlibvirt.DomainChardevSource{
+						Pty: &xlibvirt.DomainChardevSourcePty{},
+					},
+				},
+				xlibvirt.DomainSerial{
+					Source: &xlibvirt.DomainChardevSource{
+						TCP: &xlibvirt.DomainChardevSourceTCP{
+							Mode:    "bind",
+							Host:    "localhost",
+							Service: fmt.Sprintf("%d", h.TelnetPort),
+						},
+					},
+					Protocol: &xlibvirt.DomainChardevProtocol{
+						Type: "telnet",
+					},
+				},
+			},
+			Consoles: []xlibvirt.DomainConsole{
+				xlibvirt.DomainConsole{
+					Source: &xlibvirt.DomainChardevSource{
+						Pty: &xlibvirt.DomainChardevSourcePty{},
+					},
+					Target: &xlibvirt.DomainConsoleTarget{Type: "serial"},
+				},
+			},
+			Graphics: []xlibvirt.DomainGraphic{
+				createGraphics(t),
+				/*
+					xlibvirt.DomainGraphic{
+						VNC: &xlibvirt.DomainGraphicVNC{
+							Port:     -1,
+							AutoPort: "yes",
+						},
+					},
+				*/
+			},
+			Disks: []xlibvirt.DomainDisk{
+				xlibvirt.DomainDisk{
+					Device: "disk",
+					Driver: &xlibvirt.DomainDiskDriver{Name: "qemu", Type: "qcow2"},
+					Source: &xlibvirt.DomainDiskSource{
+						File: &xlibvirt.DomainDiskSourceFile{
+							File: instanceImage,
+						},
+					},
+					Target: &xlibvirt.DomainDiskTarget{
+						Dev: h.DefaultDisktype.Dev + "a",
+						Bus: h.DefaultDisktype.Bus,
+					},
+				},
+			},
+		},
+	}
+	d.Devices.Disks = append(d.Devices.Disks, disks...)
+	attachMounts(h, t, d)
+
+	return d, nil
+
+}
+
+func createGraphics(t *Topo) xlibvirt.DomainGraphic {
+	switch t.Options.Display {
+	case "local":
+		return xlibvirt.DomainGraphic{
+			Desktop: &xlibvirt.DomainGraphicDesktop{
+				Display: "gtk",
+			},
+		}
+	default:
+		return xlibvirt.DomainGraphic{
+			VNC: &xlibvirt.DomainGraphicVNC{
+				Port:     -1,
+				AutoPort: "yes",
+			},
+		}
+	}
+}
+
+func createImage(h *Host) (string, error) {
+
+	wd, err := WkDir()
+	if err != nil {
+		return "", err
+	}
+
+	baseImage, err := ImagePath(h.Image)
+	if err != nil {
+		return "", err
+	}
+
+	var size int64
+	if h.DiskSize != nil {
+		size, err = h.DiskSize.Bytes()
+		if err != nil {
+			return "", fmt.Errorf("disksize: %v", err)
+		}
+		info, err := backend.ImageInfo(baseImage)
+		if err != nil {
+			return "", err
+		}
+		if size < info.VirtualSize {
+			return "", fmt.Errorf("disksize %d%s is smaller than image %s",
+				h.DiskSize.Value, h.DiskSize.Unit, h.Image)
+		}
+	}
+
+	instanceImage := wd + "/" + h.Name
+	os.RemoveAll(instanceImage)
+
+	err = backend.CreateImage(instanceImage, baseImage, size)
+	if err != nil {
+		return "", err
+	}
+
+	return instanceImage, nil
+
+}
+
+func arm7Dom(h *Host, t *Topo) (*xlibvirt.Domain, error) {
+
+	instanceImage, err := createImage(h)
+	if err != nil {
+		return nil, err
+	}
+
+	disks, err := createDisks(h, t)
+	if err != nil {
+		return nil, err
+	}
+
+	// construct the vm
+	d := &xlibvirt.Domain{
+		Type: "qemu",
+		Name: t.QualifyName(h.Name),
+		OS: &xlibvirt.DomainOS{
+			Type: &xlibvirt.DomainOSType{
+				Type:    "hvm",
+				Arch:    h.Arch,
+				Machine: h.Machine,
+			},
+			Kernel: findKernel(h),
+		},
+		CPU: &xlibvirt.DomainCPU{
+			Mode:  "custom",
+			Match: "exact",
+			Topology: &xlibvirt.DomainCPUTopology{
+				Sockets: h.CPU.Sockets,
+				Cores:   h.CPU.Cores,
+				Threads: h.CPU.Threads,
+			},
+			Model: &xlibvirt.DomainCPUModel{
+				Value: h.CPU.Model,
+			},
+		},
+		VCPU: &xlibvirt.DomainVCPU{
+			Value: h.CPU.Sockets * h.CPU.Cores * h.CPU.Threads,
+		},
+		Memory: &xlibvirt.DomainMemory{
+			Value: uint(h.Memory.Capacity.Value),
+			Unit:  h.Memory.Capacity.Unit,
+		},
+		Devices: &xlibvirt.DomainDeviceList{
+			Emulator: "/usr/bin/qemu-system-arm",
+			Serials: []xlibvirt.DomainSerial{
+				xlibvirt.DomainSerial{
+					Source: &xlibvirt.DomainChardevSource{
+						TCP: &xlibvirt.DomainChardevSourceTCP{
+							Mode:    "bind",
+							Host:    "localhost",
+							Service: fmt.Sprintf("%d", h.TelnetPort),
+						},
+					},
+					Protocol: &xlibvirt.DomainChardevProtocol{
+						Type: "telnet",
+					},
+				},
+			},
+			Disks: []xlibvirt.DomainDisk{
+				xlibvirt.DomainDisk{
+					Device: "disk",
+					Driver: &xlibvirt.DomainDiskDriver{Name: "qemu", Type: "qcow2"},
+					Source: &xlibvirt.DomainDiskSource{
+						File: &xlibvirt.DomainDiskSourceFile{
+							File: instanceImage,
+						},
+					},
+					Target: &xlibvirt.DomainDiskTarget{
+						Dev: h.DefaultDisktype.Dev + "a",
+						Bus: h.DefaultDisktype.Bus,
+					},
+				},
+			},
+		},
+	}
+	d.Devices.Disks = append(d.Devices.Disks, disks...)
+	attachMounts(h, t, d)
+
+	return d, nil
+
+}
+
+func nextPort(min, max int) int {
+
+	ports := portsInUse(min, max)
+	ports = append(ports, min-1)
+
+	port := nextInt(ports)
+
+	if port > max {
+		log.Printf(
+			"warning: first available port is beyond specified max %d", port)
+	}
+
+	return port
+}
+
+func portsInUse(from, to int) []int {
+
+	cmd := exec.Command(
+		"ss", "-lnt", fmt.Sprintf("( sport >= %d and sport < %d )", from, to))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		fmt.Println(string(out))
+		log.Fatal(err)
+	}
+
+	var result []int
+	lines := strings.Split(string(out), "\n")
+	lines = lines[1 : len(lines)-1]
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		local := fields[3]
+		parts := strings.Split(local, ":")
+		port, _ := strconv.Atoi(parts[len(parts)-1])
+		result = append(result, port)
+	}
+
+	return result
+
+}
+
+func nextInt(ports []int) int {
+
+	sort.Ints(ports)
+	for i := 0; i < len(ports)-1; i++ {
+		if ports[i+1] > ports[i]+1 {
+			return ports[i] + 1
+		}
+	}
+
+	return ports[len(ports)-1] + 1
+
+}
+
+func nextIntFrom(ports []int, start int) int {
+
+	if len(ports) == 0 {
+		return start
+	}
+
+	sort.Ints(ports)
+	for i := 0; i < len(ports)-1; i++ {
+		if ports[i+1] > ports[i]+1 {
+			return ports[i] + 1
+		}
+	}
+
+	return ports[len(ports)-1] + 1
+
+}
+
+func domConnect(
+	net string, h *Host, dom *xlibvirt.Domain, props map[string]interface{}) {
+
+	var boot *xlibvirt.DomainDeviceBoot = nil
+	if strings.ToLower(h.OS) == "netboot" {
+		if props != nil {
+			boot_order, ok := props["boot"]
+			if ok {
+				boot_order_num, ok := boot_order.(float64)
+				if ok {
+					boot = &xlibvirt.DomainDeviceBoot{
+						Order: uint(boot_order_num),
+					}
+				}
+			}
+		}
+	}
+
+	hostNicModel := h.DefaultNic
+	hostProps_, ok := props[h.Name]
+	if ok {
+		hostProps, ok := hostProps_.(map[string]interface{})
+		if ok {
+			hostNic_, ok := hostProps["nic"]
+			if ok {
+				hostNic, ok := hostNic_.(string)
+				if ok {
+					hostNicModel = hostNic
+				}
+			}
+		}
+	}
+
+	dom.Devices.Interfaces = append(dom.Devices.Interfaces,
+		xlibvirt.DomainInterface{
+			Source: &xlibvirt.DomainInterfaceSource{
+				Network: &xlibvirt.DomainInterfaceSourceNetwork{
+					Network: net,
+				},
+			},
+			Model: &xlibvirt.DomainInterfaceModel{Type: hostNicModel},
+			Boot:  boot,
+		})
+}
+
+func resolveLinks(t *Topo) error {
+
+	// 'plug in' the link to each node
+	for _, l := range t.Links {
+		for _, e := range l.Endpoints {
+			h := t.getHost(e.Name)
+			if h == nil {
+				return linkError(l.Name, "resolve",
+					fmt.Errorf("could not find host '%s'", e.Name))
+			}
+			h.ports = append(h.ports, Port{l.Name, e.Port})
+		}
+	}
+
+	// sort the links at each node by index
+	for i := 0; i < len(t.Nodes); i++ {
+		n := &t.Nodes[i]
+		sort.Slice(n.ports, func(i, j int) bool {
+			return n.ports[i].Index < n.ports[j].Index
+		})
+	}
+
+	return nil
+
+}
+
+func domainStatus(topo, name string) DomStatus {
+
+	status, err := backend.DomainState(topo + "_" + name)
+	if err != nil {
+		status.State = "non-existant"
+	}
+	status.Name = name
+	if status.State == "running" {
+		status.ConfigState = configStatus(topo, name)
+		if strings.Contains(status.ConfigState, "failed") {
+			status.ConfigLog = failedLog(name)
+		}
+	}
+	return status
+
+}
+
+func configStatus(topo, name string) string {
+	val, err := store.Get(stateKey(topo, name))
+	if err == nil {
+		return val
+	} else {
+		return ""
+	}
+}
+
+func networkStatus(name string) string {
+	active, err := backend.NetworkActive(name)
+	if err != nil {
+		return "non-existant"
+	}
+	if active {
+		return "up"
+	}
+	return "down"
+}